@@ -16,10 +16,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	args := os.Args[2:]
 	verbose := false
 	if len(os.Args) > 4 {
 		if os.Args[4] == "verbose" {
 			verbose = true
+			args = append(os.Args[2:4:4], os.Args[5:]...)
 		}
 	}
 
@@ -39,7 +41,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := cmd.Run(os.Args[2]); err != nil {
+	if err := cmd.Run(args); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
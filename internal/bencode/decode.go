@@ -0,0 +1,453 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"kbit/pkg/types"
+)
+
+// maxIntLen bounds how many bytes an integer or a string length prefix may
+// span, so a run of digits cannot make the decoder buffer without limit.
+const maxIntLen = 20
+
+// Decoder reads bencoded values incrementally from an io.Reader.
+type Decoder struct {
+	r      *bufio.Reader
+	offset int64
+
+	// capture holds the buffers that currently record every byte consumed,
+	// innermost last.
+	capture []*bytes.Buffer
+
+	// path is the location of the value being decoded, in the form
+	// "info.files[3].path". It is only maintained while spans are recorded
+	// or raw values are kept.
+	path   string
+	spans  map[string]Span
+	keep   map[string]bool
+	raw    map[string][]byte
+	record bool
+
+	opts  DecodeOptions
+	start int64 // offset at which the current top-level value began
+	depth int
+}
+
+// Span is the half-open byte range [Start, End) a value occupied in the
+// input.
+type Span struct {
+	Start, End int64
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// Offset returns the number of input bytes consumed so far.
+func (d *Decoder) Offset() int64 {
+	return d.offset
+}
+
+// RecordSpans makes Decode record the Span of every value it reads, keyed by
+// path. The recorded spans are available from Spans until the next Decode.
+func (d *Decoder) RecordSpans() {
+	d.record = true
+}
+
+// Spans returns the spans recorded by the last Decode, keyed by path such as
+// "", "info" or "info.files[3].path".
+func (d *Decoder) Spans() map[string]Span {
+	return d.spans
+}
+
+// Keep makes Decode retain the exact input bytes of the value at path, so
+// they can be read back with Raw after decoding.
+func (d *Decoder) Keep(path string) {
+	if d.keep == nil {
+		d.keep = make(map[string]bool)
+	}
+	d.keep[path] = true
+}
+
+// Raw returns the original bytes of a value requested with Keep.
+func (d *Decoder) Raw(path string) ([]byte, bool) {
+	raw, ok := d.raw[path]
+	return raw, ok
+}
+
+// Decode reads the next value from the stream. It returns io.EOF when the
+// stream ends cleanly between values.
+func (d *Decoder) Decode() (types.BencodeValue, error) {
+	d.reset()
+	if _, err := d.peekByte(); err == io.EOF {
+		return nil, io.EOF
+	}
+
+	d.spans = nil
+	d.raw = nil
+	if d.record {
+		d.spans = make(map[string]Span)
+	}
+	if len(d.keep) > 0 {
+		d.raw = make(map[string][]byte)
+	}
+	return d.decode()
+}
+
+func (d *Decoder) reset() {
+	d.path = ""
+	d.start = d.offset
+	d.depth = 0
+}
+
+func (d *Decoder) decode() (types.BencodeValue, error) {
+	b, err := d.peekByte()
+	if err != nil {
+		return nil, d.eofError(err)
+	}
+
+	start := d.offset
+	path := d.path
+	var buf *bytes.Buffer
+	if d.raw != nil && d.keep[path] {
+		buf = &bytes.Buffer{}
+		d.capture = append(d.capture, buf)
+		defer func() { d.capture = d.capture[:len(d.capture)-1] }()
+	}
+
+	var val types.BencodeValue
+	switch {
+	case b == 'i':
+		val, err = d.decodeInt()
+	case b == 'l':
+		val, err = d.decodeList()
+	case b == 'd':
+		val, err = d.decodeDict()
+	case isDigit(b):
+		val, err = d.decodeString()
+	default:
+		return nil, d.errorf("unknown bencode type %q", b)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if d.spans != nil {
+		d.spans[path] = Span{Start: start, End: d.offset}
+	}
+	if buf != nil {
+		d.raw[path] = buf.Bytes()
+	}
+	return val, nil
+}
+
+func (d *Decoder) tracking() bool {
+	return d.spans != nil || d.raw != nil
+}
+
+// enterKey moves the current path to the dictionary entry key and returns
+// the previous path so the caller can restore it.
+func (d *Decoder) enterKey(key string) string {
+	parent := d.path
+	if d.tracking() {
+		if parent == "" {
+			d.path = key
+		} else {
+			d.path = parent + "." + key
+		}
+	}
+	return parent
+}
+
+// enterIndex moves the current path to list element i.
+func (d *Decoder) enterIndex(i int) string {
+	parent := d.path
+	if d.tracking() {
+		d.path = parent + "[" + strconv.Itoa(i) + "]"
+	}
+	return parent
+}
+
+func (d *Decoder) decodeInt() (types.BencodeInt, error) {
+	d.readByte() // skip 'i'
+
+	digits, err := d.readUntil('e')
+	if err != nil {
+		return 0, err
+	}
+
+	if d.opts.Strict && !isCanonicalInt(digits) {
+		return 0, d.errorf("non-canonical integer %q", digits)
+	}
+
+	val, err := strconv.ParseInt(string(digits), 10, 64)
+	if err != nil {
+		return 0, d.errorf("invalid integer %q", digits)
+	}
+
+	return types.BencodeInt(val), nil
+}
+
+func (d *Decoder) decodeString() (types.BencodeString, error) {
+	digits, err := d.readUntil(':')
+	if err != nil {
+		return "", err
+	}
+
+	length, err := strconv.ParseInt(string(digits), 10, 64)
+	if err != nil || length < 0 {
+		return "", d.errorf("invalid string length %q", digits)
+	}
+	if d.opts.Strict && len(digits) > 1 && digits[0] == '0' {
+		return "", d.errorf("string length %q has leading zeros", digits)
+	}
+	if d.opts.MaxStringLen > 0 && length > d.opts.MaxStringLen {
+		return "", &LimitError{Offset: d.offset, Limit: "string length", Max: d.opts.MaxStringLen}
+	}
+
+	data, err := d.readN(length)
+	if err != nil {
+		return "", err
+	}
+
+	return types.BencodeString(data), nil
+}
+
+func (d *Decoder) decodeList() (types.BencodeList, error) {
+	if err := d.enterContainer(); err != nil {
+		return nil, err
+	}
+	defer d.leaveContainer()
+
+	d.readByte() // skip 'l'
+	list := types.BencodeList{}
+
+	for {
+		b, err := d.peekByte()
+		if err != nil {
+			return nil, d.eofError(err)
+		}
+		if b == 'e' {
+			break
+		}
+
+		parent := d.enterIndex(len(list))
+		val, err := d.decode()
+		d.path = parent
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, val)
+	}
+
+	d.readByte() // skip 'e'
+	return list, nil
+}
+
+func (d *Decoder) decodeDict() (types.BencodeDict, error) {
+	if err := d.enterContainer(); err != nil {
+		return nil, err
+	}
+	defer d.leaveContainer()
+
+	d.readByte() // skip 'd'
+	dict := make(types.BencodeDict)
+
+	var prev string
+	for i := 0; ; i++ {
+		b, err := d.peekByte()
+		if err != nil {
+			return nil, d.eofError(err)
+		}
+		if b == 'e' {
+			break
+		}
+		if !isDigit(b) {
+			return nil, d.errorf("dictionary key must be a string, got %q", b)
+		}
+
+		key, err := d.decodeString()
+		if err != nil {
+			return nil, err
+		}
+		if err := d.checkKeyOrder(i, prev, string(key)); err != nil {
+			return nil, err
+		}
+		prev = string(key)
+
+		parent := d.enterKey(string(key))
+		val, err := d.decode()
+		d.path = parent
+		if err != nil {
+			return nil, err
+		}
+
+		dict[string(key)] = val
+	}
+
+	d.readByte() // skip 'e'
+	return dict, nil
+}
+
+// enterContainer accounts for one more level of list or dictionary nesting.
+func (d *Decoder) enterContainer() error {
+	d.depth++
+	if d.opts.MaxDepth > 0 && d.depth > d.opts.MaxDepth {
+		return &LimitError{Offset: d.offset, Limit: "depth", Max: int64(d.opts.MaxDepth)}
+	}
+	return nil
+}
+
+func (d *Decoder) leaveContainer() {
+	d.depth--
+}
+
+// checkKeyOrder rejects the i-th key of a dictionary if it does not sort
+// strictly after the previous one in strict mode.
+func (d *Decoder) checkKeyOrder(i int, prev, key string) error {
+	if !d.opts.Strict || i == 0 || prev < key {
+		return nil
+	}
+	if prev == key {
+		return d.errorf("duplicate dictionary key %q", key)
+	}
+	return d.errorf("dictionary key %q is not sorted after %q", key, prev)
+}
+
+// checkSize fails if consuming n more bytes would exceed MaxSize.
+func (d *Decoder) checkSize(n int64) error {
+	if d.opts.MaxSize > 0 && d.offset-d.start+n > d.opts.MaxSize {
+		return &LimitError{Offset: d.offset, Limit: "size", Max: d.opts.MaxSize}
+	}
+	return nil
+}
+
+func (d *Decoder) peekByte() (byte, error) {
+	if err := d.checkSize(1); err != nil {
+		return 0, err
+	}
+	b, err := d.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	if err := d.checkSize(1); err != nil {
+		return 0, err
+	}
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	d.offset++
+	for _, c := range d.capture {
+		c.WriteByte(b)
+	}
+	return b, nil
+}
+
+// readUntil reads the digits leading up to delim and consumes delim itself.
+func (d *Decoder) readUntil(delim byte) ([]byte, error) {
+	var digits []byte
+	for {
+		b, err := d.readByte()
+		if err != nil {
+			return nil, d.eofError(err)
+		}
+		if b == delim {
+			return digits, nil
+		}
+		if !isDigit(b) && b != '-' {
+			return nil, d.errorf("unexpected byte %q, expected %q", b, delim)
+		}
+		if len(digits) >= maxIntLen {
+			return nil, d.errorf("number longer than %d bytes", maxIntLen)
+		}
+		digits = append(digits, b)
+	}
+}
+
+// readN reads exactly n bytes. The buffer grows as data arrives instead of
+// trusting the length prefix, so a bogus prefix cannot force a huge
+// allocation up front.
+func (d *Decoder) readN(n int64) ([]byte, error) {
+	if err := d.checkSize(n); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if n <= 64*1024 {
+		buf.Grow(int(n))
+	}
+
+	copied, err := io.CopyN(&buf, d.r, n)
+	d.offset += copied
+	if err != nil {
+		return nil, d.eofError(err)
+	}
+
+	for _, c := range d.capture {
+		c.Write(buf.Bytes())
+	}
+	return buf.Bytes(), nil
+}
+
+// captureValue decodes the next value and returns the exact bytes it was
+// encoded with.
+func (d *Decoder) captureValue() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	d.capture = append(d.capture, buf)
+	defer func() { d.capture = d.capture[:len(d.capture)-1] }()
+
+	if _, err := d.decode(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// eofError turns a read error into a SyntaxError, reporting a clean EOF in
+// the middle of a value as io.ErrUnexpectedEOF. Limit errors pass through.
+func (d *Decoder) eofError(err error) error {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return err
+	}
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return &SyntaxError{Offset: d.offset, Msg: err.Error(), Err: err}
+}
+
+func (d *Decoder) errorf(format string, args ...any) error {
+	return &SyntaxError{Offset: d.offset, Msg: fmt.Sprintf(format, args...)}
+}
+
+// isCanonicalInt reports whether digits is a BEP 3 integer: no leading
+// zeros, no "-0" and at least one digit.
+func isCanonicalInt(digits []byte) bool {
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+		if len(digits) > 0 && digits[0] == '0' {
+			return false
+		}
+	}
+	if len(digits) == 0 {
+		return false
+	}
+	return digits[0] != '0' || len(digits) == 1
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
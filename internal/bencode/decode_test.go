@@ -0,0 +1,138 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"kbit/pkg/types"
+)
+
+func TestDecoder_MultipleValues(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("i1e3:fooli2eed1:ai3ee"))
+
+	expected := []types.BencodeValue{
+		types.BencodeInt(1),
+		types.BencodeString("foo"),
+		types.BencodeList{types.BencodeInt(2)},
+		types.BencodeDict{"a": types.BencodeInt(3)},
+	}
+
+	for _, want := range expected {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	}
+
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("expected io.EOF at end of stream, got %v", err)
+	}
+}
+
+func TestDecoder_Offset(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("4:spami7e"))
+	if _, err := dec.Decode(); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if dec.Offset() != 6 {
+		t.Errorf("expected offset 6, got %d", dec.Offset())
+	}
+}
+
+func TestDecoder_TruncatedInput(t *testing.T) {
+	for _, input := range []string{"i42", "l4:spam", "d3:foo", "5:ab", "d3:fooi1e"} {
+		_, err := NewDecoder(strings.NewReader(input)).Decode()
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%q: expected io.ErrUnexpectedEOF, got %v", input, err)
+		}
+	}
+}
+
+func TestDecoder_NonStringDictKey(t *testing.T) {
+	_, err := NewDecoder(strings.NewReader("di1ei2ee")).Decode()
+	if err == nil {
+		t.Error("expected error for integer dictionary key")
+	}
+}
+
+func TestDecoder_HugeLengthPrefix(t *testing.T) {
+	_, err := NewDecoder(strings.NewReader("99999999999:short")).Decode()
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestEncoder_WritesToWriter(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	if err := enc.Encode(types.BencodeInt(1)); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if err := enc.Encode(types.BencodeDict{"b": types.BencodeString("x"), "a": types.BencodeList{}}); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	if buf.String() != "i1ed1:ale1:b1:xe" {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+}
+
+func TestDecoder_RecordSpans(t *testing.T) {
+	input := "d4:infod5:filesld4:pathl1:aeeee4:name1:xe"
+	dec := NewDecoder(strings.NewReader(input))
+	dec.RecordSpans()
+
+	if _, err := dec.Decode(); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"":                   input,
+		"info":               "d5:filesld4:pathl1:aeeee",
+		"info.files":         "ld4:pathl1:aeee",
+		"info.files[0]":      "d4:pathl1:aee",
+		"info.files[0].path": "l1:ae",
+		"name":               "1:x",
+	}
+	spans := dec.Spans()
+	for path, want := range expected {
+		span, ok := spans[path]
+		if !ok {
+			t.Errorf("no span recorded for %q", path)
+			continue
+		}
+		if got := input[span.Start:span.End]; got != want {
+			t.Errorf("%q: expected %q, got %q", path, want, got)
+		}
+	}
+}
+
+func TestDecoder_KeepRaw(t *testing.T) {
+	// Unsorted keys and a duplicate: re-encoding would not reproduce these bytes.
+	input := "d4:infod1:bi1e1:ai2e1:ai3ee3:zzz0:e"
+	dec := NewDecoder(strings.NewReader(input))
+	dec.Keep("info")
+
+	if _, err := dec.Decode(); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	raw, ok := dec.Raw("info")
+	if !ok {
+		t.Fatal("expected raw bytes for info")
+	}
+	if string(raw) != "d1:bi1e1:ai2e1:ai3ee" {
+		t.Errorf("unexpected raw bytes %q", raw)
+	}
+	if _, ok := dec.Raw("zzz"); ok {
+		t.Error("did not expect raw bytes for a path that was not kept")
+	}
+}
@@ -0,0 +1,83 @@
+package bencode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"kbit/pkg/types"
+)
+
+// Encoder writes bencoded values to an io.Writer.
+type Encoder struct {
+	w *bufio.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// Encode writes v and flushes it to the underlying writer.
+func (e *Encoder) Encode(v types.BencodeValue) error {
+	if err := e.encode(v); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+func (e *Encoder) encode(v types.BencodeValue) error {
+	switch val := v.(type) {
+	case types.BencodeInt:
+		return e.encodeInt(int64(val))
+	case types.BencodeString:
+		return e.encodeString(string(val))
+	case types.BencodeList:
+		return e.encodeList(val)
+	case types.BencodeDict:
+		return e.encodeDict(val)
+	default:
+		return fmt.Errorf("unsupported type %T", v)
+	}
+}
+
+func (e *Encoder) encodeInt(i int64) error {
+	e.w.WriteByte('i')
+	e.w.WriteString(strconv.FormatInt(i, 10))
+	return e.w.WriteByte('e')
+}
+
+func (e *Encoder) encodeString(s string) error {
+	e.w.WriteString(strconv.Itoa(len(s)))
+	e.w.WriteByte(':')
+	_, err := e.w.WriteString(s)
+	return err
+}
+
+func (e *Encoder) encodeList(list types.BencodeList) error {
+	e.w.WriteByte('l')
+	for _, item := range list {
+		if err := e.encode(item); err != nil {
+			return err
+		}
+	}
+	return e.w.WriteByte('e')
+}
+
+func (e *Encoder) encodeDict(dict types.BencodeDict) error {
+	keys := make([]string, 0, len(dict))
+	for key := range dict {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	e.w.WriteByte('d')
+	for _, key := range keys {
+		e.encodeString(key)
+		if err := e.encode(dict[key]); err != nil {
+			return err
+		}
+	}
+	return e.w.WriteByte('e')
+}
@@ -0,0 +1,33 @@
+package bencode
+
+import (
+	"fmt"
+)
+
+// SyntaxError reports malformed input, or input that breaks BEP 3 while the
+// decoder runs in strict mode. Err is set when the error has an underlying
+// cause, such as io.ErrUnexpectedEOF for truncated input.
+type SyntaxError struct {
+	Offset int64
+	Msg    string
+	Err    error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: offset %d: %s", e.Offset, e.Msg)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// LimitError reports input that exceeds one of the DecodeOptions limits.
+type LimitError struct {
+	Offset int64
+	Limit  string // "depth", "string length" or "size"
+	Max    int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("bencode: offset %d: %s exceeds limit of %d", e.Offset, e.Limit, e.Max)
+}
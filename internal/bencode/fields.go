@@ -0,0 +1,87 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RawMessage is a raw encoded bencode value. It can be used to delay
+// decoding part of a message or to keep its exact original bytes.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+type structFields struct {
+	list   []field // sorted by name, the order Marshal writes them in
+	byName map[string]int
+}
+
+var fieldCache sync.Map // map[reflect.Type]*structFields
+
+// cachedFields returns the bencode fields of struct type t. A field is keyed
+// by its `bencode:"name,omitempty"` tag, or by its Go name when untagged;
+// a tag of "-" skips it.
+func cachedFields(t reflect.Type) *structFields {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(*structFields)
+	}
+
+	fields := &structFields{byName: make(map[string]int)}
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+		fields.list = append(fields.list, field{
+			name:      name,
+			index:     i,
+			omitEmpty: opts == "omitempty",
+		})
+	}
+
+	sort.Slice(fields.list, func(a, b int) bool {
+		return fields.list[a].name < fields.list[b].name
+	})
+	for i, f := range fields.list {
+		fields.byName[f.name] = i
+	}
+
+	actual, _ := fieldCache.LoadOrStore(t, fields)
+	return actual.(*structFields)
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String, reflect.Array:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	case reflect.Struct:
+		return v.IsZero()
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package bencode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"kbit/pkg/types"
+)
+
+// binaryPrefix marks a JSON string that carries base64 rather than text.
+// Strings that are not valid UTF-8, or that happen to start with the prefix
+// themselves, are written this way so the conversion stays lossless.
+const binaryPrefix = "base64:"
+
+// ToJSON converts v to JSON. Integers become numbers, lists arrays and
+// dictionaries objects with sorted keys; see binaryPrefix for strings.
+func ToJSON(v types.BencodeValue) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FromJSON reverses ToJSON. Numbers must be integers that fit in an int64,
+// and JSON null and booleans are rejected since bencode cannot hold them.
+func FromJSON(data []byte) (types.BencodeValue, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	v, err := readJSON(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("json: trailing data after value")
+	}
+	return v, nil
+}
+
+func writeJSON(buf *bytes.Buffer, v types.BencodeValue) error {
+	switch val := v.(type) {
+	case types.BencodeInt:
+		buf.WriteString(strconv.FormatInt(int64(val), 10))
+	case types.BencodeString:
+		writeJSONString(buf, string(val))
+	case types.BencodeList:
+		buf.WriteByte('[')
+		for i, item := range val {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case types.BencodeDict:
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(buf, key)
+			buf.WriteByte(':')
+			if err := writeJSON(buf, val[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("unsupported type %T", v)
+	}
+	return nil
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	if !utf8.ValidString(s) || strings.HasPrefix(s, binaryPrefix) {
+		s = binaryPrefix + base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	enc, _ := json.Marshal(s) // marshalling a string cannot fail
+	buf.Write(enc)
+}
+
+func readJSON(dec *json.Decoder) (types.BencodeValue, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case json.Number:
+		n, err := strconv.ParseInt(string(t), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("json: number %s is not a 64-bit integer", t)
+		}
+		return types.BencodeInt(n), nil
+	case string:
+		s, err := readJSONString(t)
+		if err != nil {
+			return nil, err
+		}
+		return types.BencodeString(s), nil
+	case json.Delim:
+		switch t {
+		case '[':
+			list := types.BencodeList{}
+			for dec.More() {
+				item, err := readJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			dec.Token() // consume ']'
+			return list, nil
+		case '{':
+			dict := make(types.BencodeDict)
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				key, err := readJSONString(keyTok.(string))
+				if err != nil {
+					return nil, err
+				}
+				val, err := readJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				dict[key] = val
+			}
+			dec.Token() // consume '}'
+			return dict, nil
+		}
+	}
+
+	return nil, fmt.Errorf("json: %v has no bencode equivalent", tok)
+}
+
+func readJSONString(s string) (string, error) {
+	encoded, ok := strings.CutPrefix(s, binaryPrefix)
+	if !ok {
+		return s, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("json: invalid base64 string %q: %w", s, err)
+	}
+	return string(raw), nil
+}
@@ -0,0 +1,59 @@
+package bencode
+
+import (
+	"reflect"
+	"testing"
+
+	"kbit/pkg/types"
+)
+
+func TestJSON_RoundTrip(t *testing.T) {
+	original := types.BencodeDict{
+		"announce": types.BencodeString("http://tracker/announce"),
+		"info": types.BencodeDict{
+			"name":         types.BencodeString("café"),
+			"piece length": types.BencodeInt(16384),
+			"pieces":       types.BencodeString("\x00\xff\x10"),
+			"files":        types.BencodeList{types.BencodeDict{"length": types.BencodeInt(-1)}},
+		},
+		"tricky":   types.BencodeString("base64:not really"),
+		"\xfe\xff": types.BencodeList{},
+	}
+
+	data, err := ToJSON(original)
+	if err != nil {
+		t.Fatalf("ToJSON failed: %v", err)
+	}
+
+	decoded, err := FromJSON(data)
+	if err != nil {
+		t.Fatalf("FromJSON failed: %v\n%s", err, data)
+	}
+
+	if !reflect.DeepEqual(decoded, original) {
+		t.Errorf("round-trip failed:\nexpected %v\ngot      %v\njson %s", original, decoded, data)
+	}
+}
+
+func TestToJSON_Format(t *testing.T) {
+	data, err := ToJSON(types.BencodeDict{
+		"b": types.BencodeString("\x01\xff"),
+		"a": types.BencodeList{types.BencodeInt(1), types.BencodeString("x")},
+	})
+	if err != nil {
+		t.Fatalf("ToJSON failed: %v", err)
+	}
+
+	expected := `{"a":[1,"x"],"b":"base64:Af8="}`
+	if string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+}
+
+func TestFromJSON_Rejects(t *testing.T) {
+	for _, input := range []string{`1.5`, `null`, `true`, `"base64:!!"`, `[1] [2]`, `99999999999999999999`} {
+		if _, err := FromJSON([]byte(input)); err == nil {
+			t.Errorf("%s: expected error", input)
+		}
+	}
+}
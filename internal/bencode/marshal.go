@@ -0,0 +1,131 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Marshal returns the bencoding of v.
+//
+// Structs become dictionaries keyed by their `bencode` tags, maps with string
+// keys become dictionaries, slices and arrays become lists, strings and byte
+// slices become strings, and integers and bools become integers. A
+// RawMessage is written verbatim. Nil pointers and interfaces inside a
+// struct are omitted, since bencode has no null.
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	if err := e.marshal(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	if err := e.w.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (e *Encoder) marshal(v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("bencode: cannot marshal nil value")
+	}
+
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return fmt.Errorf("bencode: cannot marshal empty RawMessage")
+		}
+		_, err := e.w.Write(v.Bytes())
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("bencode: cannot marshal nil %s", v.Type())
+		}
+		return e.marshal(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return e.encodeInt(1)
+		}
+		return e.encodeInt(0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() > 1<<63-1 {
+			return fmt.Errorf("bencode: integer %d overflows int64", v.Uint())
+		}
+		return e.encodeInt(int64(v.Uint()))
+	case reflect.String:
+		return e.encodeString(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return e.encodeString(string(byteSlice(v)))
+		}
+		e.w.WriteByte('l')
+		for i := range v.Len() {
+			if err := e.marshal(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return e.w.WriteByte('e')
+	case reflect.Map:
+		return e.marshalMap(v)
+	case reflect.Struct:
+		return e.marshalStruct(v)
+	}
+
+	return fmt.Errorf("bencode: unsupported type %s", v.Type())
+}
+
+func (e *Encoder) marshalMap(v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("bencode: map key type %s is not a string", v.Type().Key())
+	}
+
+	keys := v.MapKeys()
+	sort.Slice(keys, func(a, b int) bool {
+		return keys[a].String() < keys[b].String()
+	})
+
+	e.w.WriteByte('d')
+	for _, key := range keys {
+		e.encodeString(key.String())
+		if err := e.marshal(v.MapIndex(key)); err != nil {
+			return err
+		}
+	}
+	return e.w.WriteByte('e')
+}
+
+func (e *Encoder) marshalStruct(v reflect.Value) error {
+	e.w.WriteByte('d')
+	for _, f := range cachedFields(v.Type()).list {
+		fv := v.Field(f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		if (fv.Kind() == reflect.Pointer || fv.Kind() == reflect.Interface) && fv.IsNil() {
+			continue
+		}
+		if fv.Type() == rawMessageType && fv.Len() == 0 {
+			continue
+		}
+
+		e.encodeString(f.name)
+		if err := e.marshal(fv); err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+	return e.w.WriteByte('e')
+}
+
+func byteSlice(v reflect.Value) []byte {
+	if v.Kind() == reflect.Slice {
+		return v.Bytes()
+	}
+	b := make([]byte, v.Len())
+	reflect.Copy(reflect.ValueOf(b), v)
+	return b
+}
@@ -0,0 +1,181 @@
+package bencode
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"kbit/pkg/types"
+)
+
+type testFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type testInfo struct {
+	Name        string     `bencode:"name"`
+	PieceLength int64      `bencode:"piece length"`
+	Pieces      []byte     `bencode:"pieces"`
+	Private     bool       `bencode:"private,omitempty"`
+	Files       []testFile `bencode:"files,omitempty"`
+}
+
+type testMeta struct {
+	Announce string             `bencode:"announce,omitempty"`
+	Info     testInfo           `bencode:"info"`
+	Extra    map[string]int     `bencode:"extra,omitempty"`
+	Nodes    *[]string          `bencode:"nodes"`
+	Ignored  string             `bencode:"-"`
+	Any      types.BencodeValue `bencode:"any,omitempty"`
+}
+
+func TestMarshal_Struct(t *testing.T) {
+	meta := testMeta{
+		Announce: "http://t/a",
+		Info: testInfo{
+			Name:        "x",
+			PieceLength: 16,
+			Pieces:      []byte{0, 1},
+			Files:       []testFile{{Length: 3, Path: []string{"a", "b"}}},
+		},
+		Extra:   map[string]int{"z": 1, "y": 2},
+		Ignored: "nope",
+	}
+
+	data, err := Marshal(meta)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	expected := "d8:announce10:http://t/a5:extrad1:yi2e1:zi1ee4:infod5:filesld6:lengthi3e4:pathl1:a1:beee4:name1:x12:piece lengthi16e6:pieces2:\x00\x01ee"
+	if string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, data)
+	}
+}
+
+func TestUnmarshal_RoundTrip(t *testing.T) {
+	nodes := []string{"n1"}
+	original := testMeta{
+		Info: testInfo{
+			Name:        "x",
+			PieceLength: 16,
+			Pieces:      []byte("abc"),
+			Private:     true,
+		},
+		Nodes: &nodes,
+		Any:   types.BencodeList{types.BencodeInt(7)},
+	}
+
+	data, err := Marshal(original)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var decoded testMeta
+	if err := Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded, original) {
+		t.Errorf("round-trip failed:\nexpected %+v\ngot      %+v", original, decoded)
+	}
+}
+
+func TestUnmarshal_SkipsUnknownKeys(t *testing.T) {
+	var f testFile
+	if err := Unmarshal([]byte("d5:extrald1:ai1eee6:lengthi9e4:pathl1:pee"), &f); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if f.Length != 9 || !reflect.DeepEqual(f.Path, []string{"p"}) {
+		t.Errorf("unexpected result %+v", f)
+	}
+}
+
+func TestUnmarshal_RawMessage(t *testing.T) {
+	var v struct {
+		Info RawMessage `bencode:"info"`
+		Name string     `bencode:"name"`
+	}
+
+	// The info dict is deliberately not in canonical key order.
+	input := "d4:infod1:bi1e1:ai2ee4:name1:ne"
+	if err := Unmarshal([]byte(input), &v); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	if string(v.Info) != "d1:bi1e1:ai2ee" {
+		t.Errorf("expected original info bytes, got %q", v.Info)
+	}
+	if v.Name != "n" {
+		t.Errorf("expected name n, got %q", v.Name)
+	}
+
+	data, err := Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if string(data) != "d4:infod1:bi1e1:ai2ee4:name1:ne" {
+		t.Errorf("expected raw message written verbatim, got %q", data)
+	}
+}
+
+func TestUnmarshal_ByteArray(t *testing.T) {
+	var v struct {
+		Hash [4]byte `bencode:"hash"`
+	}
+	if err := Unmarshal([]byte("d4:hash4:abcde"), &v); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if string(v.Hash[:]) != "abcd" {
+		t.Errorf("unexpected hash %q", v.Hash)
+	}
+
+	if err := Unmarshal([]byte("d4:hash3:abce"), &v); err == nil {
+		t.Error("expected error for wrong-sized byte array")
+	}
+}
+
+func TestUnmarshal_TypeMismatch(t *testing.T) {
+	var f testFile
+	err := Unmarshal([]byte("d6:length3:abce"), &f)
+
+	var typeErr *UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("expected UnmarshalTypeError, got %v", err)
+	}
+	if typeErr.Value != "string" || typeErr.Offset != 9 {
+		t.Errorf("unexpected error details: %+v", typeErr)
+	}
+}
+
+func TestUnmarshal_IntegerOverflow(t *testing.T) {
+	var v struct {
+		N uint8 `bencode:"n"`
+	}
+	if err := Unmarshal([]byte("d1:ni300ee"), &v); err == nil {
+		t.Error("expected overflow error")
+	}
+	if err := Unmarshal([]byte("d1:ni-1ee"), &v); err == nil {
+		t.Error("expected error for negative unsigned")
+	}
+}
+
+func TestUnmarshal_RequiresPointer(t *testing.T) {
+	var f testFile
+	if err := Unmarshal([]byte("de"), f); err == nil {
+		t.Error("expected error for non-pointer target")
+	}
+}
+
+func TestMarshal_Unsupported(t *testing.T) {
+	if _, err := Marshal(1.5); err == nil {
+		t.Error("expected error for float")
+	}
+	if _, err := Marshal(map[int]string{1: "a"}); err == nil {
+		t.Error("expected error for non-string map key")
+	}
+	if _, err := Marshal(nil); err == nil {
+		t.Error("expected error for nil")
+	}
+}
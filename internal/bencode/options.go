@@ -0,0 +1,32 @@
+package bencode
+
+// DecodeOptions controls how strictly a Decoder validates its input and how
+// much of it it is willing to read. A zero limit means unlimited.
+type DecodeOptions struct {
+	// Strict enforces BEP 3: no leading zeros, no "-0", and dictionary keys
+	// in strictly increasing byte order, which also rules out duplicates.
+	Strict bool
+
+	// MaxDepth bounds how deeply lists and dictionaries may nest.
+	MaxDepth int
+
+	// MaxStringLen bounds the length of a single string.
+	MaxStringLen int64
+
+	// MaxSize bounds the number of bytes a single value may span.
+	MaxSize int64
+}
+
+// HardenedOptions is meant for input from the network, such as tracker
+// responses and peer extension messages.
+var HardenedOptions = DecodeOptions{
+	Strict:       true,
+	MaxDepth:     32,
+	MaxStringLen: 1 << 20,
+	MaxSize:      4 << 20,
+}
+
+// SetOptions applies opts to every value decoded from now on.
+func (d *Decoder) SetOptions(opts DecodeOptions) {
+	d.opts = opts
+}
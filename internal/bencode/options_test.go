@@ -0,0 +1,118 @@
+package bencode
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func decodeWith(input string, opts DecodeOptions) error {
+	dec := NewDecoder(strings.NewReader(input))
+	dec.SetOptions(opts)
+	_, err := dec.Decode()
+	return err
+}
+
+func TestStrict_RejectsNonCanonicalInput(t *testing.T) {
+	for _, input := range []string{
+		"i03e",
+		"i-0e",
+		"i-03e",
+		"ie",
+		"i-e",
+		"03:abc",
+		"d1:bi1e1:ai2ee", // unsorted keys
+		"d1:ai1e1:ai2ee", // duplicate key
+	} {
+		if err := decodeWith(input, DecodeOptions{}); err != nil && input != "ie" && input != "i-e" {
+			t.Errorf("%q: expected lenient decode to succeed, got %v", input, err)
+		}
+
+		err := decodeWith(input, DecodeOptions{Strict: true})
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: expected SyntaxError in strict mode, got %v", input, err)
+		}
+	}
+}
+
+func TestStrict_AcceptsCanonicalInput(t *testing.T) {
+	for _, input := range []string{"i0e", "i-1e", "i10e", "0:", "10:abcdefghij", "d1:ai1e1:bi2ee"} {
+		if err := decodeWith(input, DecodeOptions{Strict: true}); err != nil {
+			t.Errorf("%q: unexpected error %v", input, err)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		input string
+		opts  DecodeOptions
+		limit string
+	}{
+		{"llllleeeee", DecodeOptions{MaxDepth: 4}, "depth"},
+		{"ld1:alleee", DecodeOptions{MaxDepth: 2}, "depth"},
+		{"5:hello", DecodeOptions{MaxStringLen: 4}, "string length"},
+		{"l3:abc3:defe", DecodeOptions{MaxSize: 8}, "size"},
+	}
+
+	for _, tt := range tests {
+		err := decodeWith(tt.input, tt.opts)
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) {
+			t.Errorf("%q: expected LimitError, got %v", tt.input, err)
+			continue
+		}
+		if limitErr.Limit != tt.limit {
+			t.Errorf("%q: expected %s limit, got %s", tt.input, tt.limit, limitErr.Limit)
+		}
+	}
+
+	if err := decodeWith("llllleeeee", DecodeOptions{MaxDepth: 5}); err != nil {
+		t.Errorf("expected depth 5 to be allowed, got %v", err)
+	}
+}
+
+func TestLimits_SizeAppliesPerValue(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("3:abc3:def"))
+	dec.SetOptions(DecodeOptions{MaxSize: 5})
+	for range 2 {
+		if _, err := dec.Decode(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestHardened_TruncatedInputDoesNotPanic(t *testing.T) {
+	full := "d8:intervali1800e5:peersld2:ip9:127.0.0.14:porti6881eeee"
+	for i := range len(full) {
+		err := decodeWith(full[:i], HardenedOptions)
+		if i > 0 && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("prefix %q: expected io.ErrUnexpectedEOF, got %v", full[:i], err)
+		}
+	}
+}
+
+func TestSyntaxError_Offset(t *testing.T) {
+	err := decodeWith("li1ex", DecodeOptions{})
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("expected SyntaxError, got %v", err)
+	}
+	if syntaxErr.Offset != 4 {
+		t.Errorf("expected offset 4, got %d", syntaxErr.Offset)
+	}
+}
+
+func TestUnmarshal_HonoursOptions(t *testing.T) {
+	var v struct {
+		A int `bencode:"a"`
+		B int `bencode:"b"`
+	}
+	dec := NewDecoder(strings.NewReader("d1:bi1e1:ai2ee"))
+	dec.SetOptions(HardenedOptions)
+	if err := dec.DecodeInto(&v); err == nil {
+		t.Error("expected strict error for unsorted keys")
+	}
+}
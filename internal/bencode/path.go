@@ -0,0 +1,69 @@
+package bencode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"kbit/pkg/types"
+)
+
+// Lookup returns the value at path inside v. Paths use the same form the
+// Decoder records spans under: dictionary keys joined by dots and list
+// indexes in brackets, as in "info.files[3].path". The empty path is v
+// itself. Keys that contain dots or brackets, like "name.utf-8", are matched
+// against the dictionary directly, preferring the longest key that fits.
+func Lookup(v types.BencodeValue, path string) (types.BencodeValue, error) {
+	rest := path
+	for rest != "" {
+		switch val := v.(type) {
+		case types.BencodeList:
+			if rest[0] != '[' {
+				return nil, fmt.Errorf("path %q: expected a list index at %q", path, rest)
+			}
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("path %q: unterminated list index", path)
+			}
+			i, err := strconv.Atoi(rest[1:end])
+			if err != nil || i < 0 || i >= len(val) {
+				return nil, fmt.Errorf("path %q: index %s out of range for list of %d", path, rest[1:end], len(val))
+			}
+			v = val[i]
+			rest = rest[end+1:]
+
+		case types.BencodeDict:
+			key, ok := matchKey(val, rest)
+			if !ok {
+				return nil, fmt.Errorf("path %q: no key matches %q", path, rest)
+			}
+			v = val[key]
+			rest = rest[len(key):]
+
+		default:
+			return nil, fmt.Errorf("path %q: cannot descend into %s at %q", path, kindName(v), rest)
+		}
+
+		rest = strings.TrimPrefix(rest, ".")
+	}
+
+	return v, nil
+}
+
+// matchKey finds the longest key of dict that rest starts with and that is
+// followed by the end of the path, a dot or a list index.
+func matchKey(dict types.BencodeDict, rest string) (string, bool) {
+	best, found := "", false
+	for key := range dict {
+		if !strings.HasPrefix(rest, key) {
+			continue
+		}
+		if next := rest[len(key):]; next != "" && next[0] != '.' && next[0] != '[' {
+			continue
+		}
+		if !found || len(key) > len(best) {
+			best, found = key, true
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,76 @@
+package bencode
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"kbit/pkg/types"
+)
+
+var lookupFixture = types.BencodeDict{
+	"info": types.BencodeDict{
+		"name":         types.BencodeString("n"),
+		"name.utf-8":   types.BencodeString("u"),
+		"piece length": types.BencodeInt(4),
+		"files": types.BencodeList{
+			types.BencodeDict{"path": types.BencodeList{types.BencodeString("a"), types.BencodeString("b")}},
+		},
+	},
+}
+
+func TestLookup(t *testing.T) {
+	tests := map[string]types.BencodeValue{
+		"info.name":             types.BencodeString("n"),
+		"info.name.utf-8":       types.BencodeString("u"),
+		"info.piece length":     types.BencodeInt(4),
+		"info.files[0].path[1]": types.BencodeString("b"),
+	}
+	for path, want := range tests {
+		got, err := Lookup(lookupFixture, path)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", path, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%q: expected %v, got %v", path, want, got)
+		}
+	}
+
+	if got, _ := Lookup(lookupFixture, ""); got == nil {
+		t.Error("expected empty path to return the root")
+	}
+}
+
+func TestLookup_Errors(t *testing.T) {
+	for _, path := range []string{"missing", "info.files[1]", "info.files[x]", "info.files.path", "info.name.x", "info.files[0"} {
+		if _, err := Lookup(lookupFixture, path); err == nil {
+			t.Errorf("%q: expected error", path)
+		}
+	}
+}
+
+func TestFprint(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Fprint(&buf, lookupFixture, BinaryHex); err != nil {
+		t.Fatalf("Fprint failed: %v", err)
+	}
+	out := buf.String()
+
+	// Keys are sorted, so "files" is printed before "name".
+	if strings.Index(out, `"files"`) > strings.Index(out, `"name"`) {
+		t.Errorf("expected sorted keys, got:\n%s", out)
+	}
+
+	buf.Reset()
+	Fprint(&buf, types.BencodeString("\x00\xff"), BinaryHex)
+	if buf.String() != "<hex 2 bytes: 00ff>\n" {
+		t.Errorf("unexpected hex rendering %q", buf.String())
+	}
+
+	buf.Reset()
+	Fprint(&buf, types.BencodeString("\x00\xff"), BinaryBase64)
+	if buf.String() != "<base64 2 bytes: AP8=>\n" {
+		t.Errorf("unexpected base64 rendering %q", buf.String())
+	}
+}
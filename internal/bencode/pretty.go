@@ -0,0 +1,92 @@
+package bencode
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"kbit/pkg/types"
+)
+
+// BinaryFormat selects how Fprint shows strings that are not valid UTF-8.
+type BinaryFormat int
+
+const (
+	BinaryHex BinaryFormat = iota
+	BinaryBase64
+)
+
+// Fprint writes an indented, human-readable rendering of v to w. Dictionary
+// keys are sorted, and binary strings are shown as <hex ...> or
+// <base64 ...> with their length.
+func Fprint(w io.Writer, v types.BencodeValue, format BinaryFormat) error {
+	var sb strings.Builder
+	printValue(&sb, v, 0, format)
+	sb.WriteByte('\n')
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func printValue(sb *strings.Builder, v types.BencodeValue, indent int, format BinaryFormat) {
+	pad := func(n int) {
+		sb.WriteString(strings.Repeat("  ", n))
+	}
+
+	switch val := v.(type) {
+	case types.BencodeInt:
+		sb.WriteString(strconv.FormatInt(int64(val), 10))
+	case types.BencodeString:
+		sb.WriteString(formatString(string(val), format))
+	case types.BencodeList:
+		if len(val) == 0 {
+			sb.WriteString("[]")
+			return
+		}
+		sb.WriteString("[\n")
+		for _, item := range val {
+			pad(indent + 1)
+			printValue(sb, item, indent+1, format)
+			sb.WriteString(",\n")
+		}
+		pad(indent)
+		sb.WriteByte(']')
+	case types.BencodeDict:
+		if len(val) == 0 {
+			sb.WriteString("{}")
+			return
+		}
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		sb.WriteString("{\n")
+		for _, key := range keys {
+			pad(indent + 1)
+			sb.WriteString(formatString(key, format))
+			sb.WriteString(": ")
+			printValue(sb, val[key], indent+1, format)
+			sb.WriteString(",\n")
+		}
+		pad(indent)
+		sb.WriteByte('}')
+	default:
+		fmt.Fprintf(sb, "<%T>", v)
+	}
+}
+
+func formatString(s string, format BinaryFormat) string {
+	if utf8.ValidString(s) {
+		return strconv.Quote(s)
+	}
+	if format == BinaryBase64 {
+		return fmt.Sprintf("<base64 %d bytes: %s>", len(s), base64.StdEncoding.EncodeToString([]byte(s)))
+	}
+	return fmt.Sprintf("<hex %d bytes: %s>", len(s), hex.EncodeToString([]byte(s)))
+}
@@ -0,0 +1,267 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"kbit/pkg/types"
+)
+
+// UnmarshalTypeError describes a bencoded value that could not be stored in
+// a Go value of the given type.
+type UnmarshalTypeError struct {
+	Value  string // "integer", "string", "list" or "dictionary"
+	Type   reflect.Type
+	Offset int64
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: offset %d: cannot unmarshal %s into Go value of type %s", e.Offset, e.Value, e.Type)
+}
+
+// Unmarshal decodes the first bencoded value in data and stores it in the
+// value pointed to by v, following the same rules as Marshal. Dictionary
+// keys without a matching struct field are skipped, and a RawMessage
+// receives the exact bytes of its value.
+func Unmarshal(data []byte, v any) error {
+	return NewDecoder(bytes.NewReader(data)).DecodeInto(v)
+}
+
+// DecodeInto reads the next value from the stream and stores it in the value
+// pointed to by v.
+func (d *Decoder) DecodeInto(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("bencode: DecodeInto requires a non-nil pointer, got %T", v)
+	}
+	d.reset()
+	return d.decodeInto(rv.Elem())
+}
+
+func (d *Decoder) decodeInto(v reflect.Value) error {
+	if v.Type() == rawMessageType {
+		raw, err := d.captureValue()
+		if err != nil {
+			return err
+		}
+		v.SetBytes(raw)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeInto(v.Elem())
+	case reflect.Interface:
+		offset := d.offset
+		val, err := d.decode()
+		if err != nil {
+			return err
+		}
+		rv := reflect.ValueOf(val)
+		if !rv.Type().AssignableTo(v.Type()) {
+			return &UnmarshalTypeError{Value: kindName(val), Type: v.Type(), Offset: offset}
+		}
+		v.Set(rv)
+		return nil
+	}
+
+	b, err := d.peekByte()
+	if err != nil {
+		return d.eofError(err)
+	}
+
+	switch {
+	case b == 'i':
+		return d.unmarshalInt(v)
+	case b == 'l':
+		return d.unmarshalList(v)
+	case b == 'd':
+		return d.unmarshalDict(v)
+	case isDigit(b):
+		return d.unmarshalString(v)
+	}
+
+	return d.errorf("unknown bencode type %q", b)
+}
+
+func (d *Decoder) unmarshalInt(v reflect.Value) error {
+	offset := d.offset
+	n, err := d.decodeInt()
+	if err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(n != 0)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(int64(n)) {
+			return d.errorf("integer %d overflows %s", n, v.Type())
+		}
+		v.SetInt(int64(n))
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			return d.errorf("integer %d overflows %s", n, v.Type())
+		}
+		v.SetUint(uint64(n))
+		return nil
+	}
+
+	return &UnmarshalTypeError{Value: "integer", Type: v.Type(), Offset: offset}
+}
+
+func (d *Decoder) unmarshalString(v reflect.Value) error {
+	offset := d.offset
+	s, err := d.decodeString()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(s))
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes([]byte(s))
+		return nil
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(s) != v.Len() {
+			return d.errorf("string of length %d does not fit %s", len(s), v.Type())
+		}
+		reflect.Copy(v, reflect.ValueOf([]byte(s)))
+		return nil
+	}
+
+	return &UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: offset}
+}
+
+func (d *Decoder) unmarshalList(v reflect.Value) error {
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return &UnmarshalTypeError{Value: "list", Type: v.Type(), Offset: d.offset}
+	}
+
+	if err := d.enterContainer(); err != nil {
+		return err
+	}
+	defer d.leaveContainer()
+
+	d.readByte() // skip 'l'
+	if v.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+
+	for i := 0; ; i++ {
+		b, err := d.peekByte()
+		if err != nil {
+			return d.eofError(err)
+		}
+		if b == 'e' {
+			break
+		}
+
+		if v.Kind() == reflect.Array {
+			if i >= v.Len() {
+				return d.errorf("list has more than %d elements for %s", v.Len(), v.Type())
+			}
+			if err := d.decodeInto(v.Index(i)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := d.decodeInto(elem); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, elem))
+	}
+
+	d.readByte() // skip 'e'
+	return nil
+}
+
+func (d *Decoder) unmarshalDict(v reflect.Value) error {
+	var fields *structFields
+	switch {
+	case v.Kind() == reflect.Struct:
+		fields = cachedFields(v.Type())
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	default:
+		return &UnmarshalTypeError{Value: "dictionary", Type: v.Type(), Offset: d.offset}
+	}
+
+	if err := d.enterContainer(); err != nil {
+		return err
+	}
+	defer d.leaveContainer()
+
+	d.readByte() // skip 'd'
+	var prev string
+	for i := 0; ; i++ {
+		b, err := d.peekByte()
+		if err != nil {
+			return d.eofError(err)
+		}
+		if b == 'e' {
+			break
+		}
+		if !isDigit(b) {
+			return d.errorf("dictionary key must be a string, got %q", b)
+		}
+
+		key, err := d.decodeString()
+		if err != nil {
+			return err
+		}
+		if err := d.checkKeyOrder(i, prev, string(key)); err != nil {
+			return err
+		}
+		prev = string(key)
+
+		if fields == nil {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decodeInto(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), elem)
+			continue
+		}
+
+		fi, ok := fields.byName[string(key)]
+		if !ok {
+			if _, err := d.decode(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decodeInto(v.Field(fields.list[fi].index)); err != nil {
+			return err
+		}
+	}
+
+	d.readByte() // skip 'e'
+	return nil
+}
+
+func kindName(v types.BencodeValue) string {
+	switch v.(type) {
+	case types.BencodeInt:
+		return "integer"
+	case types.BencodeString:
+		return "string"
+	case types.BencodeList:
+		return "list"
+	case types.BencodeDict:
+		return "dictionary"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"kbit/internal/bencode"
+	"kbit/pkg/types"
+)
+
+type BencodeCommand struct {
+	In  io.Reader // used for the "-" file; defaults to os.Stdin
+	Out io.Writer // overridden in tests; defaults to os.Stdout
+}
+
+func (c *BencodeCommand) Run(args []string) error {
+	fs := flag.NewFlagSet("bencode", flag.ContinueOnError)
+	toJSON := fs.Bool("json", false, "print the value as JSON")
+	fromJSON := fs.Bool("from-json", false, "read JSON and write bencode")
+	binary := fs.String("binary", "hex", "how to print non-UTF-8 strings: hex or base64")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return fmt.Errorf("usage: kbit bencode [-json | -from-json] [-binary hex|base64] <file|-> [path]")
+	}
+	if *toJSON && *fromJSON {
+		return fmt.Errorf("-json and -from-json cannot be combined")
+	}
+
+	var format bencode.BinaryFormat
+	switch *binary {
+	case "hex":
+		format = bencode.BinaryHex
+	case "base64":
+		format = bencode.BinaryBase64
+	default:
+		return fmt.Errorf("unknown binary format %q", *binary)
+	}
+
+	out := c.Out
+	if out == nil {
+		out = os.Stdout
+	}
+
+	in, err := c.openInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var value types.BencodeValue
+	if *fromJSON {
+		data, err := io.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		value, err = bencode.FromJSON(data)
+		if err != nil {
+			return err
+		}
+	} else {
+		value, err = bencode.NewDecoder(in).Decode()
+		if err != nil {
+			return err
+		}
+	}
+
+	if path := fs.Arg(1); path != "" {
+		value, err = bencode.Lookup(value, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case *fromJSON:
+		return bencode.NewEncoder(out).Encode(value)
+	case *toJSON:
+		data, err := bencode.ToJSON(value)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", data)
+		return err
+	default:
+		return bencode.Fprint(out, value, format)
+	}
+}
+
+func (c *BencodeCommand) openInput(name string) (io.ReadCloser, error) {
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open %s: %w", name, err)
+		}
+		return file, nil
+	}
+
+	in := c.In
+	if in == nil {
+		in = os.Stdin
+	}
+	return io.NopCloser(in), nil
+}
@@ -5,7 +5,7 @@ import (
 )
 
 type Command interface {
-	Run(arg string) error
+	Run(args []string) error
 }
 
 func FindCommand(name string) (Command, error) {
@@ -16,6 +16,14 @@ func FindCommand(name string) (Command, error) {
 		return &HandshakeCommand{}, nil
 	case "download":
 		return &DownloadCommand{}, nil
+	case "bencode":
+		return &BencodeCommand{}, nil
+	case "create":
+		return &CreateCommand{}, nil
+	case "scrape":
+		return &ScrapeCommand{}, nil
+	case "seed":
+		return &SeedCommand{}, nil
 	default:
 		return nil, fmt.Errorf("unknown command: %s", name)
 	}
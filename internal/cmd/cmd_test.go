@@ -1,11 +1,15 @@
 package cmd
 
 import (
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"kbit/internal/logger"
@@ -56,7 +60,7 @@ func TestFindCommand_EmptyName(t *testing.T) {
 
 func TestParseCommand_FileNotFound(t *testing.T) {
 	cmd := &ParseCommand{}
-	err := cmd.Run("/nonexistent/path/no.torrent")
+	err := cmd.Run([]string{"/nonexistent/path/no.torrent"})
 	if err == nil {
 		t.Error("expected error when file does not exist")
 	}
@@ -72,7 +76,7 @@ func TestParseCommand_InvalidTorrent(t *testing.T) {
 	f.Close()
 
 	cmd := &ParseCommand{}
-	if err := cmd.Run(f.Name()); err == nil {
+	if err := cmd.Run([]string{f.Name()}); err == nil {
 		t.Error("expected error for non-bencode content")
 	}
 }
@@ -89,11 +93,50 @@ func TestParseCommand_ValidTorrent_UDPAnnounce(t *testing.T) {
 	f.Close()
 
 	cmd := &ParseCommand{}
-	if err := cmd.Run(f.Name()); err != nil {
+	if err := cmd.Run([]string{f.Name()}); err != nil {
 		t.Errorf("expected no error for valid torrent, got: %v", err)
 	}
 }
 
+// countingTracker starts an HTTP tracker that answers every announce with
+// no peers and counts how often it was asked.
+func countingTracker(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		fmt.Fprint(w, "d8:intervali1800e5:peers0:e")
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/announce", &hits
+}
+
+func TestParseCommand_NoNetworkByDefault(t *testing.T) {
+	tracker, hits := countingTracker(t)
+	path := writeTempTorrent(t, fmt.Sprintf("d8:announce%d:%s4:infod6:lengthi1024e4:name8:testfileee", len(tracker), tracker))
+
+	cmd := &ParseCommand{}
+	if err := cmd.Run([]string{path}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("tracker asked %d times, want 0 without -peers", n)
+	}
+}
+
+func TestParseCommand_PeersFlagAsksTrackers(t *testing.T) {
+	tracker, hits := countingTracker(t)
+	path := writeTempTorrent(t, fmt.Sprintf("d8:announce%d:%s4:infod6:lengthi1024e4:name8:testfileee", len(tracker), tracker))
+
+	cmd := &ParseCommand{}
+	if err := cmd.Run([]string{"-peers", path}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("tracker asked %d times, want 1 with -peers", n)
+	}
+}
+
 // HandshakeCommand helpers
 
 // writeTempTorrent creates a temp file with the given content and registers
@@ -149,7 +192,7 @@ const validTorrentContent = "d8:announce28:udp://tracker.example.com:804:infod6:
 
 func TestHandshakeCommand_FileNotFound(t *testing.T) {
 	cmd := &HandshakeCommand{In: strings.NewReader("")}
-	if err := cmd.Run("/nonexistent/path/no.torrent"); err == nil {
+	if err := cmd.Run([]string{"/nonexistent/path/no.torrent"}); err == nil {
 		t.Error("expected error for missing file")
 	}
 }
@@ -157,7 +200,7 @@ func TestHandshakeCommand_FileNotFound(t *testing.T) {
 func TestHandshakeCommand_InvalidTorrent(t *testing.T) {
 	path := writeTempTorrent(t, "this is not bencode")
 	cmd := &HandshakeCommand{In: strings.NewReader("")}
-	if err := cmd.Run(path); err == nil {
+	if err := cmd.Run([]string{path}); err == nil {
 		t.Error("expected error for invalid torrent content")
 	}
 }
@@ -166,7 +209,7 @@ func TestHandshakeCommand_EmptyPeerAddress(t *testing.T) {
 	path := writeTempTorrent(t, validTorrentContent)
 	// Simulate user pressing Enter without typing an address.
 	cmd := &HandshakeCommand{In: strings.NewReader("\n")}
-	if err := cmd.Run(path); err == nil {
+	if err := cmd.Run([]string{path}); err == nil {
 		t.Error("expected error for empty peer address")
 	}
 }
@@ -176,7 +219,7 @@ func TestHandshakeCommand_ConnectionRefused(t *testing.T) {
 	path := writeTempTorrent(t, validTorrentContent)
 	// Port 1 is essentially always refused.
 	cmd := &HandshakeCommand{In: strings.NewReader("127.0.0.1:1\n")}
-	if err := cmd.Run(path); err == nil {
+	if err := cmd.Run([]string{path}); err == nil {
 		t.Error("expected error for refused connection")
 	}
 }
@@ -187,7 +230,173 @@ func TestHandshakeCommand_Success(t *testing.T) {
 	addr := startEchoPeer(t)
 
 	cmd := &HandshakeCommand{In: strings.NewReader(addr + "\n")}
-	if err := cmd.Run(path); err != nil {
+	if err := cmd.Run([]string{path}); err != nil {
 		t.Errorf("expected successful handshake, got: %v", err)
 	}
 }
+
+// BencodeCommand tests
+
+func TestFindCommand_Bencode(t *testing.T) {
+	if _, err := FindCommand("bencode"); err != nil {
+		t.Fatalf("expected no error for 'bencode', got: %v", err)
+	}
+}
+
+func TestBencodeCommand_PrettyPrintPath(t *testing.T) {
+	path := writeTempTorrent(t, validTorrentContent)
+
+	var out strings.Builder
+	cmd := &BencodeCommand{Out: &out}
+	if err := cmd.Run([]string{path, "info.name"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != "\"testfile\"\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestBencodeCommand_JSONRoundTrip(t *testing.T) {
+	path := writeTempTorrent(t, validTorrentContent)
+
+	var jsonOut strings.Builder
+	if err := (&BencodeCommand{Out: &jsonOut}).Run([]string{"-json", path}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var benOut strings.Builder
+	cmd := &BencodeCommand{In: strings.NewReader(jsonOut.String()), Out: &benOut}
+	if err := cmd.Run([]string{"-from-json", "-"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if benOut.String() != validTorrentContent {
+		t.Errorf("expected %q, got %q", validTorrentContent, benOut.String())
+	}
+}
+
+func TestBencodeCommand_Usage(t *testing.T) {
+	cmd := &BencodeCommand{Out: io.Discard}
+	if err := cmd.Run(nil); err == nil {
+		t.Error("expected usage error without a file")
+	}
+	if err := cmd.Run([]string{"-json", "-from-json", "x"}); err == nil {
+		t.Error("expected error when combining -json and -from-json")
+	}
+	if err := cmd.Run([]string{"-binary", "octal", "x"}); err == nil {
+		t.Error("expected error for unknown binary format")
+	}
+}
+
+// CreateCommand tests
+
+func TestFindCommand_Create(t *testing.T) {
+	if _, err := FindCommand("create"); err != nil {
+		t.Fatalf("expected no error for 'create', got: %v", err)
+	}
+}
+
+func TestCreateCommand_WritesParsableTorrent(t *testing.T) {
+	dir := t.TempDir()
+	src := dir + "/payload.txt"
+	if err := os.WriteFile(src, []byte("hello world"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := dir + "/out.torrent"
+
+	cmd := &CreateCommand{}
+	err := cmd.Run([]string{"-o", out, "-t", "udp://a.example:80,udp://b.example:80", "-piece-length", "16K", "-private", src})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	parse := &ParseCommand{}
+	if err := parse.Run([]string{out}); err != nil {
+		t.Errorf("created torrent does not parse: %v", err)
+	}
+}
+
+func TestCreateCommand_Usage(t *testing.T) {
+	cmd := &CreateCommand{}
+	if err := cmd.Run(nil); err == nil {
+		t.Error("expected usage error without a path")
+	}
+	if err := cmd.Run([]string{"-piece-length", "abc", "x"}); err == nil {
+		t.Error("expected error for invalid piece length")
+	}
+}
+
+func TestDownloadCommand_MagnetWithoutPeers(t *testing.T) {
+	cmd := &DownloadCommand{}
+	err := cmd.Run([]string{"-dht=false", "-lsd=false", "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a"})
+	if err == nil || !strings.Contains(err.Error(), "metadata") {
+		t.Errorf("expected metadata error, got: %v", err)
+	}
+}
+
+func TestDownloadCommand_InvalidMagnet(t *testing.T) {
+	cmd := &DownloadCommand{}
+	if err := cmd.Run([]string{"magnet:?dn=missing-hash"}); err == nil {
+		t.Error("expected error for magnet without infohash")
+	}
+}
+
+func TestFindCommand_Scrape(t *testing.T) {
+	if _, err := FindCommand("scrape"); err != nil {
+		t.Fatalf("expected no error for 'scrape', got: %v", err)
+	}
+}
+
+func TestScrapeCommand_TextAndJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hash := r.URL.Query().Get("info_hash")
+		fmt.Fprintf(w, "d5:filesd20:%sd8:completei7e10:downloadedi9e10:incompletei2eeee", hash)
+	}))
+	defer server.Close()
+
+	tracker := server.URL + "/announce"
+	path := writeTempTorrent(t, fmt.Sprintf("d8:announce%d:%s4:infod6:lengthi1024e4:name8:testfileee", len(tracker), tracker))
+
+	var text strings.Builder
+	if err := (&ScrapeCommand{Out: &text}).Run([]string{path}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !strings.Contains(text.String(), tracker) || !strings.Contains(text.String(), "7 seeders, 2 leechers, 9 completed") {
+		t.Errorf("unexpected text output:\n%s", text.String())
+	}
+
+	var js strings.Builder
+	if err := (&ScrapeCommand{Out: &js}).Run([]string{"-json", path}); err != nil {
+		t.Fatalf("Run -json: %v", err)
+	}
+	for _, want := range []string{`"tracker": "` + tracker + `"`, `"seeders": 7`, `"leechers": 2`, `"completed": 9`, `"name": "testfile"`} {
+		if !strings.Contains(js.String(), want) {
+			t.Errorf("JSON output missing %s:\n%s", want, js.String())
+		}
+	}
+}
+
+func TestScrapeCommand_NoTrackers(t *testing.T) {
+	path := writeTempTorrent(t, "d4:infod6:lengthi1024e4:name8:testfileee")
+	if err := (&ScrapeCommand{Out: io.Discard}).Run([]string{path}); err == nil {
+		t.Error("expected an error for a torrent without trackers")
+	}
+}
+
+func TestFindCommand_Seed(t *testing.T) {
+	if _, err := FindCommand("seed"); err != nil {
+		t.Fatalf("expected no error for 'seed', got: %v", err)
+	}
+}
+
+func TestSeedCommand_Usage(t *testing.T) {
+	cmd := &SeedCommand{}
+	if err := cmd.Run([]string{"only.torrent"}); err == nil || !strings.Contains(err.Error(), "usage") {
+		t.Errorf("expected a usage error without a path, got: %v", err)
+	}
+	if err := cmd.Run([]string{"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a", "."}); err == nil {
+		t.Error("expected an error seeding a magnet link")
+	}
+	if err := cmd.Run([]string{"-ratio", "-1", "x.torrent", "."}); err == nil {
+		t.Error("expected an error for a negative ratio")
+	}
+}
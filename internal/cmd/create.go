@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"kbit/internal/torrent"
+	"kbit/pkg/types"
+)
+
+type CreateCommand struct{}
+
+func (c *CreateCommand) Run(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	output := fs.String("o", "", "output file (default <name>.torrent)")
+	name := fs.String("name", "", "torrent name (default the base name of <path>)")
+	pieceLength := fs.String("piece-length", "", "piece length in bytes, with optional K or M suffix (default automatic)")
+	private := fs.Bool("private", false, "mark the torrent private")
+	comment := fs.String("comment", "", "free-form comment")
+	source := fs.String("source", "", "source tag stored in the info dictionary")
+	createdBy := fs.String("created-by", "kbit-torrent", "value of the \"created by\" field")
+	noDate := fs.Bool("no-date", false, "leave out the creation date")
+	var trackers, webSeeds stringList
+	fs.Var(&trackers, "t", "tracker tier as comma-separated announce URLs; repeat for more tiers")
+	fs.Var(&webSeeds, "w", "web seed URL; may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: kbit create [flags] <path>")
+	}
+	path := fs.Arg(0)
+
+	opts := torrent.CreateOptions{
+		Name:      *name,
+		WebSeeds:  webSeeds,
+		Private:   *private,
+		Comment:   *comment,
+		Source:    *source,
+		CreatedBy: *createdBy,
+	}
+	if !*noDate {
+		opts.CreatedAt = time.Now()
+	}
+	for _, tier := range trackers {
+		opts.Trackers = append(opts.Trackers, strings.Split(tier, ","))
+	}
+	if *pieceLength != "" {
+		n, err := parseSize(*pieceLength)
+		if err != nil {
+			return err
+		}
+		opts.PieceLength = n
+	}
+
+	meta, err := torrent.Create(path, opts)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := torrent.Encode(meta)
+	if err != nil {
+		return err
+	}
+
+	info := meta["info"].(types.BencodeDict)
+	out := *output
+	if out == "" {
+		out = string(info["name"].(types.BencodeString)) + ".torrent"
+	}
+	if err := os.WriteFile(out, []byte(encoded), 0o644); err != nil {
+		return err
+	}
+
+	infoEncoded, err := torrent.Encode(info)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Torrent created: %s\n", out)
+	fmt.Printf("Info hash: %x\n", sha1.Sum([]byte(infoEncoded)))
+	return nil
+}
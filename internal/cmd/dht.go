@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kbit/internal/dht"
+	"kbit/internal/net"
+)
+
+// dhtFlags are the DHT options shared by the commands that find peers.
+type dhtFlags struct {
+	enabled   *bool
+	state     *string
+	bootstrap stringList
+}
+
+func addDHTFlags(fs *flag.FlagSet) *dhtFlags {
+	f := &dhtFlags{
+		enabled: fs.Bool("dht", true, "find peers in the mainline DHT"),
+		state:   fs.String("dht-state", defaultDHTState(), "file the DHT routing table is kept in between runs"),
+	}
+	fs.Var(&f.bootstrap, "dht-bootstrap", "host:port of a DHT node to join through; may be repeated (default the public routers)")
+	return f
+}
+
+// start starts the DHT node, or returns nil when the DHT is disabled.
+// announcePort, when not zero, is announced for every torrent looked up.
+func (f *dhtFlags) start(announcePort int) (*dht.Node, error) {
+	if !*f.enabled {
+		return nil, nil
+	}
+
+	cfg := dht.Config{
+		Addr:         fmt.Sprintf(":%d", net.ListenPort),
+		StatePath:    *f.state,
+		AnnouncePort: announcePort,
+	}
+	for _, b := range f.bootstrap {
+		cfg.Bootstrap = append(cfg.Bootstrap, strings.Split(b, ",")...)
+	}
+
+	node, err := dht.New(cfg)
+	if err != nil {
+		// Another client may hold the usual port; any port will do.
+		cfg.Addr = ":0"
+		node, err = dht.New(cfg)
+	}
+	return node, err
+}
+
+func defaultDHTState() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "kbit-torrent", "dht.dat")
+}
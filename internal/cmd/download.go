@@ -1,26 +1,114 @@
 package cmd
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
 	"kbit/internal/net"
 	"kbit/internal/torrent"
+	"kbit/pkg/types"
 )
 
 type DownloadCommand struct{}
 
-func (c *DownloadCommand) Run(arg string) error {
-	file, err := os.Open(arg)
+func (c *DownloadCommand) Run(args []string) error {
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	save := fs.String("save", "", "for magnet links, also write the fetched metadata to this .torrent file")
+	dhtOpts := addDHTFlags(fs)
+	lsdOpts := addLSDFlags(fs)
+	slots := fs.Int("slots", net.DefaultUploadSlots, "number of peers uploaded to at once, besides one optimistic unchoke")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() < 1 {
+		return fmt.Errorf("usage: kbit download [-save file.torrent] [-dht=false] [-lsd=false] [-slots n] <file|magnet>")
+	}
+	if *slots < 1 {
+		return fmt.Errorf("-slots must be at least 1")
+	}
+
+	announcePort := 0
+	ln, err := listen()
 	if err != nil {
-		return fmt.Errorf("cannot open %s: %w", arg, err)
+		fmt.Fprintf(os.Stderr, "Not accepting peer connections: %v\n", err)
+	} else {
+		defer ln.Close()
+		announcePort = ln.Port()
 	}
-	defer file.Close()
 
-	t, err := torrent.ParseTorrentFile(file)
+	var sources []net.PeerSource
+	node, err := dhtOpts.start(announcePort)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DHT disabled: %v\n", err)
+	} else if node != nil {
+		defer node.Close()
+		sources = append(sources, node)
+	}
+
+	local, err := lsdOpts.start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LSD disabled: %v\n", err)
+	} else if local != nil {
+		defer local.Close()
+		sources = append(sources, local)
+	}
+
+	t, err := loadTorrent(fs.Arg(0), *save, sources)
 	if err != nil {
 		return err
 	}
 
-	return net.Download(&t)
+	return net.Download(&t, ln, *slots, sources...)
+}
+
+// loadTorrent reads a .torrent file or, for magnet URIs, parses the link,
+// asks its trackers and sources for peers and fetches the metadata from
+// them. The fetched metadata is saved to save when it is not empty.
+func loadTorrent(arg, save string, sources []net.PeerSource) (types.TorrentFile, error) {
+	if torrent.IsMagnet(arg) {
+		return loadMagnet(arg, save, sources)
+	}
+	return readMetainfo(arg)
+}
+
+func loadMagnet(uri, save string, sources []net.PeerSource) (types.TorrentFile, error) {
+	t, err := torrent.ParseMagnet(uri)
+	if err != nil {
+		return t, err
+	}
+
+	// Metadata can only come from peers, so find some before the session
+	// starts; the x.pe peers from the link are kept.
+	net.DiscoverPeers(&t, append([]net.PeerSource{net.TrackerSource}, sources...)...)
+
+	peers := make([]string, 0, len(t.Peers))
+	for p := range t.Peers {
+		peers = append(peers, p)
+	}
+
+	fmt.Fprintf(os.Stderr, "Fetching metadata from %d peer(s)...\n", len(peers))
+	info, err := net.FetchMetadata(t.InfoHash, peers)
+	if err != nil {
+		return t, fmt.Errorf("fetching metadata for %x: %w", t.InfoHash, err)
+	}
+	if err := torrent.ParseInfo(&t, info); err != nil {
+		return t, err
+	}
+
+	if save != "" {
+		out, err := os.Create(save)
+		if err != nil {
+			return t, fmt.Errorf("cannot create %s: %w", save, err)
+		}
+		defer out.Close()
+
+		if err := torrent.WriteMetainfo(out, &t); err != nil {
+			return t, fmt.Errorf("writing %s: %w", save, err)
+		}
+		fmt.Fprintf(os.Stderr, "Metadata saved to %s\n", save)
+	}
+
+	return t, nil
 }
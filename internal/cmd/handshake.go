@@ -15,7 +15,12 @@ type HandshakeCommand struct {
 	In io.Reader // overridden in tests; defaults to os.Stdin
 }
 
-func (c *HandshakeCommand) Run(arg string) error {
+func (c *HandshakeCommand) Run(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: kbit handshake <file>")
+	}
+
+	arg := args[0]
 	file, err := os.Open(arg)
 	if err != nil {
 		return fmt.Errorf("file %s does not exist", arg)
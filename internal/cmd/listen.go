@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"fmt"
+
+	"kbit/internal/net"
+)
+
+// listen accepts peer connections on net.ListenPort or, when another
+// client holds it, on any free port. net.ListenPort is updated to the port
+// in use, so trackers, the DHT and LSD announce the right one; start it
+// before them.
+func listen() (*net.Listener, error) {
+	ln, err := net.Listen(fmt.Sprintf(":%d", net.ListenPort))
+	if err != nil {
+		ln, err = net.Listen(":0")
+		if err != nil {
+			return nil, err
+		}
+	}
+	net.ListenPort = ln.Port()
+	return ln, nil
+}
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"flag"
+
+	"kbit/internal/lsd"
+	"kbit/internal/net"
+)
+
+// lsdFlags are the Local Service Discovery options shared by the commands
+// that find peers.
+type lsdFlags struct {
+	enabled *bool
+}
+
+func addLSDFlags(fs *flag.FlagSet) *lsdFlags {
+	return &lsdFlags{
+		enabled: fs.Bool("lsd", true, "find peers on the local network (Local Service Discovery)"),
+	}
+}
+
+// start starts Local Service Discovery, or returns nil when it is
+// disabled.
+func (f *lsdFlags) start() (*lsd.Service, error) {
+	if !*f.enabled {
+		return nil, nil
+	}
+	return lsd.New(lsd.Config{Port: net.ListenPort})
+}
@@ -2,16 +2,30 @@ package cmd
 
 import (
 	"os"
+	"flag"
+	"kbit/internal/net"
 	"kbit/internal/torrent"
 	"fmt"
+	"path/filepath"
+	"strings"
 )
 
 type ParseCommand struct {
 	File string
 }
 
-func (c *ParseCommand) Run(arg string) error {
-	c.File = arg
+func (c *ParseCommand) Run(args []string) error {
+	fs := flag.NewFlagSet("parse", flag.ContinueOnError)
+	peers := fs.Bool("peers", false, "also ask the trackers for peers")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() < 1 {
+		return fmt.Errorf("usage: kbit parse [-peers] <file>")
+	}
+
+	c.File = fs.Arg(0)
 	file, err := os.Open(c.File)
 	if err != nil {
 		return fmt.Errorf("File %s does not exists", c.File)
@@ -24,14 +38,29 @@ func (c *ParseCommand) Run(arg string) error {
 		return err
 	}
 
+	if *peers {
+		net.DiscoverPeers(&torrent)
+	}
+
 	fmt.Println("")
 	fmt.Println("===== SUMMARY =====")
 	fmt.Printf("Name: %s\n", torrent.Name)
 	fmt.Printf("Private: %t\n", torrent.Private)
 	fmt.Printf("Info hash: %x\n", string(torrent.InfoHash))
 	fmt.Printf("Length: %d\n", torrent.Length)
+	if len(torrent.Files) > 1 {
+		fmt.Println("Files:")
+		for _, f := range torrent.Files {
+			fmt.Printf("  %s (%d)\n", filepath.Join(f.Path...), f.Length)
+		}
+	}
 	fmt.Println("")
 	fmt.Printf("Tracker: %s\n", torrent.TrackerURL)
+	if len(torrent.Tiers) > 1 || (len(torrent.Tiers) == 1 && len(torrent.Tiers[0]) > 1) {
+		for i, tier := range torrent.Tiers {
+			fmt.Printf("Tier %d: %s\n", i+1, strings.Join(tier, ", "))
+		}
+	}
 	for peer := range torrent.Peers {
 		fmt.Println(peer)
 	}
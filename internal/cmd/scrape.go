@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"kbit/internal/net"
+	"kbit/internal/torrent"
+	"kbit/pkg/types"
+)
+
+type ScrapeCommand struct {
+	Out io.Writer // overridden in tests; defaults to os.Stdout
+}
+
+type scrapeResult struct {
+	Tracker  string        `json:"tracker"`
+	Error    string        `json:"error,omitempty"`
+	Torrents []scrapeEntry `json:"torrents,omitempty"`
+}
+
+type scrapeEntry struct {
+	InfoHash  string `json:"infohash"`
+	Name      string `json:"name"`
+	Seeders   int    `json:"seeders"`
+	Leechers  int    `json:"leechers"`
+	Completed int    `json:"completed"`
+}
+
+func (c *ScrapeCommand) Run(args []string) error {
+	fs := flag.NewFlagSet("scrape", flag.ContinueOnError)
+	toJSON := fs.Bool("json", false, "print the results as JSON")
+	timeout := fs.Duration("timeout", 30*time.Second, "give up on a tracker after this long")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() < 1 {
+		return fmt.Errorf("usage: kbit scrape [-json] [-timeout d] <file|magnet>...")
+	}
+
+	out := c.Out
+	if out == nil {
+		out = os.Stdout
+	}
+
+	var torrents []types.TorrentFile
+	for _, arg := range fs.Args() {
+		t, err := readMetainfo(arg)
+		if err != nil {
+			return err
+		}
+		torrents = append(torrents, t)
+	}
+
+	// Ask every tracker once, for all the torrents it serves.
+	var trackers []string
+	served := make(map[string][]int)
+	for i, t := range torrents {
+		for _, tier := range t.Tiers {
+			for _, tracker := range tier {
+				if _, ok := served[tracker]; !ok {
+					trackers = append(trackers, tracker)
+				}
+				served[tracker] = append(served[tracker], i)
+			}
+		}
+	}
+	if len(trackers) == 0 {
+		return fmt.Errorf("no trackers to scrape")
+	}
+
+	results := make([]scrapeResult, len(trackers))
+	var wg sync.WaitGroup
+	for i, tracker := range trackers {
+		wg.Add(1)
+		go func(i int, tracker string) {
+			defer wg.Done()
+			results[i] = scrapeTracker(tracker, torrents, served[tracker], *timeout)
+		}(i, tracker)
+	}
+	wg.Wait()
+
+	if *toJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		for _, r := range results {
+			fmt.Fprintln(out, r.Tracker)
+			if r.Error != "" {
+				fmt.Fprintf(out, "  error: %s\n", r.Error)
+				continue
+			}
+			for _, e := range r.Torrents {
+				fmt.Fprintf(out, "  %s (%s): %d seeders, %d leechers, %d completed\n",
+					e.Name, e.InfoHash, e.Seeders, e.Leechers, e.Completed)
+			}
+		}
+	}
+
+	for _, r := range results {
+		if r.Error == "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("no tracker answered the scrape")
+}
+
+func scrapeTracker(tracker string, torrents []types.TorrentFile, indices []int, timeout time.Duration) scrapeResult {
+	result := scrapeResult{Tracker: tracker}
+
+	hashes := make([][]byte, len(indices))
+	for i, idx := range indices {
+		hashes[i] = torrents[idx].InfoHash
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stats, err := net.Scrape(ctx, tracker, hashes)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	for i, idx := range indices {
+		result.Torrents = append(result.Torrents, scrapeEntry{
+			InfoHash:  fmt.Sprintf("%x", torrents[idx].InfoHash),
+			Name:      torrents[idx].Name,
+			Seeders:   stats[i].Seeders,
+			Leechers:  stats[i].Leechers,
+			Completed: stats[i].Completed,
+		})
+	}
+	return result
+}
+
+// readMetainfo reads a .torrent file or a magnet URI without touching the
+// network.
+func readMetainfo(arg string) (types.TorrentFile, error) {
+	if torrent.IsMagnet(arg) {
+		return torrent.ParseMagnet(arg)
+	}
+
+	file, err := os.Open(arg)
+	if err != nil {
+		return types.TorrentFile{}, fmt.Errorf("cannot open %s: %w", arg, err)
+	}
+	defer file.Close()
+
+	return torrent.ParseTorrentFile(file)
+}
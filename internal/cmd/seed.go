@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"kbit/internal/net"
+	"kbit/internal/torrent"
+)
+
+type SeedCommand struct{}
+
+func (c *SeedCommand) Run(args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	ratio := fs.Float64("ratio", 0, "stop once this many times the torrent's size was uploaded (0 for no limit)")
+	duration := fs.Duration("time", 0, "stop after seeding this long, such as 2h (0 for no limit)")
+	dhtOpts := addDHTFlags(fs)
+	lsdOpts := addLSDFlags(fs)
+	slots := fs.Int("slots", net.DefaultUploadSlots, "number of peers uploaded to at once, besides one optimistic unchoke")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() < 2 {
+		return fmt.Errorf("usage: kbit seed [-ratio r] [-time d] [-dht=false] [-lsd=false] [-slots n] <file.torrent> <path>")
+	}
+	if *ratio < 0 || *duration < 0 {
+		return fmt.Errorf("-ratio and -time must not be negative")
+	}
+	if *slots < 1 {
+		return fmt.Errorf("-slots must be at least 1")
+	}
+
+	if torrent.IsMagnet(fs.Arg(0)) {
+		return fmt.Errorf("seeding needs a .torrent file; a magnet link has no piece hashes")
+	}
+
+	t, err := readMetainfo(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	ln, err := listen()
+	if err != nil {
+		return fmt.Errorf("accepting peer connections: %w", err)
+	}
+	defer ln.Close()
+
+	var sources []net.PeerSource
+	node, err := dhtOpts.start(ln.Port())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DHT disabled: %v\n", err)
+	} else if node != nil {
+		defer node.Close()
+		sources = append(sources, node)
+	}
+
+	local, err := lsdOpts.start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LSD disabled: %v\n", err)
+	} else if local != nil {
+		defer local.Close()
+		sources = append(sources, local)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	limits := net.SeedLimits{Ratio: *ratio, Duration: *duration}
+	return net.Seed(ctx, &t, fs.Arg(1), ln, *slots, limits, sources...)
+}
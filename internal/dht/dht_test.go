@@ -0,0 +1,256 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kbit/internal/logger"
+	"kbit/pkg/types"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init(slog.LevelError, false)
+	queryTimeout = 500 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+// startNode starts a node on loopback that bootstraps through the given
+// nodes.
+func startNode(t *testing.T, bootstrap ...*Node) *Node {
+	t.Helper()
+	cfg := Config{Addr: "127.0.0.1:0", Bootstrap: []string{}}
+	for _, b := range bootstrap {
+		cfg.Bootstrap = append(cfg.Bootstrap, b.Addr().String())
+	}
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+// startNetwork starts count nodes, each bootstrapping through the first.
+func startNetwork(t *testing.T, count int) []*Node {
+	t.Helper()
+	first := startNode(t)
+	nodes := []*Node{first}
+	for range count - 1 {
+		n := startNode(t, first)
+		if err := n.Bootstrap(context.Background()); err != nil {
+			t.Fatalf("Bootstrap: %v", err)
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+func TestPing(t *testing.T) {
+	a, b := startNode(t), startNode(t)
+
+	id, err := a.Ping(context.Background(), b.Addr())
+	if err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if id != b.ID() {
+		t.Errorf("Ping returned %s, want %s", id, b.ID())
+	}
+	if a.Len() != 1 || b.Len() != 1 {
+		t.Errorf("table sizes = %d, %d; both sides should know each other", a.Len(), b.Len())
+	}
+}
+
+func TestBootstrap_NoNodes(t *testing.T) {
+	n := startNode(t)
+	if err := n.Bootstrap(context.Background()); err == nil {
+		t.Error("expected an error bootstrapping without any node")
+	}
+}
+
+func TestBootstrap_FillsRoutingTables(t *testing.T) {
+	nodes := startNetwork(t, 6)
+	for i, n := range nodes {
+		if n.Len() < 2 {
+			t.Errorf("node %d knows %d nodes, want at least 2", i, n.Len())
+		}
+	}
+}
+
+func TestFindNode(t *testing.T) {
+	nodes := startNetwork(t, 4)
+	a, target := nodes[1], nodes[3]
+
+	r, err := a.query(context.Background(), nodes[0].Addr(), "find_node", &msgArgs{Target: target.id[:]})
+	if err != nil {
+		t.Fatalf("find_node: %v", err)
+	}
+	found := decodeNodes(r.Nodes)
+	if len(found) == 0 || found[0].id != target.ID() {
+		t.Errorf("closest node = %v, want %s first", found, target.ID())
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := startNetwork(t, 6)
+	infoHash := RandomID()
+
+	if _, err := nodes[2].Announce(context.Background(), infoHash, 51413); err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+
+	peers, err := nodes[5].GetPeers(context.Background(), infoHash)
+	if err != nil {
+		t.Fatalf("GetPeers: %v", err)
+	}
+	want := "127.0.0.1:51413"
+	found := false
+	for _, p := range peers {
+		found = found || p == want
+	}
+	if !found {
+		t.Errorf("peers = %v, want %s", peers, want)
+	}
+}
+
+func TestAnnounce_RejectsBadToken(t *testing.T) {
+	a, b := startNode(t), startNode(t)
+	infoHash := RandomID()
+
+	_, err := a.query(context.Background(), b.Addr(), "announce_peer", &msgArgs{
+		InfoHash: infoHash[:],
+		Token:    []byte("forged"),
+		Port:     6881,
+	})
+	var krpcErr *Error
+	if !errors.As(err, &krpcErr) || krpcErr.Code != errProtocol {
+		t.Fatalf("error = %v, want protocol error", err)
+	}
+	if peers := b.storedPeers(infoHash); len(peers) != 0 {
+		t.Errorf("stored %d peers after a forged token", len(peers))
+	}
+}
+
+func TestToken_SurvivesOneRotation(t *testing.T) {
+	n := startNode(t)
+	ip := netip.MustParseAddr("192.0.2.7")
+
+	token := n.token(ip, 0)
+	n.rotateSecret()
+	if !n.validToken(ip, token) {
+		t.Error("token rejected after one rotation")
+	}
+	n.rotateSecret()
+	if n.validToken(ip, token) {
+		t.Error("token accepted after two rotations")
+	}
+	if n.validToken(netip.MustParseAddr("192.0.2.8"), n.token(ip, 0)) {
+		t.Error("token accepted from another address")
+	}
+}
+
+func TestStorePeer_CapsInfohashes(t *testing.T) {
+	saved := maxHashes
+	maxHashes = 3
+	t.Cleanup(func() { maxHashes = saved })
+
+	n := startNode(t)
+	peer := netip.MustParseAddrPort("192.0.2.7:6881")
+	hashes := []ID{{1}, {2}, {3}, {4}}
+	for _, h := range hashes[:3] {
+		n.storePeer(h, peer)
+		time.Sleep(time.Millisecond)
+	}
+	n.storePeer(hashes[0], peer) // announced again, now the freshest
+
+	n.storePeer(hashes[3], peer)
+	if len(n.storedPeers(hashes[1])) != 0 {
+		t.Error("the stalest infohash was kept past the cap")
+	}
+	for _, h := range []ID{hashes[0], hashes[2], hashes[3]} {
+		if len(n.storedPeers(h)) != 1 {
+			t.Errorf("infohash %x lost its peer", h[:1])
+		}
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	a, b := startNode(t), startNode(t)
+
+	_, err := a.query(context.Background(), b.Addr(), "vote", &msgArgs{})
+	var krpcErr *Error
+	if !errors.As(err, &krpcErr) || krpcErr.Code != errMethodUnknown {
+		t.Errorf("error = %v, want method unknown", err)
+	}
+}
+
+func TestStatePersistsAcrossRuns(t *testing.T) {
+	nodes := startNetwork(t, 4)
+	path := filepath.Join(t.TempDir(), "dht.dat")
+
+	n, err := New(Config{Addr: "127.0.0.1:0", Bootstrap: []string{nodes[0].Addr().String()}, StatePath: path})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := n.Bootstrap(context.Background()); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	id, known := n.ID(), n.Len()
+	if err := n.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The second run has no bootstrap nodes and must rely on the saved table.
+	again, err := New(Config{Addr: "127.0.0.1:0", Bootstrap: []string{}, StatePath: path})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer again.Close()
+
+	if again.ID() != id {
+		t.Errorf("ID = %s, want saved %s", again.ID(), id)
+	}
+	if again.Len() != known {
+		t.Errorf("loaded %d nodes, want %d", again.Len(), known)
+	}
+	if err := again.Bootstrap(context.Background()); err != nil {
+		t.Errorf("Bootstrap from saved table: %v", err)
+	}
+}
+
+func TestRefresh_LooksUpStaleBuckets(t *testing.T) {
+	nodes := startNetwork(t, 5)
+	n := nodes[4]
+
+	stale := n.table.stale(refreshAfter)
+	if len(stale) == 0 {
+		t.Skip("no buckets in use")
+	}
+
+	// Age the table past the refresh interval.
+	ageTable(n.table, 2*refreshAfter)
+
+	if len(n.table.stale(refreshAfter)) == 0 {
+		t.Fatal("aged buckets not reported stale")
+	}
+	n.refresh()
+	if got := n.table.stale(refreshAfter); len(got) != 0 {
+		t.Errorf("buckets %v still stale after refresh", got)
+	}
+}
+
+func TestFindPeers_SkipsPrivateTorrents(t *testing.T) {
+	nodes := startNetwork(t, 3)
+	infoHash := RandomID()
+	nodes[1].Announce(context.Background(), infoHash, 6881) //nolint:errcheck
+
+	peers, err := nodes[2].FindPeers(context.Background(), &types.TorrentFile{InfoHash: infoHash[:], Private: true})
+	if err != nil || len(peers) != 0 {
+		t.Errorf("FindPeers on a private torrent = %v, %v; want nothing", peers, err)
+	}
+}
@@ -0,0 +1,122 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"math/bits"
+	"net/netip"
+)
+
+// ID is a 160-bit node ID or infohash. Distance between two IDs is their
+// XOR, compared as a big-endian integer.
+type ID [20]byte
+
+// RandomID returns a new random node ID.
+func RandomID() ID {
+	var id ID
+	rand.Read(id[:]) //nolint:errcheck // crypto/rand.Read never fails
+	return id
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func idFromBytes(b []byte) (ID, bool) {
+	var id ID
+	if len(b) != len(id) {
+		return id, false
+	}
+	copy(id[:], b)
+	return id, true
+}
+
+// prefixLen returns how many leading bits a and b share; 160 if equal.
+func prefixLen(a, b ID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return 160
+}
+
+// closer reports whether a is closer to target than b.
+func closer(target, a, b ID) bool {
+	var da, db ID
+	for i := range target {
+		da[i] = a[i] ^ target[i]
+		db[i] = b[i] ^ target[i]
+	}
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// randomIDWithPrefix returns a random ID that shares exactly n leading
+// bits with id, so it falls into bucket n of id's routing table.
+func randomIDWithPrefix(id ID, n int) ID {
+	r := RandomID()
+	for i := range n {
+		byteI, bit := i/8, byte(0x80>>(i%8))
+		r[byteI] = r[byteI]&^bit | id[byteI]&bit
+	}
+	if n < 160 {
+		byteI, bit := n/8, byte(0x80>>(n%8))
+		r[byteI] = r[byteI]&^bit | ^id[byteI]&bit
+	}
+	return r
+}
+
+// nodeInfo is a node as it travels in "nodes": its ID and IPv4 address.
+type nodeInfo struct {
+	id   ID
+	addr netip.AddrPort
+}
+
+const compactNodeLen = 26
+
+// encodeNodes writes the compact node info of the IPv4 nodes.
+func encodeNodes(nodes []nodeInfo) []byte {
+	buf := make([]byte, 0, len(nodes)*compactNodeLen)
+	for _, n := range nodes {
+		if !n.addr.Addr().Is4() {
+			continue
+		}
+		buf = append(buf, n.id[:]...)
+		buf = append(buf, encodePeer(n.addr)...)
+	}
+	return buf
+}
+
+// decodeNodes reads compact node info, skipping a trailing partial entry
+// and nodes with an unusable address.
+func decodeNodes(b []byte) []nodeInfo {
+	var nodes []nodeInfo
+	for ; len(b) >= compactNodeLen; b = b[compactNodeLen:] {
+		id, _ := idFromBytes(b[:20])
+		addr, ok := decodePeer(b[20:compactNodeLen])
+		if !ok {
+			continue
+		}
+		nodes = append(nodes, nodeInfo{id: id, addr: addr})
+	}
+	return nodes
+}
+
+// encodePeer writes the 6-byte compact form of an IPv4 address and port.
+func encodePeer(addr netip.AddrPort) []byte {
+	ip := addr.Addr().As4()
+	return append(ip[:], byte(addr.Port()>>8), byte(addr.Port()))
+}
+
+func decodePeer(b []byte) (netip.AddrPort, bool) {
+	if len(b) != 6 {
+		return netip.AddrPort{}, false
+	}
+	ip := netip.AddrFrom4([4]byte(b[:4]))
+	port := uint16(b[4])<<8 | uint16(b[5])
+	if port == 0 || ip.IsUnspecified() {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ip, port), true
+}
@@ -0,0 +1,88 @@
+package dht
+
+import (
+	"bytes"
+	"fmt"
+
+	"kbit/internal/bencode"
+	"kbit/pkg/types"
+)
+
+// KRPC error codes (BEP 5).
+const (
+	errGeneric       = 201
+	errServer        = 202
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+// msg is a KRPC message: a query (y=q), a response (y=r) or an error
+// (y=e), matched to its query by the transaction ID t.
+type msg struct {
+	T string     `bencode:"t"`
+	Y string     `bencode:"y"`
+	Q string     `bencode:"q,omitempty"`
+	A *msgArgs   `bencode:"a,omitempty"`
+	R *msgReturn `bencode:"r,omitempty"`
+	E []any      `bencode:"e,omitempty"`
+}
+
+type msgArgs struct {
+	ID          []byte `bencode:"id"`
+	Target      []byte `bencode:"target,omitempty"`
+	InfoHash    []byte `bencode:"info_hash,omitempty"`
+	Token       []byte `bencode:"token,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+}
+
+type msgReturn struct {
+	ID     []byte   `bencode:"id"`
+	Nodes  []byte   `bencode:"nodes,omitempty"`
+	Token  []byte   `bencode:"token,omitempty"`
+	Values [][]byte `bencode:"values,omitempty"`
+}
+
+// Error is a KRPC error returned by a remote node.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("dht error %d: %s", e.Code, e.Message)
+}
+
+// krpcOptions bound what a single datagram may contain. Key order is not
+// enforced: plenty of nodes in the wild send unsorted dictionaries.
+var krpcOptions = bencode.DecodeOptions{
+	MaxDepth:     8,
+	MaxStringLen: 8 << 10,
+	MaxSize:      64 << 10,
+}
+
+func decodeMsg(b []byte) (*msg, error) {
+	var m msg
+	dec := bencode.NewDecoder(bytes.NewReader(b))
+	dec.SetOptions(krpcOptions)
+	if err := dec.DecodeInto(&m); err != nil {
+		return nil, fmt.Errorf("malformed krpc message: %w", err)
+	}
+	return &m, nil
+}
+
+// remoteError turns the e list of an error message into an *Error.
+func remoteError(e []any) *Error {
+	err := &Error{Code: errGeneric}
+	if len(e) > 0 {
+		if code, ok := e[0].(types.BencodeInt); ok {
+			err.Code = int(code)
+		}
+	}
+	if len(e) > 1 {
+		if s, ok := e[1].(types.BencodeString); ok {
+			err.Message = string(s)
+		}
+	}
+	return err
+}
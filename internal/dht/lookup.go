@@ -0,0 +1,166 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+)
+
+// alpha is how many nodes a lookup queries at once.
+const alpha = 3
+
+type candidate struct {
+	nodeInfo
+	token    []byte
+	queried  bool
+	answered bool
+}
+
+// lookup walks towards target, querying the closest nodes it knows of
+// alpha at a time until the bucketSize closest have all been asked. With
+// getPeers it sends get_peers and also collects peers and announce tokens;
+// otherwise find_node. It returns the closest nodes that answered, nearest
+// first, and the peers found.
+func (n *Node) lookup(ctx context.Context, target ID, getPeers bool) ([]*candidate, []string) {
+	var (
+		mu     sync.Mutex
+		byAddr = make(map[netip.AddrPort]*candidate)
+		list   []*candidate
+		peers  []string
+		seen   = make(map[netip.AddrPort]bool)
+	)
+	add := func(node nodeInfo) {
+		if node.id == n.id || byAddr[node.addr] != nil {
+			return
+		}
+		c := &candidate{nodeInfo: node}
+		byAddr[node.addr] = c
+		list = append(list, c)
+	}
+	for _, node := range n.table.closest(target, bucketSize) {
+		add(node)
+	}
+
+	for ctx.Err() == nil {
+		sort.Slice(list, func(a, b int) bool {
+			return closer(target, list[a].id, list[b].id)
+		})
+
+		var batch []*candidate
+		considered := 0
+		for _, c := range list {
+			if considered == bucketSize || len(batch) == alpha {
+				break
+			}
+			if c.queried && !c.answered {
+				continue // silent nodes do not count towards the closest
+			}
+			considered++
+			if !c.queried {
+				c.queried = true
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, c := range batch {
+			wg.Add(1)
+			go func(c *candidate) {
+				defer wg.Done()
+
+				args := &msgArgs{}
+				q := "find_node"
+				if getPeers {
+					q = "get_peers"
+					args.InfoHash = target[:]
+				} else {
+					args.Target = target[:]
+				}
+
+				r, err := n.query(ctx, c.addr, q, args)
+				if err != nil {
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				c.answered = true
+				c.token = r.Token
+				for _, v := range r.Values {
+					addr, ok := decodePeer(v)
+					if ok && !seen[addr] {
+						seen[addr] = true
+						peers = append(peers, addr.String())
+					}
+				}
+				for _, node := range decodeNodes(r.Nodes) {
+					add(node)
+				}
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	var answered []*candidate
+	for _, c := range list {
+		if c.answered {
+			answered = append(answered, c)
+		}
+	}
+	if len(answered) > bucketSize {
+		answered = answered[:bucketSize]
+	}
+	return answered, peers
+}
+
+// GetPeers looks up peers for infoHash.
+func (n *Node) GetPeers(ctx context.Context, infoHash ID) ([]string, error) {
+	if n.table.len() == 0 {
+		return nil, fmt.Errorf("dht routing table is empty")
+	}
+	_, peers := n.lookup(ctx, infoHash, true)
+	return peers, nil
+}
+
+// Announce looks up peers for infoHash and then announces port to the
+// closest nodes that handed out a token. It returns the peers found.
+func (n *Node) Announce(ctx context.Context, infoHash ID, port int) ([]string, error) {
+	if n.table.len() == 0 {
+		return nil, fmt.Errorf("dht routing table is empty")
+	}
+	closest, peers := n.lookup(ctx, infoHash, true)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for _, c := range closest {
+		if len(c.token) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(c *candidate) {
+			defer wg.Done()
+			_, err := n.query(ctx, c.addr, "announce_peer", &msgArgs{
+				InfoHash: infoHash[:],
+				Token:    c.token,
+				Port:     port,
+			})
+			if err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	if accepted == 0 && len(closest) > 0 {
+		return peers, fmt.Errorf("no dht node accepted the announce")
+	}
+	return peers, nil
+}
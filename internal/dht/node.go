@@ -0,0 +1,515 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"kbit/internal/bencode"
+	"kbit/internal/logger"
+)
+
+// DefaultBootstrap are well-known routers used to join the DHT when no
+// saved routing table is available.
+var DefaultBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+	"dht.libtorrent.org:25401",
+}
+
+// Timings of the node. Variables so tests can speed them up.
+var (
+	queryTimeout    = 5 * time.Second
+	refreshAfter    = 15 * time.Minute // buckets unchanged this long are refreshed
+	secretLifetime  = 5 * time.Minute  // tokens stay valid for up to twice this
+	peerLifetime    = 30 * time.Minute // announced peers are forgotten after this
+	maintainEvery   = time.Minute
+	maxPeersPerHash = 100
+	maxHashes       = 1000 // infohashes peers are stored for; the stalest is dropped for a new one
+)
+
+// Config configures a Node.
+type Config struct {
+	// Addr is the UDP address to listen on, such as ":6881".
+	Addr string
+	// Bootstrap are host:port nodes to join through; DefaultBootstrap
+	// when nil.
+	Bootstrap []string
+	// StatePath, when set, is where the node ID and routing table are
+	// loaded from and saved to, so later runs skip bootstrapping.
+	StatePath string
+	// AnnouncePort, when not zero, is announced as the port peers can
+	// reach this client on after every peer lookup.
+	AnnouncePort int
+}
+
+// Node is a mainline DHT (BEP 5) node: it answers queries from other
+// nodes and looks up and announces peers for infohashes.
+type Node struct {
+	cfg   Config
+	conn  *net.UDPConn
+	id    ID
+	table *table
+
+	mu       sync.Mutex
+	pending  map[string]*pendingQuery
+	nextTx   uint16
+	secrets  [2][]byte
+	rotated  time.Time
+	peers    map[ID]map[netip.AddrPort]time.Time
+	lastPeer map[ID]time.Time // latest announce for each infohash in peers
+	closed   bool
+	done     chan struct{}
+	routines sync.WaitGroup
+}
+
+type pendingQuery struct {
+	addr  netip.AddrPort
+	reply chan *msg
+}
+
+// New starts a DHT node listening on cfg.Addr. The saved routing table is
+// loaded from cfg.StatePath when there is one; call Bootstrap to join the
+// network.
+func New(cfg Config) (*Node, error) {
+	if cfg.Bootstrap == nil {
+		cfg.Bootstrap = DefaultBootstrap
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dht address %q: %w", cfg.Addr, err)
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dht listen: %w", err)
+	}
+
+	n := &Node{
+		cfg:      cfg,
+		conn:     conn,
+		id:       RandomID(),
+		pending:  make(map[string]*pendingQuery),
+		peers:    make(map[ID]map[netip.AddrPort]time.Time),
+		lastPeer: make(map[ID]time.Time),
+		done:     make(chan struct{}),
+	}
+	if cfg.StatePath != "" {
+		if err := n.load(cfg.StatePath); err != nil {
+			logger.Log.Warn("could not load dht state",
+				slog.String("path", cfg.StatePath),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+	if n.table == nil {
+		n.table = newTable(n.id)
+	}
+	n.rotateSecret()
+
+	n.routines.Add(2)
+	go n.readLoop()
+	go n.maintain()
+	return n, nil
+}
+
+// ID returns the node ID.
+func (n *Node) ID() ID {
+	return n.id
+}
+
+// Addr returns the local UDP address of the node.
+func (n *Node) Addr() netip.AddrPort {
+	return n.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// Len returns the number of nodes in the routing table.
+func (n *Node) Len() int {
+	return n.table.len()
+}
+
+// Close stops the node and saves its routing table to cfg.StatePath.
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.done)
+	n.mu.Unlock()
+
+	err := n.conn.Close()
+	n.routines.Wait()
+	if n.cfg.StatePath != "" {
+		err = errors.Join(err, n.Save(n.cfg.StatePath))
+	}
+	return err
+}
+
+// Bootstrap fills the routing table by looking up our own ID, starting
+// from the saved table or, failing that, from the bootstrap nodes.
+func (n *Node) Bootstrap(ctx context.Context) error {
+	if n.table.len() > 0 {
+		n.lookup(ctx, n.id, false)
+		if n.table.len() > 0 {
+			return nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, host := range n.cfg.Bootstrap {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			addr, err := net.ResolveUDPAddr("udp4", host)
+			if err != nil {
+				logger.Log.Warn("cannot resolve dht bootstrap node",
+					slog.String("node", host),
+					slog.String("error", err.Error()),
+				)
+				return
+			}
+			r, err := n.query(ctx, addr.AddrPort(), "find_node", &msgArgs{Target: n.id[:]})
+			if err != nil {
+				return
+			}
+			for _, node := range decodeNodes(r.Nodes) {
+				n.table.add(node.id, node.addr)
+			}
+		}(host)
+	}
+	wg.Wait()
+
+	if n.table.len() == 0 {
+		return fmt.Errorf("dht bootstrap failed: no node answered")
+	}
+	n.lookup(ctx, n.id, false)
+	return nil
+}
+
+// Ping asks the node at addr for its ID.
+func (n *Node) Ping(ctx context.Context, addr netip.AddrPort) (ID, error) {
+	r, err := n.query(ctx, addr, "ping", &msgArgs{})
+	if err != nil {
+		return ID{}, err
+	}
+	id, _ := idFromBytes(r.ID)
+	return id, nil
+}
+
+// query sends q to addr and waits for the response. Responses update the
+// routing table; silence counts against the node.
+func (n *Node) query(ctx context.Context, addr netip.AddrPort, q string, args *msgArgs) (*msgReturn, error) {
+	args.ID = n.id[:]
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	n.nextTx++
+	tx := string([]byte{byte(n.nextTx >> 8), byte(n.nextTx)})
+	p := &pendingQuery{addr: addr, reply: make(chan *msg, 1)}
+	n.pending[tx] = p
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, tx)
+		n.mu.Unlock()
+	}()
+
+	if err := n.send(addr, &msg{T: tx, Y: "q", Q: q, A: args}); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	select {
+	case m := <-p.reply:
+		if m.Y == "e" {
+			return nil, remoteError(m.E)
+		}
+		id, ok := idFromBytes(m.R.ID)
+		if !ok {
+			return nil, fmt.Errorf("dht response from %s has no valid id", addr)
+		}
+		if ping := n.table.seen(id, addr); ping != nil {
+			go n.checkQuestionable(ping)
+		}
+		return m.R, nil
+	case <-timer.C:
+		n.table.failed(addr)
+		return nil, fmt.Errorf("dht query %s to %s timed out", q, addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-n.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// checkQuestionable pings a node that has been quiet for long; if it does
+// not answer it is marked failed and makes room in its bucket.
+func (n *Node) checkQuestionable(c *contact) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	n.Ping(ctx, c.addr) //nolint:errcheck // the outcome updates the table
+}
+
+func (n *Node) send(addr netip.AddrPort, m *msg) error {
+	data, err := bencode.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = n.conn.WriteToUDPAddrPort(data, addr)
+	return err
+}
+
+func (n *Node) readLoop() {
+	defer n.routines.Done()
+
+	buf := make([]byte, 64<<10)
+	for {
+		size, from, err := n.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+		m, err := decodeMsg(buf[:size])
+		if err != nil {
+			logger.Log.Debug("dropping dht packet",
+				slog.String("from", from.String()),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+
+		switch m.Y {
+		case "q":
+			n.handleQuery(from, m)
+		case "r", "e":
+			if m.Y == "r" && m.R == nil {
+				continue
+			}
+			n.mu.Lock()
+			p, ok := n.pending[m.T]
+			n.mu.Unlock()
+			if ok && p.addr == from {
+				select {
+				case p.reply <- m:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (n *Node) handleQuery(from netip.AddrPort, m *msg) {
+	if m.A == nil {
+		n.sendError(from, m.T, errProtocol, "missing arguments")
+		return
+	}
+	id, ok := idFromBytes(m.A.ID)
+	if !ok {
+		n.sendError(from, m.T, errProtocol, "invalid id")
+		return
+	}
+	if ping := n.table.seen(id, from); ping != nil {
+		go n.checkQuestionable(ping)
+	}
+
+	r := &msgReturn{ID: n.id[:]}
+	switch m.Q {
+	case "ping":
+	case "find_node":
+		target, ok := idFromBytes(m.A.Target)
+		if !ok {
+			n.sendError(from, m.T, errProtocol, "invalid target")
+			return
+		}
+		r.Nodes = encodeNodes(n.table.closest(target, bucketSize))
+	case "get_peers":
+		infoHash, ok := idFromBytes(m.A.InfoHash)
+		if !ok {
+			n.sendError(from, m.T, errProtocol, "invalid info_hash")
+			return
+		}
+		r.Token = n.token(from.Addr(), 0)
+		r.Values = n.storedPeers(infoHash)
+		r.Nodes = encodeNodes(n.table.closest(infoHash, bucketSize))
+	case "announce_peer":
+		infoHash, ok := idFromBytes(m.A.InfoHash)
+		if !ok {
+			n.sendError(from, m.T, errProtocol, "invalid info_hash")
+			return
+		}
+		if !n.validToken(from.Addr(), m.A.Token) {
+			n.sendError(from, m.T, errProtocol, "bad token")
+			return
+		}
+		port := uint16(m.A.Port)
+		if m.A.ImpliedPort != 0 {
+			port = from.Port()
+		}
+		if port == 0 {
+			n.sendError(from, m.T, errProtocol, "invalid port")
+			return
+		}
+		n.storePeer(infoHash, netip.AddrPortFrom(from.Addr(), port))
+	default:
+		n.sendError(from, m.T, errMethodUnknown, "method unknown")
+		return
+	}
+
+	n.send(from, &msg{T: m.T, Y: "r", R: r}) //nolint:errcheck // best effort reply
+}
+
+func (n *Node) sendError(to netip.AddrPort, tx string, code int, message string) {
+	n.send(to, &msg{T: tx, Y: "e", E: []any{code, message}}) //nolint:errcheck // best effort reply
+}
+
+// token returns the announce token for ip under the current (0) or
+// previous (1) secret.
+func (n *Node) token(ip netip.Addr, which int) []byte {
+	n.mu.Lock()
+	secret := n.secrets[which]
+	n.mu.Unlock()
+
+	h := sha1.New()
+	h.Write(secret)
+	ipBytes := ip.AsSlice()
+	h.Write(ipBytes)
+	return h.Sum(nil)[:8]
+}
+
+func (n *Node) validToken(ip netip.Addr, token []byte) bool {
+	for which := range 2 {
+		if string(token) == string(n.token(ip, which)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) rotateSecret() {
+	secret := make([]byte, 16)
+	rand.Read(secret) //nolint:errcheck // crypto/rand.Read never fails
+
+	n.mu.Lock()
+	n.secrets[1] = n.secrets[0]
+	n.secrets[0] = secret
+	if n.secrets[1] == nil {
+		n.secrets[1] = secret
+	}
+	n.rotated = time.Now()
+	n.mu.Unlock()
+}
+
+func (n *Node) storePeer(infoHash ID, addr netip.AddrPort) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	peers := n.peers[infoHash]
+	if peers == nil {
+		if len(n.peers) >= maxHashes {
+			n.dropStalestHash()
+		}
+		peers = make(map[netip.AddrPort]time.Time)
+		n.peers[infoHash] = peers
+	}
+	if _, ok := peers[addr]; !ok && len(peers) >= maxPeersPerHash {
+		return
+	}
+	peers[addr] = time.Now()
+	n.lastPeer[infoHash] = peers[addr]
+}
+
+// dropStalestHash forgets the infohash announced least recently, making
+// room for another. n.mu must be held.
+func (n *Node) dropStalestHash() {
+	var stalest ID
+	var at time.Time
+	for hash, last := range n.lastPeer {
+		if at.IsZero() || last.Before(at) {
+			stalest, at = hash, last
+		}
+	}
+	delete(n.peers, stalest)
+	delete(n.lastPeer, stalest)
+}
+
+func (n *Node) storedPeers(infoHash ID) [][]byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var values [][]byte
+	for addr := range n.peers[infoHash] {
+		if addr.Addr().Is4() {
+			values = append(values, encodePeer(addr))
+		}
+	}
+	return values
+}
+
+// maintain rotates token secrets, forgets expired peers and refreshes
+// stale buckets.
+func (n *Node) maintain() {
+	defer n.routines.Done()
+
+	ticker := time.NewTicker(maintainEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		rotate := time.Now().Sub(n.rotated) >= secretLifetime
+		for hash, peers := range n.peers {
+			for addr, at := range peers {
+				if time.Now().Sub(at) > peerLifetime {
+					delete(peers, addr)
+				}
+			}
+			if len(peers) == 0 {
+				delete(n.peers, hash)
+				delete(n.lastPeer, hash)
+			}
+		}
+		n.mu.Unlock()
+		if rotate {
+			n.rotateSecret()
+		}
+
+		n.refresh()
+	}
+}
+
+// refresh looks up a random ID in every bucket that has not changed for
+// refreshAfter, as BEP 5 asks.
+func (n *Node) refresh() {
+	for _, i := range n.table.stale(refreshAfter) {
+		ctx, cancel := context.WithTimeout(context.Background(), 4*queryTimeout)
+		n.lookup(ctx, randomIDWithPrefix(n.id, i), false)
+		cancel()
+		n.table.touch(i)
+	}
+}
@@ -0,0 +1,36 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+
+	"kbit/pkg/types"
+)
+
+// Name returns the name of the node as a peer source.
+func (n *Node) Name() string { return "dht" }
+
+// FindPeers looks t up in the DHT, joining the network first if the
+// routing table is empty, and announces cfg.AnnouncePort when it is set.
+// Private torrents are never looked up (BEP 27).
+func (n *Node) FindPeers(ctx context.Context, t *types.TorrentFile) ([]string, error) {
+	if t.Private {
+		return nil, nil
+	}
+
+	infoHash, ok := idFromBytes(t.InfoHash)
+	if !ok {
+		return nil, fmt.Errorf("invalid infohash length %d", len(t.InfoHash))
+	}
+
+	if n.table.len() == 0 {
+		if err := n.Bootstrap(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.cfg.AnnouncePort != 0 {
+		return n.Announce(ctx, infoHash, n.cfg.AnnouncePort)
+	}
+	return n.GetPeers(ctx, infoHash)
+}
@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"kbit/internal/bencode"
+)
+
+// state is the saved form of a node: its ID and the compact node info of
+// its routing table.
+type state struct {
+	ID    []byte `bencode:"id"`
+	Nodes []byte `bencode:"nodes"`
+}
+
+// Save writes the node ID and routing table to path, replacing the file
+// atomically.
+func (n *Node) Save(path string) error {
+	data, err := bencode.Marshal(state{ID: n.id[:], Nodes: encodeNodes(n.table.all())})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// load restores the node ID and routing table saved at path. A missing
+// file is not an error. The nodes are of unknown health until they answer.
+func (n *Node) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var s state
+	if err := bencode.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("malformed dht state: %w", err)
+	}
+	id, ok := idFromBytes(s.ID)
+	if !ok {
+		return fmt.Errorf("malformed dht state: invalid node id")
+	}
+
+	n.id = id
+	n.table = newTable(id)
+	for _, node := range decodeNodes(s.Nodes) {
+		n.table.add(node.id, node.addr)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package dht
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// bucketSize is K, the number of nodes a bucket holds.
+	bucketSize = 8
+
+	// questionableAfter is how long a node may stay silent before it is
+	// pinged to decide whether it keeps its place in a full bucket.
+	questionableAfter = 15 * time.Minute
+
+	// maxFailures is how many unanswered queries remove a node.
+	maxFailures = 2
+)
+
+type contact struct {
+	id       ID
+	addr     netip.AddrPort
+	lastSeen time.Time
+	failures int
+}
+
+type bucket struct {
+	contacts []*contact // least recently seen first
+	changed  time.Time
+}
+
+// table is the Kademlia routing table. Bucket i holds the nodes whose IDs
+// share exactly i leading bits with ours; the last bucket also holds
+// nodes equal to or sharing more than 159 bits with us.
+type table struct {
+	mu      sync.Mutex
+	self    ID
+	buckets [160]bucket
+	now     func() time.Time // replaced in tests to age the table
+}
+
+func newTable(self ID) *table {
+	return &table{self: self, now: time.Now}
+}
+
+func (t *table) bucketFor(id ID) *bucket {
+	return &t.buckets[min(prefixLen(t.self, id), len(t.buckets)-1)]
+}
+
+// seen records that node id answered, or queried us, from addr. When its
+// bucket is full of good nodes, the least recently seen one is returned
+// if it has gone quiet, so the caller can ping it; the new node is
+// dropped either way.
+func (t *table) seen(id ID, addr netip.AddrPort) (ping *contact) {
+	if id == t.self {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(id)
+	for i, c := range b.contacts {
+		if c.id != id {
+			continue
+		}
+		c.addr = addr
+		c.lastSeen = t.now()
+		c.failures = 0
+		b.contacts = append(append(b.contacts[:i:i], b.contacts[i+1:]...), c)
+		b.changed = t.now()
+		return nil
+	}
+
+	fresh := &contact{id: id, addr: addr, lastSeen: t.now()}
+	if len(b.contacts) < bucketSize {
+		b.contacts = append(b.contacts, fresh)
+		b.changed = t.now()
+		return nil
+	}
+
+	for i, c := range b.contacts {
+		if c.failures > 0 {
+			b.contacts = append(append(b.contacts[:i:i], b.contacts[i+1:]...), fresh)
+			b.changed = t.now()
+			return nil
+		}
+	}
+
+	oldest := b.contacts[0]
+	if t.now().Sub(oldest.lastSeen) > questionableAfter {
+		c := *oldest
+		return &c
+	}
+	return nil
+}
+
+// add puts a node of unknown health into the table, as when loading a
+// saved table. It never displaces a node.
+func (t *table) add(id ID, addr netip.AddrPort) {
+	if id == t.self {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(id)
+	if len(b.contacts) >= bucketSize {
+		return
+	}
+	for _, c := range b.contacts {
+		if c.id == id {
+			return
+		}
+	}
+	b.contacts = append([]*contact{{id: id, addr: addr}}, b.contacts...)
+}
+
+// failed records an unanswered query to addr and removes the node once it
+// failed maxFailures times in a row.
+func (t *table) failed(addr netip.AddrPort) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		for j, c := range b.contacts {
+			if c.addr != addr {
+				continue
+			}
+			c.failures++
+			if c.failures >= maxFailures {
+				b.contacts = append(b.contacts[:j:j], b.contacts[j+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// closest returns up to n nodes closest to target, nearest first.
+func (t *table) closest(target ID, n int) []nodeInfo {
+	nodes := t.all()
+	sort.Slice(nodes, func(a, b int) bool {
+		return closer(target, nodes[a].id, nodes[b].id)
+	})
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+func (t *table) all() []nodeInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []nodeInfo
+	for i := range t.buckets {
+		for _, c := range t.buckets[i].contacts {
+			nodes = append(nodes, nodeInfo{id: c.id, addr: c.addr})
+		}
+	}
+	return nodes
+}
+
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for i := range t.buckets {
+		n += len(t.buckets[i].contacts)
+	}
+	return n
+}
+
+// stale returns the buckets, up to the deepest one in use, that have not
+// changed for longer than age and so should be refreshed.
+func (t *table) stale(age time.Duration) []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deepest := -1
+	for i := range t.buckets {
+		if len(t.buckets[i].contacts) > 0 {
+			deepest = i
+		}
+	}
+
+	var idx []int
+	for i := 0; i <= deepest; i++ {
+		if t.now().Sub(t.buckets[i].changed) > age {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// touch marks bucket i as refreshed.
+func (t *table) touch(i int) {
+	t.mu.Lock()
+	t.buckets[i].changed = t.now()
+	t.mu.Unlock()
+}
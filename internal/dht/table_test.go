@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func addrN(i int) netip.AddrPort {
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 6881)
+}
+
+// ageTable moves the clock of tb forward by d.
+func ageTable(tb *table, d time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.now = func() time.Time { return time.Now().Add(d) }
+}
+
+func TestPrefixLen(t *testing.T) {
+	var a, b ID
+	if got := prefixLen(a, b); got != 160 {
+		t.Errorf("equal IDs: prefixLen = %d, want 160", got)
+	}
+	b[0] = 0x80
+	if got := prefixLen(a, b); got != 0 {
+		t.Errorf("prefixLen = %d, want 0", got)
+	}
+	b[0], b[2] = 0, 0x10
+	if got := prefixLen(a, b); got != 19 {
+		t.Errorf("prefixLen = %d, want 19", got)
+	}
+}
+
+func TestRandomIDWithPrefix(t *testing.T) {
+	self := RandomID()
+	for _, n := range []int{0, 1, 7, 8, 63, 159} {
+		if got := prefixLen(self, randomIDWithPrefix(self, n)); got != n {
+			t.Errorf("randomIDWithPrefix(%d) shares %d bits", n, got)
+		}
+	}
+}
+
+func TestCompactNodesRoundTrip(t *testing.T) {
+	nodes := []nodeInfo{{id: RandomID(), addr: addrN(1)}, {id: RandomID(), addr: addrN(2)}}
+	got := decodeNodes(append(encodeNodes(nodes), 1, 2, 3))
+	if len(got) != 2 || got[0] != nodes[0] || got[1] != nodes[1] {
+		t.Errorf("round trip = %v, want %v", got, nodes)
+	}
+}
+
+func TestTable_FullBucketKeepsGoodNodes(t *testing.T) {
+	var self ID
+	tb := newTable(self)
+
+	// IDs with the top bit set all land in bucket 0.
+	idAt := func(i int) ID {
+		var id ID
+		id[0] = 0x80
+		id[19] = byte(i)
+		return id
+	}
+	for i := range bucketSize {
+		tb.seen(idAt(i), addrN(i))
+	}
+	if ping := tb.seen(idAt(100), addrN(100)); ping != nil {
+		t.Errorf("fresh bucket asked to ping %v", ping.addr)
+	}
+	if tb.len() != bucketSize {
+		t.Fatalf("table has %d nodes, want %d", tb.len(), bucketSize)
+	}
+
+	// Once the oldest node goes quiet it must be pinged ...
+	ageTable(tb, questionableAfter+time.Minute)
+
+	ping := tb.seen(idAt(101), addrN(101))
+	if ping == nil || ping.id != idAt(0) {
+		t.Fatalf("ping = %v, want the least recently seen node", ping)
+	}
+
+	// ... and a failure makes room for the next newcomer.
+	tb.failed(ping.addr)
+	tb.seen(idAt(102), addrN(102))
+	for _, n := range tb.all() {
+		if n.id == idAt(0) {
+			t.Error("failed node still in the table")
+		}
+	}
+	if tb.len() != bucketSize {
+		t.Errorf("table has %d nodes, want %d", tb.len(), bucketSize)
+	}
+}
+
+func TestTable_Closest(t *testing.T) {
+	tb := newTable(RandomID())
+	for i := range 50 {
+		tb.seen(RandomID(), addrN(i))
+	}
+
+	target := RandomID()
+	got := tb.closest(target, bucketSize)
+	if len(got) != bucketSize {
+		t.Fatalf("closest returned %d nodes", len(got))
+	}
+	for i := 1; i < len(got); i++ {
+		if closer(target, got[i].id, got[i-1].id) {
+			t.Fatalf("closest not sorted at %d", i)
+		}
+	}
+	for _, n := range tb.all() {
+		if closer(target, n.id, got[len(got)-1].id) && !contains(got, n.id) {
+			t.Errorf("node %s is closer than the returned ones", n.id)
+		}
+	}
+}
+
+func contains(nodes []nodeInfo, id ID) bool {
+	for _, n := range nodes {
+		if n.id == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,318 @@
+// Package lsd implements Local Service Discovery (BEP 14): peers on the
+// same network announce the torrents they are active in to a multicast
+// group and learn about each other from those announces.
+package lsd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"kbit/internal/logger"
+	"kbit/pkg/types"
+)
+
+// DefaultGroup is the IPv4 multicast group of BEP 14.
+const DefaultGroup = "239.192.152.143:6771"
+
+// Timings of the service. Variables so tests can speed them up.
+var (
+	announceInterval    = 5 * time.Minute // how often active torrents are announced
+	minAnnounceInterval = time.Minute     // never announce a torrent more often
+)
+
+// Config configures a Service.
+type Config struct {
+	// Group is the multicast group to announce to and listen on;
+	// DefaultGroup when empty.
+	Group string
+	// Interface is the network interface to join the group on; the
+	// system's choice when nil.
+	Interface *net.Interface
+	// Port is the port peers can reach this client on.
+	Port int
+}
+
+// Service announces the torrents it is asked about on the local network
+// and collects the peers that announce the same torrents.
+type Service struct {
+	cfg    Config
+	group  *net.UDPAddr
+	recv   *net.UDPConn
+	send   *net.UDPConn
+	cookie string
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*torrent
+	closed   bool
+	done     chan struct{}
+	routines sync.WaitGroup
+}
+
+// torrent is an infohash the service announces.
+type torrent struct {
+	peers     types.HashSet[string]
+	order     []string
+	watchers  map[int]func(addr string)
+	next      int
+	announced time.Time
+}
+
+// New joins the multicast group of cfg and starts listening for and
+// sending announces.
+func New(cfg Config) (*Service, error) {
+	if cfg.Group == "" {
+		cfg.Group = DefaultGroup
+	}
+	group, err := net.ResolveUDPAddr("udp4", cfg.Group)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lsd group %q: %w", cfg.Group, err)
+	}
+	if !group.IP.IsMulticast() {
+		return nil, fmt.Errorf("lsd group %s is not a multicast address", group.IP)
+	}
+
+	recv, err := net.ListenMulticastUDP("udp4", cfg.Interface, group)
+	if err != nil {
+		return nil, fmt.Errorf("lsd listen: %w", err)
+	}
+	// The receiving socket does not loop multicast back to this host, so
+	// announces go out on their own socket, which other clients on this
+	// machine can hear.
+	send, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		recv.Close()
+		return nil, fmt.Errorf("lsd listen: %w", err)
+	}
+
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+
+	s := &Service{
+		cfg:      cfg,
+		group:    group,
+		recv:     recv,
+		send:     send,
+		cookie:   hex.EncodeToString(cookie),
+		torrents: make(map[[20]byte]*torrent),
+		done:     make(chan struct{}),
+	}
+	s.routines.Add(2)
+	go s.readLoop()
+	go s.announceLoop()
+	return s, nil
+}
+
+// Close stops the service.
+func (s *Service) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	s.mu.Unlock()
+
+	err := errors.Join(s.recv.Close(), s.send.Close())
+	s.routines.Wait()
+	return err
+}
+
+// Name returns the name of the service as a peer source.
+func (s *Service) Name() string { return "lsd" }
+
+// FindPeers starts announcing t on the local network and returns the
+// peers that announced it so far. Private torrents are never announced
+// (BEP 27).
+func (s *Service) FindPeers(ctx context.Context, t *types.TorrentFile) ([]string, error) {
+	if t.Private {
+		return nil, nil
+	}
+	infoHash, err := toInfoHash(t.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	tr := s.activate(infoHash)
+	peers := append([]string(nil), tr.order...)
+	s.mu.Unlock()
+
+	s.announce(infoHash)
+	return peers, nil
+}
+
+// WatchPeers starts announcing t on the local network and calls found with
+// every peer that announces it, those already known first, until ctx is
+// done. Private torrents are never announced.
+func (s *Service) WatchPeers(ctx context.Context, t *types.TorrentFile, found func(addr string)) {
+	if t.Private {
+		return
+	}
+	infoHash, err := toInfoHash(t.InfoHash)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	tr := s.activate(infoHash)
+	id := tr.next
+	tr.next++
+	tr.watchers[id] = found
+	peers := append([]string(nil), tr.order...)
+	s.mu.Unlock()
+
+	for _, addr := range peers {
+		found(addr)
+	}
+	s.announce(infoHash)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.done:
+		}
+		s.mu.Lock()
+		delete(tr.watchers, id)
+		s.mu.Unlock()
+	}()
+}
+
+func (s *Service) activate(infoHash [20]byte) *torrent {
+	tr, ok := s.torrents[infoHash]
+	if !ok {
+		tr = &torrent{peers: make(types.HashSet[string]), watchers: make(map[int]func(string))}
+		s.torrents[infoHash] = tr
+	}
+	return tr
+}
+
+// announce multicasts infoHash unless it was announced less than
+// minAnnounceInterval ago.
+func (s *Service) announce(infoHash [20]byte) {
+	s.mu.Lock()
+	tr := s.torrents[infoHash]
+	if time.Since(tr.announced) < minAnnounceInterval {
+		s.mu.Unlock()
+		return
+	}
+	tr.announced = time.Now()
+	s.mu.Unlock()
+
+	s.write([][20]byte{infoHash})
+}
+
+func (s *Service) announceLoop() {
+	defer s.routines.Done()
+
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		var due [][20]byte
+		s.mu.Lock()
+		for infoHash, tr := range s.torrents {
+			if time.Since(tr.announced) >= minAnnounceInterval {
+				tr.announced = time.Now()
+				due = append(due, infoHash)
+			}
+		}
+		s.mu.Unlock()
+		s.write(due)
+	}
+}
+
+func (s *Service) write(infoHashes [][20]byte) {
+	if len(infoHashes) == 0 {
+		return
+	}
+	packets := encodeAnnounces(s.group.String(), announce{
+		port:       s.cfg.Port,
+		infoHashes: infoHashes,
+		cookie:     s.cookie,
+	})
+	for _, p := range packets {
+		if _, err := s.send.WriteToUDP(p, s.group); err != nil {
+			logger.Log.Debug("lsd announce failed", slog.String("error", err.Error()))
+		}
+	}
+}
+
+func (s *Service) readLoop() {
+	defer s.routines.Done()
+
+	buf := make([]byte, 64<<10)
+	for {
+		size, from, err := s.recv.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		a, err := decodeAnnounce(buf[:size])
+		if err != nil {
+			logger.Log.Debug("dropping lsd packet",
+				slog.String("from", from.String()),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		if a.cookie == s.cookie {
+			continue
+		}
+		s.handle(net.JoinHostPort(from.IP.String(), strconv.Itoa(a.port)), a)
+	}
+}
+
+// handle records addr as a peer of every announced torrent we are active
+// in and tells the watchers about it.
+func (s *Service) handle(addr string, a announce) {
+	var notify []func(string)
+
+	s.mu.Lock()
+	for _, infoHash := range a.infoHashes {
+		tr, ok := s.torrents[infoHash]
+		if !ok {
+			continue
+		}
+		if _, seen := tr.peers[addr]; seen {
+			continue
+		}
+		tr.peers[addr] = struct{}{}
+		tr.order = append(tr.order, addr)
+		for _, w := range tr.watchers {
+			notify = append(notify, w)
+		}
+		logger.Log.Info("lsd peer found",
+			slog.String("peer", addr),
+			slog.String("infohash", hex.EncodeToString(infoHash[:])),
+		)
+	}
+	s.mu.Unlock()
+
+	for _, found := range notify {
+		found(addr)
+	}
+}
+
+func toInfoHash(b []byte) ([20]byte, error) {
+	if len(b) != 20 {
+		return [20]byte{}, fmt.Errorf("invalid infohash length %d", len(b))
+	}
+	return [20]byte(b), nil
+}
@@ -0,0 +1,182 @@
+package lsd
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"kbit/internal/logger"
+	"kbit/pkg/types"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init(slog.LevelError, false)
+	os.Exit(m.Run())
+}
+
+// testGroup returns a multicast group on a free port, so tests do not
+// talk to real clients on the network.
+func testGroup(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer conn.Close()
+	return net.JoinHostPort("239.192.152.143", strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port))
+}
+
+// startService starts a service on group announcing port, skipping the
+// test where multicast is unavailable.
+func startService(t *testing.T, group string, port int) *Service {
+	t.Helper()
+	s, err := New(Config{Group: group, Port: port})
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func infoHash(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 20)
+}
+
+func TestAnnounceRoundTrip(t *testing.T) {
+	a := announce{port: 6881, cookie: "abc"}
+	for i := range 3 {
+		a.infoHashes = append(a.infoHashes, [20]byte(infoHash(byte(i))))
+	}
+
+	packets := encodeAnnounces(DefaultGroup, a)
+	if len(packets) != 1 {
+		t.Fatalf("got %d packets, want 1", len(packets))
+	}
+	if !strings.HasPrefix(string(packets[0]), "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\n") {
+		t.Errorf("unexpected packet %q", packets[0])
+	}
+
+	got, err := decodeAnnounce(packets[0])
+	if err != nil {
+		t.Fatalf("decodeAnnounce failed: %v", err)
+	}
+	if got.port != a.port || got.cookie != a.cookie || len(got.infoHashes) != 3 || got.infoHashes[2] != a.infoHashes[2] {
+		t.Errorf("decoded %+v, want %+v", got, a)
+	}
+}
+
+func TestEncodeAnnounces_SplitsLargeAnnounces(t *testing.T) {
+	a := announce{port: 6881}
+	for i := range 100 {
+		a.infoHashes = append(a.infoHashes, [20]byte(infoHash(byte(i))))
+	}
+
+	total := 0
+	for _, p := range encodeAnnounces(DefaultGroup, a) {
+		if len(p) > maxPacket {
+			t.Errorf("packet of %d bytes exceeds %d", len(p), maxPacket)
+		}
+		got, err := decodeAnnounce(p)
+		if err != nil {
+			t.Fatalf("decodeAnnounce failed: %v", err)
+		}
+		total += len(got.infoHashes)
+	}
+	if total != 100 {
+		t.Errorf("packets carry %d infohashes, want 100", total)
+	}
+}
+
+func TestDecodeAnnounce_Invalid(t *testing.T) {
+	ih := strings.Repeat("ab", 20)
+	for name, msg := range map[string]string{
+		"wrong method":   "NOTIFY * HTTP/1.1\r\nPort: 1\r\nInfohash: " + ih + "\r\n\r\n\r\n",
+		"no port":        "BT-SEARCH * HTTP/1.1\r\nInfohash: " + ih + "\r\n\r\n\r\n",
+		"bad port":       "BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: " + ih + "\r\n\r\n\r\n",
+		"no infohash":    "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\n\r\n\r\n",
+		"short infohash": "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: abcd\r\n\r\n\r\n",
+	} {
+		if _, err := decodeAnnounce([]byte(msg)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// Header names are case-insensitive.
+	a, err := decodeAnnounce([]byte("BT-SEARCH * HTTP/1.1\r\nport: 1\r\nINFOHASH: " + ih + "\r\n\r\n\r\n"))
+	if err != nil || a.port != 1 || len(a.infoHashes) != 1 {
+		t.Errorf("decodeAnnounce = %+v, %v", a, err)
+	}
+}
+
+func TestServices_FindEachOther(t *testing.T) {
+	group := testGroup(t)
+	a, b := startService(t, group, 51413), startService(t, group, 51414)
+	tf := &types.TorrentFile{InfoHash: infoHash(1)}
+
+	found := make(chan string, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.WatchPeers(ctx, tf, func(addr string) { found <- addr })
+
+	// b announces as soon as it is asked about the torrent.
+	if _, err := b.FindPeers(context.Background(), tf); err != nil {
+		t.Fatalf("FindPeers failed: %v", err)
+	}
+
+	select {
+	case addr := <-found:
+		if !strings.HasSuffix(addr, ":51414") {
+			t.Errorf("found %s, want port 51414", addr)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("announce not received")
+	}
+
+	// Neither hears its own announces.
+	time.Sleep(100 * time.Millisecond)
+	for name, s := range map[string]*Service{"a": a, "b": b} {
+		peers, _ := s.FindPeers(context.Background(), tf)
+		for _, p := range peers {
+			if strings.HasSuffix(p, ":"+strconv.Itoa(s.cfg.Port)) {
+				t.Errorf("%s found itself: %v", name, peers)
+			}
+		}
+	}
+}
+
+func TestServices_IgnoreOtherTorrents(t *testing.T) {
+	group := testGroup(t)
+	a, b := startService(t, group, 51413), startService(t, group, 51414)
+
+	a.FindPeers(context.Background(), &types.TorrentFile{InfoHash: infoHash(1)}) //nolint:errcheck
+	b.FindPeers(context.Background(), &types.TorrentFile{InfoHash: infoHash(2)}) //nolint:errcheck
+	time.Sleep(200 * time.Millisecond)
+
+	if peers, _ := a.FindPeers(context.Background(), &types.TorrentFile{InfoHash: infoHash(1)}); len(peers) != 0 {
+		t.Errorf("a found %v for a torrent b is not in", peers)
+	}
+}
+
+func TestPrivateTorrentsAreNotAnnounced(t *testing.T) {
+	group := testGroup(t)
+	a, b := startService(t, group, 51413), startService(t, group, 51414)
+	private := &types.TorrentFile{InfoHash: infoHash(1), Private: true}
+	public := &types.TorrentFile{InfoHash: infoHash(1)}
+
+	a.FindPeers(context.Background(), public) //nolint:errcheck
+	b.WatchPeers(context.Background(), private, func(string) { t.Error("watched a private torrent") })
+	if peers, err := b.FindPeers(context.Background(), private); err != nil || len(peers) != 0 {
+		t.Errorf("FindPeers on a private torrent = %v, %v; want nothing", peers, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if peers, _ := a.FindPeers(context.Background(), public); len(peers) != 0 {
+		t.Errorf("private torrent was announced: a found %v", peers)
+	}
+}
@@ -0,0 +1,94 @@
+package lsd
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxPacket keeps announces below common MTUs; announces for more
+// torrents than fit are split.
+const maxPacket = 1400
+
+// announce is a BT-SEARCH message.
+type announce struct {
+	port       int
+	infoHashes [][20]byte
+	cookie     string
+}
+
+// encodeAnnounces formats a as one or more BT-SEARCH packets addressed to
+// host, each small enough to send in one datagram.
+func encodeAnnounces(host string, a announce) [][]byte {
+	head := fmt.Sprintf("BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", host, a.port)
+	tail := "\r\n\r\n"
+	if a.cookie != "" {
+		tail = "cookie: " + a.cookie + "\r\n" + tail
+	}
+
+	var packets [][]byte
+	var b strings.Builder
+	for _, ih := range a.infoHashes {
+		line := "Infohash: " + hex.EncodeToString(ih[:]) + "\r\n"
+		if b.Len() > 0 && len(head)+b.Len()+len(line)+len(tail) > maxPacket {
+			packets = append(packets, []byte(head+b.String()+tail))
+			b.Reset()
+		}
+		b.WriteString(line)
+	}
+	if b.Len() > 0 {
+		packets = append(packets, []byte(head+b.String()+tail))
+	}
+	return packets
+}
+
+// decodeAnnounce parses a BT-SEARCH packet. Header names are matched
+// without regard to case; unknown headers and malformed infohashes are
+// skipped.
+func decodeAnnounce(data []byte) (announce, error) {
+	var a announce
+
+	sc := bufio.NewScanner(strings.NewReader(string(data)))
+	if !sc.Scan() || strings.TrimSpace(sc.Text()) != "BT-SEARCH * HTTP/1.1" {
+		return a, fmt.Errorf("not a BT-SEARCH message")
+	}
+
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port <= 0 || port > 65535 {
+				return a, fmt.Errorf("invalid port %q", value)
+			}
+			a.port = port
+		case "infohash":
+			raw, err := hex.DecodeString(value)
+			if err != nil || len(raw) != 20 {
+				continue
+			}
+			a.infoHashes = append(a.infoHashes, [20]byte(raw))
+		case "cookie":
+			a.cookie = value
+		}
+	}
+
+	if a.port == 0 {
+		return a, fmt.Errorf("missing port")
+	}
+	if len(a.infoHashes) == 0 {
+		return a, fmt.Errorf("missing infohash")
+	}
+	return a, nil
+}
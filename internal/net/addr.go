@@ -0,0 +1,60 @@
+package net
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+)
+
+// PeerAddr formats a peer address as host:port, bracketing IPv6 addresses
+// ([addr]:port) and writing IPv4-mapped addresses in their IPv4 form.
+func PeerAddr(ip net.IP, port int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// parseCompactPeers reads the compact peer format: 4 bytes of IPv4 address
+// and 2 bytes of port per peer. A trailing partial entry is ignored.
+func parseCompactPeers(data []byte) []string {
+	return parseCompact(data, net.IPv4len)
+}
+
+// parseCompactPeers6 reads the IPv6 compact format of BEP 7: 16 bytes of
+// address and 2 bytes of port per peer.
+func parseCompactPeers6(data []byte) []string {
+	return parseCompact(data, net.IPv6len)
+}
+
+func parseCompact(data []byte, ipLen int) []string {
+	size := ipLen + 2
+	peers := make([]string, 0, len(data)/size)
+	for i := 0; i+size <= len(data); i += size {
+		ip := net.IP(data[i : i+ipLen])
+		port := binary.BigEndian.Uint16(data[i+ipLen : i+size])
+
+		peers = append(peers, PeerAddr(ip, int(port)))
+	}
+	return peers
+}
+
+// localIPv6 returns a global unicast IPv6 address of this host to
+// announce with ipv6=, or nil if there is none. A variable so tests can
+// replace it.
+var localIPv6 = func() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil {
+			continue
+		}
+		if ipNet.IP.IsGlobalUnicast() && !ipNet.IP.IsPrivate() {
+			return ipNet.IP
+		}
+	}
+	return nil
+}
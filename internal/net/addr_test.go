@@ -0,0 +1,121 @@
+package net
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"kbit/pkg/types"
+)
+
+func TestPeerAddr(t *testing.T) {
+	tests := []struct {
+		ip   string
+		port int
+		want string
+	}{
+		{"10.0.0.1", 6881, "10.0.0.1:6881"},
+		{"::ffff:10.0.0.1", 6881, "10.0.0.1:6881"},
+		{"2001:db8::1", 51413, "[2001:db8::1]:51413"},
+	}
+	for _, tt := range tests {
+		if got := PeerAddr(net.ParseIP(tt.ip), tt.port); got != tt.want {
+			t.Errorf("PeerAddr(%s, %d): expected %s, got %s", tt.ip, tt.port, tt.want, got)
+		}
+	}
+}
+
+func TestDecodeAnnounceResponse_IPv6Peers(t *testing.T) {
+	v6 := append(net.ParseIP("2001:db8::1"), 0x1A, 0xE1)
+	body := "d5:peersld2:ip11:2001:db8::24:porti6882eee6:peers618:" + string(v6) + "e"
+
+	peers := decodePeers(t, []byte(body))
+	for _, want := range []string{"[2001:db8::1]:6881", "[2001:db8::2]:6882"} {
+		if _, ok := peers[want]; !ok {
+			t.Errorf("expected peer %s, got: %v", want, peers)
+		}
+	}
+}
+
+func TestBuildTrackerURL_IPv6Param(t *testing.T) {
+	old := localIPv6
+	localIPv6 = func() net.IP { return net.ParseIP("2001:db8::5") }
+	defer func() { localIPv6 = old }()
+
+	torrent := &types.TorrentFile{InfoHash: make([]byte, 20)}
+	result, err := buildTrackerURL(torrent, "http://tracker.example.com/announce", announceParams{left: torrent.Length})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if !strings.Contains(result, "ipv6=2001%3Adb8%3A%3A5") {
+		t.Errorf("expected ipv6 param, got: %s", result)
+	}
+
+	localIPv6 = func() net.IP { return nil }
+	result, _ = buildTrackerURL(torrent, "http://tracker.example.com/announce", announceParams{left: torrent.Length})
+	if strings.Contains(result, "ipv6=") {
+		t.Errorf("expected no ipv6 param without an IPv6 address, got: %s", result)
+	}
+}
+
+func TestHandshake_IPv6Peer(t *testing.T) {
+	PeerID = []byte("-GT0001-LOCALPEERID-")
+	infoHash := []byte("01234567890123456789")
+
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 68)
+		io.ReadFull(conn, buf)                       //nolint:errcheck
+		conn.Write(buildHandshakeResponse(infoHash)) //nolint:errcheck
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	conn, err := Handshake(PeerAddr(addr.IP, addr.Port), infoHash)
+	if err != nil {
+		t.Fatalf("expected handshake over IPv6 to succeed, got: %v", err)
+	}
+	conn.Close()
+}
+
+func TestListenDualStack(t *testing.T) {
+	ln, err := ListenDualStack(0)
+	if err != nil {
+		t.Fatalf("ListenDualStack failed: %v", err)
+	}
+	defer ln.Close()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	targets := []string{PeerAddr(net.ParseIP("127.0.0.1"), port)}
+	if probe, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		probe.Close()
+		targets = append(targets, PeerAddr(net.ParseIP("::1"), port))
+	}
+
+	for _, target := range targets {
+		client, err := net.Dial("tcp", target)
+		if err != nil {
+			t.Fatalf("dial %s: %v", target, err)
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("accept from %s: %v", target, err)
+		}
+		conn.Close()
+		client.Close()
+	}
+
+	ln.Close()
+	if _, err := ln.Accept(); err == nil {
+		t.Error("expected Accept to fail after Close")
+	}
+}
@@ -0,0 +1,235 @@
+package net
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kbit/internal/logger"
+	"kbit/pkg/types"
+)
+
+// announceUnit is the unit of tracker intervals. A variable so tests can
+// run whole announce cycles in milliseconds.
+var announceUnit = time.Second
+
+const (
+	// defaultInterval is used when a tracker gives no interval.
+	defaultInterval = 30 * 60
+	// retryInterval is the first wait after every tracker failed; it
+	// doubles with each further failure up to defaultInterval.
+	retryInterval = 60
+	// stopTimeout bounds the stopped announce sent on shutdown.
+	stopTimeout = 5 * time.Second
+)
+
+// Stats are the transfer counters of a session, reported to trackers.
+type Stats struct {
+	Uploaded   atomic.Int64
+	Downloaded atomic.Int64
+	Left       atomic.Int64
+}
+
+// NewStats returns counters for a session that still needs left bytes.
+func NewStats(left int64) *Stats {
+	s := &Stats{}
+	s.Left.Store(left)
+	return s
+}
+
+// Announcer keeps a torrent announced to its trackers for the lifetime of
+// a session: it sends started first, completed once the download finishes
+// and stopped on shutdown, re-announces on the tracker's interval, and
+// feeds every peer it learns into a PeerPool.
+type Announcer struct {
+	torrent *types.TorrentFile
+	pool    *PeerPool
+	stats   *Stats
+
+	trackerIDs map[string]string
+
+	completeOnce sync.Once
+	completed    chan struct{}
+	needPeers    chan struct{}
+	done         chan struct{}
+}
+
+// NewAnnouncer returns an announcer for t that reports stats and adds the
+// peers it receives to pool.
+func NewAnnouncer(t *types.TorrentFile, pool *PeerPool, stats *Stats) *Announcer {
+	return &Announcer{
+		torrent:    t,
+		pool:       pool,
+		stats:      stats,
+		trackerIDs: make(map[string]string),
+		completed:  make(chan struct{}),
+		needPeers:  make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+}
+
+// Completed tells the trackers that the download finished. It may be
+// called more than once.
+func (a *Announcer) Completed() {
+	a.completeOnce.Do(func() { close(a.completed) })
+}
+
+// NeedPeers asks for an early announce because the session ran out of
+// peers. The tracker's min interval is still respected.
+func (a *Announcer) NeedPeers() {
+	select {
+	case a.needPeers <- struct{}{}:
+	default:
+	}
+}
+
+// Done is closed when Run has returned.
+func (a *Announcer) Done() <-chan struct{} {
+	return a.done
+}
+
+// Run announces until ctx is cancelled, then sends stopped to the trackers
+// if they were told the session started.
+func (a *Announcer) Run(ctx context.Context) {
+	defer close(a.done)
+
+	event := eventStarted
+	started := false  // a tracker accepted started
+	complete := false // the download finished
+	reported := false // a tracker accepted completed
+	completed := a.completed
+	var next, earliest time.Time
+	fails := 0
+
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			select {
+			case <-a.completed:
+				complete = true
+			default:
+			}
+			if started {
+				if complete && !reported {
+					a.final(eventCompleted)
+				}
+				a.final(eventStopped)
+			}
+			return
+		case <-completed:
+			timer.Stop()
+			completed = nil
+			complete = true
+			// Completed must follow a started; until one is accepted the
+			// started announce is retried and completed is sent after it.
+			if started {
+				event = eventCompleted
+				next = time.Time{}
+			}
+			continue
+		case <-a.needPeers:
+			timer.Stop()
+			if earliest.Before(next) {
+				next = earliest
+			}
+			continue
+		case <-timer.C:
+		}
+
+		resp, err := a.announce(ctx, event)
+		now := time.Now()
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			fails++
+			wait := min(retryInterval<<(fails-1), defaultInterval)
+			next = now.Add(time.Duration(wait) * announceUnit)
+			logger.Log.Warn("no tracker answered",
+				slog.String("event", event.String()),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		fails = 0
+
+		added := a.pool.Add(resp.Peers...)
+		logger.Log.Info("announced",
+			slog.String("event", event.String()),
+			slog.Int("peers", len(resp.Peers)),
+			slog.Int("new", added),
+		)
+
+		switch event {
+		case eventStarted:
+			started = true
+		case eventCompleted:
+			reported = true
+		}
+		event = eventNone
+		if complete && !reported {
+			event = eventCompleted
+			next = time.Time{}
+			continue
+		}
+
+		interval := resp.Interval
+		if interval <= 0 {
+			interval = defaultInterval
+		}
+		next = now.Add(time.Duration(interval) * announceUnit)
+		earliest = now.Add(time.Duration(resp.MinInterval) * announceUnit)
+	}
+}
+
+// announce sends one announce with the current counters, walking the tiers
+// of the torrent.
+func (a *Announcer) announce(ctx context.Context, event announceEvent) (*AnnounceResponse, error) {
+	params := announceParams{
+		event:      event,
+		uploaded:   a.stats.Uploaded.Load(),
+		downloaded: a.stats.Downloaded.Load(),
+		left:       a.stats.Left.Load(),
+	}
+
+	resp, tracker, err := announceTiers(a.torrent.Tiers, func(tracker string) (*AnnounceResponse, error) {
+		p := params
+		p.trackerID = a.trackerIDs[tracker]
+
+		actx, cancel := context.WithTimeout(ctx, trackerTimeout)
+		defer cancel()
+
+		resp, err := announce(actx, a.torrent, tracker, p)
+		if err != nil {
+			logger.Log.Warn("failed to reach tracker",
+				slog.String("tracker", tracker),
+				slog.String("error", err.Error()),
+			)
+		}
+		return resp, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.TrackerID != "" {
+		a.trackerIDs[tracker] = resp.TrackerID
+	}
+	return resp, nil
+}
+
+// final sends an announce during shutdown, when the session context is
+// already cancelled.
+func (a *Announcer) final(event announceEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	if _, err := a.announce(ctx, event); err != nil {
+		logger.Log.Warn("final announce failed",
+			slog.String("event", event.String()),
+			slog.String("error", err.Error()),
+		)
+	}
+}
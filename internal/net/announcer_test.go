@@ -0,0 +1,221 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"kbit/pkg/types"
+)
+
+// recordingTracker is an HTTP tracker that records every announce and
+// hands out a new peer with each answer.
+type recordingTracker struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	announces []url.Values
+	interval  int
+	minInt    int
+	fail      bool
+}
+
+func startRecordingTracker(t *testing.T, interval, minInterval int) *recordingTracker {
+	t.Helper()
+	rt := &recordingTracker{interval: interval, minInt: minInterval}
+	rt.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		if rt.fail {
+			fmt.Fprint(w, "d14:failure reason4:downe")
+			return
+		}
+		rt.announces = append(rt.announces, r.URL.Query())
+		n := len(rt.announces)
+		peer := []byte{10, 0, 0, byte(n), 0x1A, 0xE1}
+		fmt.Fprintf(w, "d8:intervali%de12:min intervali%de5:peers6:%s10:tracker id3:abce",
+			rt.interval, rt.minInt, peer)
+	}))
+	t.Cleanup(rt.Close)
+	return rt
+}
+
+func (rt *recordingTracker) snapshot() []url.Values {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return append([]url.Values(nil), rt.announces...)
+}
+
+func (rt *recordingTracker) waitFor(t *testing.T, n int) []url.Values {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if got := rt.snapshot(); len(got) >= n {
+			return got
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("tracker saw %d announces, want at least %d", len(rt.snapshot()), n)
+	return nil
+}
+
+func fastAnnounces(t *testing.T) {
+	t.Helper()
+	orig := announceUnit
+	announceUnit = 10 * time.Millisecond
+	t.Cleanup(func() { announceUnit = orig })
+}
+
+func announcerTorrent(tracker string) *types.TorrentFile {
+	return &types.TorrentFile{
+		InfoHash: make([]byte, 20),
+		Length:   1000,
+		Tiers:    [][]string{{tracker}},
+	}
+}
+
+func TestAnnouncer_Lifecycle(t *testing.T) {
+	fastAnnounces(t)
+	rt := startRecordingTracker(t, 5, 0)
+
+	pool := NewPeerPool()
+	stats := NewStats(1000)
+	a := NewAnnouncer(announcerTorrent(rt.URL), pool, stats)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go a.Run(ctx)
+
+	got := rt.waitFor(t, 2)
+	if got[0].Get("event") != "started" {
+		t.Errorf("first event = %q, want started", got[0].Get("event"))
+	}
+	if got[1].Get("event") != "" {
+		t.Errorf("re-announce event = %q, want none", got[1].Get("event"))
+	}
+	if got[1].Get("trackerid") != "abc" {
+		t.Errorf("trackerid = %q, want abc echoed back", got[1].Get("trackerid"))
+	}
+
+	stats.Downloaded.Store(1000)
+	stats.Uploaded.Store(300)
+	stats.Left.Store(0)
+	a.Completed()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got = rt.snapshot()
+		if got[len(got)-1].Get("event") == "completed" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("completed was never announced")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	last := got[len(got)-1]
+	if last.Get("downloaded") != "1000" || last.Get("uploaded") != "300" || last.Get("left") != "0" {
+		t.Errorf("completed counters = downloaded %s uploaded %s left %s, want 1000/300/0",
+			last.Get("downloaded"), last.Get("uploaded"), last.Get("left"))
+	}
+
+	cancel()
+	<-a.Done()
+	got = rt.snapshot()
+	if ev := got[len(got)-1].Get("event"); ev != "stopped" {
+		t.Errorf("last event = %q, want stopped", ev)
+	}
+
+	if pool.Len() < 3 {
+		t.Errorf("pool has %d peers, want one per announce (at least 3)", pool.Len())
+	}
+}
+
+func TestAnnouncer_CompletedBeforeShutdown(t *testing.T) {
+	rt := startRecordingTracker(t, 1800, 0)
+	a := NewAnnouncer(announcerTorrent(rt.URL), NewPeerPool(), NewStats(0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go a.Run(ctx)
+	rt.waitFor(t, 1)
+
+	// Finishing and shutting down at once still reports the completion.
+	a.Completed()
+	cancel()
+	<-a.Done()
+
+	var events []string
+	for _, q := range rt.snapshot() {
+		events = append(events, q.Get("event"))
+	}
+	want := []string{"started", "completed", "stopped"}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+}
+
+func TestAnnouncer_NeedPeersRespectsMinInterval(t *testing.T) {
+	fastAnnounces(t)
+	rt := startRecordingTracker(t, 100000, 20)
+	a := NewAnnouncer(announcerTorrent(rt.URL), NewPeerPool(), NewStats(1000))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		<-a.Done()
+	}()
+	go a.Run(ctx)
+	rt.waitFor(t, 1)
+
+	start := time.Now()
+	a.NeedPeers()
+	rt.waitFor(t, 2)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("early announce after %v, want no sooner than the 200ms min interval", elapsed)
+	}
+}
+
+func TestAnnouncer_NoStoppedWithoutStarted(t *testing.T) {
+	rt := startRecordingTracker(t, 1800, 0)
+	rt.fail = true
+	a := NewAnnouncer(announcerTorrent(rt.URL), NewPeerPool(), NewStats(1000))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go a.Run(ctx)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-a.Done()
+
+	if got := rt.snapshot(); len(got) != 0 {
+		t.Errorf("tracker recorded %d announces, want none after started failed", len(got))
+	}
+}
+
+func TestPeerPool_AddDeduplicatesAndSignals(t *testing.T) {
+	pool := NewPeerPool("a:1")
+	<-pool.Changed()
+
+	if n := pool.Add("a:1", "b:2", "b:2"); n != 1 {
+		t.Errorf("Add returned %d, want 1 new peer", n)
+	}
+	select {
+	case <-pool.Changed():
+	default:
+		t.Error("Changed not signalled after a new peer")
+	}
+
+	pool.Add("a:1")
+	select {
+	case <-pool.Changed():
+		t.Error("Changed signalled without a new peer")
+	default:
+	}
+
+	if got := fmt.Sprint(pool.Peers()); got != "[a:1 b:2]" {
+		t.Errorf("Peers = %s, want [a:1 b:2]", got)
+	}
+}
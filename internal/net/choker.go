@@ -0,0 +1,272 @@
+package net
+
+import (
+	"context"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultUploadSlots is how many interested peers are unchoked for their
+// rates unless told otherwise; one more is unchoked optimistically.
+const DefaultUploadSlots = 4
+
+const (
+	// rechokeInterval is how often upload slots are given out again.
+	rechokeInterval = 10 * time.Second
+
+	// optimisticInterval is how often the optimistic unchoke moves on.
+	optimisticInterval = 30 * time.Second
+
+	// newPeerAge is how long a peer counts as new; new peers are three
+	// times as likely to be unchoked optimistically, so they get a chance
+	// to earn a regular slot.
+	newPeerAge = 3 * optimisticInterval
+)
+
+// chokePeer is a connection the choker decides for.
+type chokePeer interface {
+	// isInterested reports whether the peer wants to download from us.
+	isInterested() bool
+	// downloaded and uploaded count the bytes received from and sent to
+	// the peer so far.
+	downloaded() int64
+	uploaded() int64
+	// setChoked chokes or unchokes the peer, telling it if that changes
+	// anything.
+	setChoked(choked bool)
+}
+
+// chokeState is what the choker remembers about a peer.
+type chokeState struct {
+	seq      int // order of joining
+	joined   time.Time
+	choked   bool
+	regular  bool  // holds a regular upload slot
+	last     int64 // counter value at the last rechoke
+	lastRate float64
+}
+
+// choker gives out upload slots as BEP 3 describes: every 10 seconds the
+// interested peers with the best rates are unchoked, by how fast they send
+// to us while we are downloading and by how fast they take from us once we
+// are seeding. Peers that are not interested but beat the slowest of them
+// are unchoked too, ready for when they become interested. Every 30
+// seconds one more interested peer is unchoked at random, favouring new
+// peers, so that peers without a rate yet can show what they do.
+type choker struct {
+	slots   int
+	seeding func() bool
+	now     func() time.Time // replaced in tests
+	rand    *rand.Rand       // replaced in tests
+
+	mu             sync.Mutex
+	peers          map[chokePeer]*chokeState
+	joins          int
+	wasSeeding     bool
+	optimistic     chokePeer
+	lastRechoke    time.Time
+	lastOptimistic time.Time
+}
+
+func newChoker(slots int, seeding func() bool) *choker {
+	return &choker{
+		slots:      slots,
+		seeding:    seeding,
+		now:        time.Now,
+		rand:       rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+		peers:      make(map[chokePeer]*chokeState),
+		wasSeeding: seeding(),
+	}
+}
+
+// run rechokes until ctx is done.
+func (c *choker) run(ctx context.Context) {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.rechoke()
+		}
+	}
+}
+
+// add starts managing p, which begins choked.
+func (c *choker) add(p chokePeer) {
+	c.mu.Lock()
+	c.joins++
+	c.peers[p] = &chokeState{seq: c.joins, joined: c.now(), choked: true, last: c.counter(p)}
+	c.mu.Unlock()
+	c.update()
+}
+
+// remove stops managing p and hands its slot on.
+func (c *choker) remove(p chokePeer) {
+	c.mu.Lock()
+	delete(c.peers, p)
+	if c.optimistic == p {
+		c.optimistic = nil
+	}
+	c.mu.Unlock()
+	c.update()
+}
+
+// update fills free regular slots with interested peers at once, rather
+// than leaving them empty until the next rechoke. Call it whenever a peer
+// changes its interest.
+func (c *choker) update() {
+	c.mu.Lock()
+	used := 0
+	for p, st := range c.peers {
+		if st.regular && p.isInterested() {
+			used++
+		}
+	}
+
+	var unchoke []chokePeer
+	for _, p := range c.byRate() {
+		if used >= c.slots {
+			break
+		}
+		st := c.peers[p]
+		if st.regular || p == c.optimistic || !p.isInterested() {
+			continue
+		}
+		st.regular, st.choked = true, false
+		unchoke = append(unchoke, p)
+		used++
+	}
+	c.mu.Unlock()
+
+	for _, p := range unchoke {
+		p.setChoked(false)
+	}
+}
+
+// rechoke recomputes the rates and gives out the slots again, moving the
+// optimistic unchoke on when it has had its 30 seconds.
+func (c *choker) rechoke() {
+	c.mu.Lock()
+	now := c.now()
+	elapsed := now.Sub(c.lastRechoke).Seconds()
+	c.lastRechoke = now
+	// Once the download completes, rates switch from one counter to the
+	// other and start again from zero.
+	seeding := c.seeding()
+	switched := seeding != c.wasSeeding
+	c.wasSeeding = seeding
+	for p, st := range c.peers {
+		counter := c.counter(p)
+		switch {
+		case switched:
+			st.lastRate = 0
+		case elapsed > 0:
+			st.lastRate = float64(counter-st.last) / elapsed
+		}
+		st.last = counter
+	}
+
+	regular := make(map[chokePeer]bool)
+	interested := 0
+	for _, p := range c.byRate() {
+		if interested >= c.slots {
+			break
+		}
+		regular[p] = true
+		if p.isInterested() {
+			interested++
+		}
+	}
+
+	if c.optimistic == nil || regular[c.optimistic] || now.Sub(c.lastOptimistic) >= optimisticInterval {
+		c.optimistic = c.pickOptimistic(regular)
+		c.lastOptimistic = now
+	}
+
+	type change struct {
+		p      chokePeer
+		choked bool
+	}
+	var changes []change
+	for p, st := range c.peers {
+		st.regular = regular[p]
+		choked := !st.regular && p != c.optimistic
+		if choked != st.choked {
+			st.choked = choked
+			changes = append(changes, change{p, choked})
+		}
+	}
+	c.mu.Unlock()
+
+	for _, ch := range changes {
+		ch.p.setChoked(ch.choked)
+	}
+}
+
+// pickOptimistic draws an interested peer outside the regular slots, new
+// peers weighing three times as much as the others.
+func (c *choker) pickOptimistic(regular map[chokePeer]bool) chokePeer {
+	var candidates []chokePeer
+	total := 0
+	weight := func(p chokePeer) int {
+		if c.now().Sub(c.peers[p].joined) < newPeerAge {
+			return 3
+		}
+		return 1
+	}
+
+	for _, p := range c.sorted() {
+		if regular[p] || !p.isInterested() {
+			continue
+		}
+		candidates = append(candidates, p)
+		total += weight(p)
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := c.rand.IntN(total)
+	for _, p := range candidates {
+		n -= weight(p)
+		if n < 0 {
+			return p
+		}
+	}
+	return nil
+}
+
+// byRate returns the peers fastest first.
+func (c *choker) byRate() []chokePeer {
+	peers := c.sorted()
+	sort.SliceStable(peers, func(a, b int) bool {
+		return c.peers[peers[a]].lastRate > c.peers[peers[b]].lastRate
+	})
+	return peers
+}
+
+// sorted returns the peers in the order they joined, so that ties and
+// random draws do not depend on map order.
+func (c *choker) sorted() []chokePeer {
+	peers := make([]chokePeer, 0, len(c.peers))
+	for p := range c.peers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(a, b int) bool {
+		return c.peers[peers[a]].seq < c.peers[peers[b]].seq
+	})
+	return peers
+}
+
+// counter is the byte count rates are taken from: what the peer sends us
+// while we download, and what it takes from us once we seed.
+func (c *choker) counter(p chokePeer) int64 {
+	if c.seeding() {
+		return p.uploaded()
+	}
+	return p.downloaded()
+}
@@ -0,0 +1,170 @@
+package net
+
+import (
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+// fakePeer is a chokePeer whose counters the test sets.
+type fakePeer struct {
+	name       string
+	interested bool
+	down, up   int64
+	choked     bool
+}
+
+func (p *fakePeer) isInterested() bool { return p.interested }
+func (p *fakePeer) downloaded() int64  { return p.down }
+func (p *fakePeer) uploaded() int64    { return p.up }
+
+func (p *fakePeer) setChoked(choked bool) {
+	p.choked = choked
+}
+
+// fakeChoker returns a choker with a clock the test moves and a fixed
+// random source.
+func fakeChoker(slots int, seeding bool) (*choker, *time.Time) {
+	now := time.Unix(1_000_000, 0)
+	c := newChoker(slots, func() bool { return seeding })
+	c.now = func() time.Time { return now }
+	c.rand = rand.New(rand.NewPCG(1, 2))
+	c.lastRechoke = now
+	return c, &now
+}
+
+func addPeers(c *choker, names ...string) []*fakePeer {
+	var peers []*fakePeer
+	for _, name := range names {
+		p := &fakePeer{name: name, interested: true, choked: true}
+		c.add(p)
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+func unchoked(peers []*fakePeer) []string {
+	var names []string
+	for _, p := range peers {
+		if !p.choked {
+			names = append(names, p.name)
+		}
+	}
+	return names
+}
+
+func TestChoker_FillsFreeSlotsAtOnce(t *testing.T) {
+	c, _ := fakeChoker(2, false)
+	peers := addPeers(c, "a", "b", "c")
+
+	if got := unchoked(peers); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("unchoked = %v, want [a b]", got)
+	}
+
+	// A slot that frees up goes to the waiting peer.
+	c.remove(peers[0])
+	if peers[2].choked {
+		t.Error("c still choked after a left")
+	}
+}
+
+func TestChoker_RechokesByDownloadRateWhileLeeching(t *testing.T) {
+	c, now := fakeChoker(2, false)
+	peers := addPeers(c, "a", "b", "c", "d", "e")
+	for i, p := range peers {
+		p.down = int64(i) * 10_000 // e is fastest, a slowest
+		p.up = int64(5-i) * 10_000
+	}
+
+	*now = now.Add(rechokeInterval)
+	c.rechoke()
+
+	if peers[4].choked || peers[3].choked {
+		t.Errorf("fastest peers d, e choked; unchoked = %v", unchoked(peers))
+	}
+	if got := unchoked(peers); len(got) != 3 {
+		t.Errorf("unchoked = %v, want two regular slots and one optimistic", got)
+	}
+}
+
+func TestChoker_RechokesByUploadRateWhileSeeding(t *testing.T) {
+	c, now := fakeChoker(1, true)
+	peers := addPeers(c, "a", "b", "c")
+	peers[1].up = 50_000
+	peers[2].down = 90_000 // ignored once seeding
+
+	*now = now.Add(rechokeInterval)
+	c.rechoke()
+
+	c.mu.Lock()
+	regular := c.peers[peers[1]].regular
+	c.mu.Unlock()
+	if !regular || peers[1].choked {
+		t.Errorf("b, the fastest downloader from us, has no regular slot; unchoked = %v", unchoked(peers))
+	}
+}
+
+func TestChoker_UnchokesFasterUninterestedPeers(t *testing.T) {
+	c, now := fakeChoker(1, false)
+	peers := addPeers(c, "a", "b")
+	peers[0].interested = false
+	peers[0].down = 80_000
+	peers[1].down = 10_000
+
+	*now = now.Add(rechokeInterval)
+	c.rechoke()
+
+	if peers[0].choked || peers[1].choked {
+		t.Errorf("unchoked = %v, want both: a is faster, b is the only interested peer", unchoked(peers))
+	}
+}
+
+func TestChoker_OptimisticUnchokeRotates(t *testing.T) {
+	c, now := fakeChoker(0, false)
+	peers := addPeers(c, "a", "b", "c", "d")
+
+	c.rechoke()
+	first := c.optimistic
+	if first == nil {
+		t.Fatal("no optimistic unchoke")
+	}
+
+	// It keeps its slot for 30 seconds ...
+	for range 2 {
+		*now = now.Add(rechokeInterval)
+		c.rechoke()
+		if c.optimistic != first {
+			t.Fatal("optimistic unchoke moved before 30 seconds")
+		}
+	}
+
+	// ... and then moves on, over time to everyone.
+	seen := make(map[chokePeer]bool)
+	for range 40 {
+		*now = now.Add(optimisticInterval)
+		c.rechoke()
+		seen[c.optimistic] = true
+		if got := unchoked(peers); len(got) != 1 {
+			t.Fatalf("unchoked = %v, want only the optimistic peer", got)
+		}
+	}
+	if len(seen) != len(peers) {
+		t.Errorf("optimistic unchoke reached %d of %d peers", len(seen), len(peers))
+	}
+}
+
+func TestChoker_OptimisticFavoursNewPeers(t *testing.T) {
+	c, now := fakeChoker(0, false)
+	old := addPeers(c, "old")[0]
+	*now = now.Add(10 * time.Minute)
+	fresh := addPeers(c, "new")[0]
+
+	picks := map[chokePeer]int{}
+	for range 4000 {
+		picks[c.pickOptimistic(nil)]++
+	}
+	share := float64(picks[fresh]) / 4000
+	if share < 0.7 || share > 0.8 {
+		t.Errorf("new peer picked %.2f of the time, want about 0.75 (old %d)", share, picks[old])
+	}
+}
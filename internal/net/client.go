@@ -6,6 +6,9 @@ import (
 
 var PeerID []byte
 
+// ListenPort is the port announced to trackers and peers.
+var ListenPort = 6881
+
 func GeneratePeerID() ([]byte, error) {
 	peerID := make([]byte, 20)
 	copy(peerID[:8], []byte("-GT0001-"))
@@ -1,142 +1,136 @@
 package net
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"net"
 	"net/http"
 	"net/url"
 	"strconv"
-	"sync"
 	"log/slog"
 
 	"kbit/internal/logger"
 	"kbit/pkg/types"
 )
 
-func DiscoverPeers(torrent *types.TorrentFile, urls *types.HashSet[string]) error {
-	if ((*torrent).Private || len(*urls) == 1) {
-		peers := bruteForce(torrent, urls)
-		torrent.Peers = peers
-		return nil
-	}
-
-	peers := fetchConcurent(torrent, urls)
-	torrent.Peers = peers
-	return nil
-}
-
-func fetchConcurent(torrent *types.TorrentFile, urls *types.HashSet[string]) types.HashSet[string] {
-	peers := make(types.HashSet[string])
-
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-
-	limit := make(chan struct{}, 10)
-
-	for trackerURL := range *urls {
-		wg.Add(1)
+// trackerSource asks the trackers of a torrent for peers once, walking its
+// tiers as BEP 12 describes.
+type trackerSource struct{}
 
-		go func(tracker string) {
-			defer wg.Done()
+func (trackerSource) Name() string { return "tracker" }
 
-			limit <- struct{}{}
-			defer func() { <-limit }()
+func (trackerSource) FindPeers(ctx context.Context, torrent *types.TorrentFile) ([]string, error) {
+	resp, _, err := announceTiers(torrent.Tiers, func(tracker string) (*AnnounceResponse, error) {
+		return queryTracker(ctx, torrent, tracker)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Peers, nil
+}
 
-			reqURL, err := buildTrackerURL(torrent, tracker)
+// announceTiers tries the trackers of the first tier in order, and moves on
+// to the next tier only when every tracker in it failed. The tracker that
+// answers is moved to the front of its tier so it is asked first next
+// time. It returns the response and the URL of that tracker.
+func announceTiers(tiers [][]string, announce func(tracker string) (*AnnounceResponse, error)) (*AnnounceResponse, string, error) {
+	var errs []error
+	for _, tier := range tiers {
+		for i, tracker := range tier {
+			resp, err := announce(tracker)
 			if err != nil {
-				logger.Log.Error("invalid tracker URL",
-					slog.String("tracker", tracker),
-					slog.String("error", err.Error()),
-				)
-				return
+				errs = append(errs, fmt.Errorf("%s: %w", tracker, err))
+				continue
 			}
 
-			logger.Log.Info("querying tracker",
-				slog.String("tracker", tracker),
-				slog.String("infohash", fmt.Sprintf("%x", torrent.InfoHash)),
-			)
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = tracker
+			return resp, tracker, nil
+		}
+	}
 
-			resp, err := http.Get(reqURL)
-			if err != nil {
-				logger.Log.Warn("failed to reach tracker",
-					slog.String("tracker", tracker),
-					slog.String("error", err.Error()),
-				)
-				return
-			}
-			defer resp.Body.Close()
+	if len(errs) == 0 {
+		return nil, "", fmt.Errorf("no trackers")
+	}
+	return nil, "", errors.Join(errs...)
+}
 
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				logger.Log.Warn("failed to read tracker response",
-					slog.String("tracker", tracker),
-					slog.String("error", err.Error()),
-				)
-				return
-			}
+// queryTracker announces to one tracker, giving up after trackerTimeout,
+// and logs the outcome.
+func queryTracker(ctx context.Context, torrent *types.TorrentFile, tracker string) (*AnnounceResponse, error) {
+	logger.Log.Info("querying tracker",
+		slog.String("tracker", tracker),
+		slog.String("infohash", fmt.Sprintf("%x", torrent.InfoHash)),
+	)
 
-			temp := make(types.HashSet[string])
-			extractPeers(body, temp)
+	ctx, cancel := context.WithTimeout(ctx, trackerTimeout)
+	defer cancel()
 
-			mu.Lock()
-			for p := range temp {
-				peers[p] = struct{}{}
-			}
+	resp, err := announce(ctx, torrent, tracker, announceParams{left: torrent.Length})
+	if err != nil {
+		logger.Log.Warn("failed to reach tracker",
+			slog.String("tracker", tracker),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
+	}
+	return resp, nil
+}
 
-			mu.Unlock()
-		}(trackerURL)
+// announce sends one announce to tracker over HTTP(S) or UDP, depending on
+// its scheme.
+func announce(ctx context.Context, torrent *types.TorrentFile, tracker string, params announceParams) (*AnnounceResponse, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker URL: %w", err)
 	}
 
-	wg.Wait()
-	return peers
+	switch u.Scheme {
+	case "udp":
+		return udpAnnounce(ctx, u.Host, torrent.InfoHash, params)
+	case "http", "https":
+		return httpAnnounce(ctx, torrent, tracker, params)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
 }
 
-func bruteForce(torrent *types.TorrentFile, urls *types.HashSet[string]) types.HashSet[string] {
-	peers := make(types.HashSet[string])
-	for trackerURL := range *urls {
-		reqURL, err := buildTrackerURL(torrent, trackerURL)
-		if err != nil {
-			logger.Log.Error("invalid tracker URL",
-				slog.String("tracker", trackerURL),
-				slog.String("error", err.Error()),
-			)
-			continue
-		}
-
-		logger.Log.Info("querying tracker",
-			slog.String("tracker", trackerURL),
-			slog.String("infohash", fmt.Sprintf("%x", torrent.InfoHash)),
-		)
+func httpAnnounce(ctx context.Context, torrent *types.TorrentFile, tracker string, params announceParams) (*AnnounceResponse, error) {
+	reqURL, err := buildTrackerURL(torrent, tracker, params)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker URL: %w", err)
+	}
 
-		resp, err := http.Get(reqURL)
-		if err != nil {
-			logger.Log.Warn("failed to reach tracker",
-				slog.String("tracker", trackerURL),
-				slog.String("error", err.Error()),
-			)
-			continue
-		}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
 
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			logger.Log.Warn("failed to read tracker response",
-				slog.String("tracker", trackerURL),
-				slog.String("error", err.Error()),
-			)
-			continue
-		}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-		extractPeers(body, peers)
+	body, err := readTrackerBody(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading tracker response: %w", err)
 	}
 
-	return peers
+	result, err := decodeAnnounceResponse(body)
+	if err != nil {
+		return nil, err
+	}
+	if result.WarningMessage != "" {
+		logger.Log.Warn("tracker warning",
+			slog.String("tracker", tracker),
+			slog.String("message", result.WarningMessage),
+		)
+	}
+	return result, nil
 }
 
-func buildTrackerURL(torrent *types.TorrentFile, tracker string) (string, error) {
+func buildTrackerURL(torrent *types.TorrentFile, tracker string, p announceParams) (string, error) {
 	base, err := url.Parse(tracker)
 	if err != nil {
 		return "", err
@@ -145,46 +139,23 @@ func buildTrackerURL(torrent *types.TorrentFile, tracker string) (string, error)
 	params := url.Values{}
 	params.Set("info_hash", string(torrent.InfoHash))
 	params.Set("peer_id", string(PeerID))
-	params.Set("port", "6881")
-	params.Set("uploaded", "0")
-	params.Set("downloaded", "0")
-	params.Set("left", strconv.Itoa(int(torrent.Length)))
+	params.Set("port", strconv.Itoa(ListenPort))
+	params.Set("uploaded", strconv.FormatInt(p.uploaded, 10))
+	params.Set("downloaded", strconv.FormatInt(p.downloaded, 10))
+	params.Set("left", strconv.FormatInt(p.left, 10))
 	params.Set("compact", "1")
-
-	base.RawQuery = params.Encode()
-	return base.String(), nil
-}
-
-func extractPeers(body []byte, peers types.HashSet[string]) {
-	// Look for: "5:peers"
-	key := []byte("5:peers")
-	idx := bytes.Index(body, key)
-	if idx == -1 {
-		return
+	if p.event != eventNone {
+		params.Set("event", p.event.String())
 	}
-
-	// Move to start of peer string length
-	start := idx + len(key)
-
-	// Read length prefix (e.g., 12:)
-	colon := bytes.IndexByte(body[start:], ':')
-	if colon == -1 {
-		return
+	if p.trackerID != "" {
+		params.Set("trackerid", p.trackerID)
 	}
-
-	lengthStr := string(body[start : start+colon])
-	var peerLen int
-	fmt.Sscanf(lengthStr, "%d", &peerLen)
-
-	peerStart := start + colon + 1
-	peerData := body[peerStart : peerStart+peerLen]
-
-	// Compact peer list: 6 bytes per peer
-	for i := 0; i+6 <= len(peerData); i += 6 {
-		ip := net.IP(peerData[i : i+4])
-		port := binary.BigEndian.Uint16(peerData[i+4 : i+6])
-
-		addr := fmt.Sprintf("%s:%d", ip.String(), port)
-		peers[addr] = struct{}{}
+	if ip := localIPv6(); ip != nil {
+		// BEP 7: tell the tracker where to reach us over IPv6 even when
+		// announcing over IPv4.
+		params.Set("ipv6", ip.String())
 	}
+
+	base.RawQuery = params.Encode()
+	return base.String(), nil
 }
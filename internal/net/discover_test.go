@@ -1,11 +1,15 @@
 package net
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 	"crypto/rand"
 
 	"kbit/pkg/types"
@@ -24,22 +28,32 @@ func buildPeerResponse(peerBytes []byte) []byte {
 	return append(body, 'e')
 }
 
-func TestExtractPeers_NoPeersKey(t *testing.T) {
-	body := []byte("d8:intervali1800ee")
+// decodePeers decodes body and returns its peers as a set, failing the
+// test on a decode error.
+func decodePeers(t *testing.T, body []byte) types.HashSet[string] {
+	t.Helper()
+	resp, err := decodeAnnounceResponse(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 	peers := make(types.HashSet[string])
-	extractPeers(body, peers)
+	for _, p := range resp.Peers {
+		peers[p] = struct{}{}
+	}
+	return peers
+}
+
+func TestDecodeAnnounceResponse_NoPeersKey(t *testing.T) {
+	peers := decodePeers(t, []byte("d8:intervali1800ee"))
 	if len(peers) != 0 {
 		t.Errorf("expected 0 peers, got %d", len(peers))
 	}
 }
 
-func TestExtractPeers_SinglePeer(t *testing.T) {
+func TestDecodeAnnounceResponse_SinglePeer(t *testing.T) {
 	// 127.0.0.1:6881 — [0x7F,0x00,0x00,0x01] + [0x1A,0xE1]
 	peerBytes := []byte{127, 0, 0, 1, 0x1A, 0xE1}
-	body := buildPeerResponse(peerBytes)
-
-	peers := make(types.HashSet[string])
-	extractPeers(body, peers)
+	peers := decodePeers(t, buildPeerResponse(peerBytes))
 
 	if len(peers) != 1 {
 		t.Fatalf("expected 1 peer, got %d: %v", len(peers), peers)
@@ -49,16 +63,13 @@ func TestExtractPeers_SinglePeer(t *testing.T) {
 	}
 }
 
-func TestExtractPeers_MultiplePeers(t *testing.T) {
+func TestDecodeAnnounceResponse_MultiplePeers(t *testing.T) {
 	// 1.2.3.4:1000 and 5.6.7.8:2000
 	peerBytes := []byte{
 		1, 2, 3, 4, 0x03, 0xE8, // 1.2.3.4:1000
 		5, 6, 7, 8, 0x07, 0xD0, // 5.6.7.8:2000
 	}
-	body := buildPeerResponse(peerBytes)
-
-	peers := make(types.HashSet[string])
-	extractPeers(body, peers)
+	peers := decodePeers(t, buildPeerResponse(peerBytes))
 
 	if len(peers) != 2 {
 		t.Fatalf("expected 2 peers, got %d: %v", len(peers), peers)
@@ -71,35 +82,73 @@ func TestExtractPeers_MultiplePeers(t *testing.T) {
 	}
 }
 
-func TestExtractPeers_EmptyPeerData(t *testing.T) {
-	body := []byte("d5:peers0:e")
-	peers := make(types.HashSet[string])
-	extractPeers(body, peers)
+func TestDecodeAnnounceResponse_EmptyPeerData(t *testing.T) {
+	peers := decodePeers(t, []byte("d5:peers0:e"))
 	if len(peers) != 0 {
 		t.Errorf("expected 0 peers, got %d", len(peers))
 	}
 }
 
-func TestExtractPeers_IncompleteEntry(t *testing.T) {
-	// 5 bytes (not a multiple of 6) — last entry should be ignored
-	peerBytes := []byte{10, 0, 0, 1, 0x1F, 0x90, 192, 168, 1} // 9 bytes: 1 full + 3 incomplete
-	body := buildPeerResponse(peerBytes)
-
-	peers := make(types.HashSet[string])
-	extractPeers(body, peers)
+func TestDecodeAnnounceResponse_IncompleteEntry(t *testing.T) {
+	// 9 bytes: 1 full entry + 3 bytes of an incomplete one, which is ignored
+	peerBytes := []byte{10, 0, 0, 1, 0x1F, 0x90, 192, 168, 1}
+	peers := decodePeers(t, buildPeerResponse(peerBytes))
 
 	if len(peers) != 1 {
 		t.Errorf("expected 1 peer (incomplete entry ignored), got %d: %v", len(peers), peers)
 	}
 }
 
+func TestDecodeAnnounceResponse_TruncatedBody(t *testing.T) {
+	// The length prefix promises more peer data than the body holds.
+	if _, err := decodeAnnounceResponse([]byte("d5:peers12:\x7f\x00\x00\x01")); err == nil {
+		t.Error("expected error for truncated body")
+	}
+}
+
+func TestDecodeAnnounceResponse_AllFields(t *testing.T) {
+	body := "d8:completei5e10:incompletei7e8:intervali1800e12:min intervali60e" +
+		"5:peersld2:ip8:10.0.0.17:peer id20:-XX0001-abcdefghijkl4:porti6881eed2:ip9:peer.test4:porti51413eee" +
+		"10:tracker id3:abc15:warning message4:slowe"
+
+	resp, err := decodeAnnounceResponse([]byte(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Complete != 5 || resp.Incomplete != 7 || resp.Interval != 1800 || resp.MinInterval != 60 {
+		t.Errorf("unexpected counters %+v", resp)
+	}
+	if resp.TrackerID != "abc" || resp.WarningMessage != "slow" {
+		t.Errorf("unexpected tracker id or warning %+v", resp)
+	}
+	if len(resp.Peers) != 2 || resp.Peers[0] != "10.0.0.1:6881" || resp.Peers[1] != "peer.test:51413" {
+		t.Errorf("unexpected dictionary peers %v", resp.Peers)
+	}
+}
+
+func TestDecodeAnnounceResponse_FailureReason(t *testing.T) {
+	_, err := decodeAnnounceResponse([]byte("d14:failure reason9:forbiddene"))
+	var failure *TrackerFailure
+	if !errors.As(err, &failure) || failure.Reason != "forbidden" {
+		t.Errorf("expected TrackerFailure, got: %v", err)
+	}
+}
+
+func TestDecodeAnnounceResponse_Malformed(t *testing.T) {
+	for _, body := range []string{"", "le", "d5:peersi3ee", "d5:peersl3:abcee", "d8:intervali1e8:completei1ee"} {
+		if _, err := decodeAnnounceResponse([]byte(body)); err == nil {
+			t.Errorf("expected error for %q", body)
+		}
+	}
+}
+
 func TestBuildTrackerURL_ContainsRequiredParams(t *testing.T) {
 	torrent := &types.TorrentFile{
 		InfoHash: []byte("01234567890123456789"), // 20 bytes
 		Length:   5000,
 	}
 
-	result, err := buildTrackerURL(torrent, "http://tracker.example.com/announce")
+	result, err := buildTrackerURL(torrent, "http://tracker.example.com/announce", announceParams{left: torrent.Length})
 	if err != nil {
 		t.Fatalf("expected no error, got: %v", err)
 	}
@@ -122,7 +171,7 @@ func TestBuildTrackerURL_InvalidURL(t *testing.T) {
 	}
 
 	// A bare "%" is invalid percent-encoding and causes url.Parse to fail.
-	_, err := buildTrackerURL(torrent, "%")
+	_, err := buildTrackerURL(torrent, "%", announceParams{left: torrent.Length})
 	if err == nil {
 		t.Error("expected error for invalid tracker URL")
 	}
@@ -162,9 +211,9 @@ func TestDiscoverPeers_SingleTracker_ReturnsCompactPeers(t *testing.T) {
 		InfoHash: make([]byte, 20),
 		Length:   1000,
 	}
-	urls := types.HashSet[string]{server.URL: struct{}{}}
+	torrent.Tiers = [][]string{{server.URL}}
 
-	if err := DiscoverPeers(torrent, &urls); err != nil {
+	if err := DiscoverPeers(torrent); err != nil {
 		t.Fatalf("DiscoverPeers returned error: %v", err)
 	}
 
@@ -173,17 +222,23 @@ func TestDiscoverPeers_SingleTracker_ReturnsCompactPeers(t *testing.T) {
 	}
 }
 
-func TestDiscoverPeers_MultipleTrackers_MergesPeers(t *testing.T) {
-	// Two trackers each returning a different peer; len(urls) > 1 triggers fetchConcurent.
+func TestDiscoverPeers_FirstAnsweringTrackerWins(t *testing.T) {
+	// The first tier holds a dead tracker and a live one; the second tier
+	// must not be asked once the live one answers.
 	peer1 := []byte{10, 0, 0, 1, 0x1F, 0x90} // 10.0.0.1:8080
 	peer2 := []byte{10, 0, 0, 2, 0x1F, 0x91} // 10.0.0.2:8081
 
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	dead.Close()
+
 	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write(buildPeerResponse(peer1))
 	}))
 	defer server1.Close()
 
+	var asked atomic.Bool
 	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked.Store(true)
 		w.Write(buildPeerResponse(peer2))
 	}))
 	defer server2.Close()
@@ -191,28 +246,32 @@ func TestDiscoverPeers_MultipleTrackers_MergesPeers(t *testing.T) {
 	torrent := &types.TorrentFile{
 		InfoHash: make([]byte, 20),
 		Length:   1000,
-	}
-	urls := types.HashSet[string]{
-		server1.URL: struct{}{},
-		server2.URL: struct{}{},
+		Tiers:    [][]string{{dead.URL, server1.URL}, {server2.URL}},
 	}
 
-	if err := DiscoverPeers(torrent, &urls); err != nil {
+	if err := DiscoverPeers(torrent); err != nil {
 		t.Fatalf("DiscoverPeers returned error: %v", err)
 	}
 
-	if _, ok := torrent.Peers["10.0.0.1:8080"]; !ok {
-		t.Errorf("expected peer 10.0.0.1:8080, got: %v", torrent.Peers)
+	if _, ok := torrent.Peers["10.0.0.1:8080"]; !ok || len(torrent.Peers) != 1 {
+		t.Errorf("expected only peer 10.0.0.1:8080, got: %v", torrent.Peers)
 	}
-	if _, ok := torrent.Peers["10.0.0.2:8081"]; !ok {
-		t.Errorf("expected peer 10.0.0.2:8081, got: %v", torrent.Peers)
+	if asked.Load() {
+		t.Error("expected the second tier not to be asked")
+	}
+	if torrent.Tiers[0][0] != server1.URL {
+		t.Errorf("expected the answering tracker to be promoted, got tier %v", torrent.Tiers[0])
 	}
 }
 
-func TestDiscoverPeers_PrivateTorrent_UsesBruteForce(t *testing.T) {
-	// Private flag forces sequential bruteForce even with multiple trackers.
+func TestDiscoverPeers_FallsBackToNextTier(t *testing.T) {
 	peerBytes := []byte{192, 168, 1, 1, 0x1F, 0x91} // 192.168.1.1:8081
 
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason7:refusede"))
+	}))
+	defer failing.Close()
+
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write(buildPeerResponse(peerBytes))
 	}))
@@ -222,10 +281,10 @@ func TestDiscoverPeers_PrivateTorrent_UsesBruteForce(t *testing.T) {
 		InfoHash: make([]byte, 20),
 		Length:   1000,
 		Private:  true,
+		Tiers:    [][]string{{failing.URL}, {server.URL}},
 	}
-	urls := types.HashSet[string]{server.URL: struct{}{}}
 
-	if err := DiscoverPeers(torrent, &urls); err != nil {
+	if err := DiscoverPeers(torrent); err != nil {
 		t.Fatalf("DiscoverPeers returned error: %v", err)
 	}
 
@@ -234,6 +293,45 @@ func TestDiscoverPeers_PrivateTorrent_UsesBruteForce(t *testing.T) {
 	}
 }
 
+func TestAnnounceTiers_Order(t *testing.T) {
+	tiers := [][]string{{"a", "b", "c"}, {"d", "e"}}
+	alive := map[string]bool{"c": true, "e": true}
+
+	var asked []string
+	announce := func(tracker string) (*AnnounceResponse, error) {
+		asked = append(asked, tracker)
+		if !alive[tracker] {
+			return nil, fmt.Errorf("down")
+		}
+		return &AnnounceResponse{}, nil
+	}
+
+	_, tracker, err := announceTiers(tiers, announce)
+	if err != nil || tracker != "c" {
+		t.Fatalf("expected c to answer, got %q, %v", tracker, err)
+	}
+	if strings.Join(asked, ",") != "a,b,c" {
+		t.Errorf("unexpected order %v", asked)
+	}
+	if strings.Join(tiers[0], ",") != "c,a,b" {
+		t.Errorf("expected c promoted to the front, got %v", tiers[0])
+	}
+
+	alive["c"] = false
+	asked = nil
+	_, tracker, _ = announceTiers(tiers, announce)
+	if tracker != "e" || strings.Join(asked, ",") != "c,a,b,d,e" {
+		t.Errorf("expected fallback to the second tier, got %q after %v", tracker, asked)
+	}
+	if strings.Join(tiers[1], ",") != "e,d" {
+		t.Errorf("expected e promoted in the second tier, got %v", tiers[1])
+	}
+
+	if _, _, err := announceTiers(nil, announce); err == nil {
+		t.Error("expected error without trackers")
+	}
+}
+
 func TestDiscoverPeers_TrackerUnreachable_ReturnsNoError(t *testing.T) {
 	// A server that is immediately closed produces connection-refused errors,
 	// which DiscoverPeers must handle gracefully (no returned error).
@@ -245,9 +343,9 @@ func TestDiscoverPeers_TrackerUnreachable_ReturnsNoError(t *testing.T) {
 		InfoHash: make([]byte, 20),
 		Length:   1000,
 	}
-	urls := types.HashSet[string]{url: struct{}{}}
+	torrent.Tiers = [][]string{{url}}
 
-	err := DiscoverPeers(torrent, &urls)
+	err := DiscoverPeers(torrent)
 	if err != nil {
 		t.Errorf("expected no error for unreachable tracker, got: %v", err)
 	}
@@ -266,12 +364,72 @@ func TestDiscoverPeers_TrackerReturnsGarbage_ReturnsNoPeers(t *testing.T) {
 		InfoHash: make([]byte, 20),
 		Length:   1000,
 	}
-	urls := types.HashSet[string]{server.URL: struct{}{}}
+	torrent.Tiers = [][]string{{server.URL}}
 
-	if err := DiscoverPeers(torrent, &urls); err != nil {
+	if err := DiscoverPeers(torrent); err != nil {
 		t.Fatalf("expected no error, got: %v", err)
 	}
 	if len(torrent.Peers) != 0 {
 		t.Errorf("expected 0 peers for garbage response, got %d: %v", len(torrent.Peers), torrent.Peers)
 	}
 }
+
+type staticSource struct {
+	name  string
+	peers []string
+	err   error
+}
+
+func (s staticSource) Name() string { return s.name }
+
+func (s staticSource) FindPeers(ctx context.Context, t *types.TorrentFile) ([]string, error) {
+	return s.peers, s.err
+}
+
+func TestDiscoverPeers_MergesSourcesAndKeepsExistingPeers(t *testing.T) {
+	torrent := &types.TorrentFile{
+		InfoHash: make([]byte, 20),
+		Peers:    types.HashSet[string]{"10.0.0.1:6881": {}},
+	}
+
+	err := DiscoverPeers(torrent,
+		staticSource{name: "a", peers: []string{"10.0.0.2:6881"}},
+		staticSource{name: "b", peers: []string{"10.0.0.2:6881", "[2001:db8::1]:6881"}},
+		staticSource{name: "broken", err: fmt.Errorf("unreachable")},
+	)
+	if err != nil {
+		t.Fatalf("DiscoverPeers: %v", err)
+	}
+
+	for _, want := range []string{"10.0.0.1:6881", "10.0.0.2:6881", "[2001:db8::1]:6881"} {
+		if _, ok := torrent.Peers[want]; !ok {
+			t.Errorf("missing peer %s in %v", want, torrent.Peers)
+		}
+	}
+	if len(torrent.Peers) != 3 {
+		t.Errorf("got %d peers, want 3", len(torrent.Peers))
+	}
+}
+
+func TestPeerSources_KeepPeersReturnedWithAnError(t *testing.T) {
+	partial := staticSource{name: "partial", peers: []string{"10.0.0.3:6881"}, err: fmt.Errorf("announce not accepted")}
+
+	torrent := &types.TorrentFile{InfoHash: make([]byte, 20)}
+	if err := DiscoverPeers(torrent, partial); err != nil {
+		t.Fatalf("DiscoverPeers: %v", err)
+	}
+	if _, ok := torrent.Peers["10.0.0.3:6881"]; !ok {
+		t.Errorf("DiscoverPeers dropped the peers: %v", torrent.Peers)
+	}
+
+	pool := NewPeerPool()
+	feedPool(context.Background(), torrent, pool, []PeerSource{partial})
+	select {
+	case <-pool.Changed():
+	case <-time.After(time.Second):
+		t.Fatal("feedPool dropped the peers")
+	}
+	if got := pool.Peers(); len(got) != 1 || got[0] != "10.0.0.3:6881" {
+		t.Errorf("pool = %v, want [10.0.0.3:6881]", got)
+	}
+}
@@ -1,8 +1,10 @@
 package net
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -25,6 +27,7 @@ type pieceWork struct {
 type pieceResult struct {
 	index int
 	data  []byte
+	peer  string
 }
 
 type workQueue struct {
@@ -32,15 +35,49 @@ type workQueue struct {
 	items []pieceWork
 }
 
-func (q *workQueue) pop() (pieceWork, bool) {
+// popFor takes the first piece pc can give us: one it has and, while a
+// Fast Extension peer chokes us, one it allows us to fetch anyway. Pieces
+// the peer suggested go first.
+func (q *workQueue) popFor(pc *PeerConn) (pieceWork, bool) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	if len(q.items) == 0 {
-		return pieceWork{}, false
+
+	usable := func(i int) bool {
+		return pc.HasPiece(i) && (!pc.Fast() || !pc.Choked || pc.AllowedFast[i])
+	}
+	take := func(i int) pieceWork {
+		item := q.items[i]
+		q.items = append(q.items[:i], q.items[i+1:]...)
+		return item
+	}
+
+	// Suggestions for pieces that are no longer queued are forgotten.
+	suggested := pc.Suggested[:0]
+	found := -1
+	for _, index := range pc.Suggested {
+		for i, item := range q.items {
+			if item.index != index {
+				continue
+			}
+			if found < 0 && usable(index) {
+				found = i
+			} else {
+				suggested = append(suggested, index)
+			}
+			break
+		}
 	}
-	item := q.items[0]
-	q.items = q.items[1:]
-	return item, true
+	pc.Suggested = suggested
+	if found >= 0 {
+		return take(found), true
+	}
+
+	for i, item := range q.items {
+		if usable(item.index) {
+			return take(i), true
+		}
+	}
+	return pieceWork{}, false
 }
 
 func (q *workQueue) push(pw pieceWork) {
@@ -55,26 +92,81 @@ func (q *workQueue) len() int {
 	return len(q.items)
 }
 
-func Download(t *types.TorrentFile) error {
+// peerWaitTimeout is how long a download waits for its first peers, and
+// how long it keeps waiting for new ones after every peer has gone.
+var peerWaitTimeout = 60 * time.Second
+
+// Limits on the connections of one download, however many peers the
+// trackers and other sources report.
+var (
+	maxPeers = 50 // peers connected at once
+	maxDials = 10 // connection attempts in flight for peers found later
+)
+
+// Download fetches t into the working directory. Its trackers are kept
+// announced for the whole download, and sources are asked for peers at the
+// start and again whenever the download runs out of them; peers found later
+// join the peers the download started with. When ln is not nil, peers that
+// connect to it are served the pieces verified so far, slots of them at a
+// time besides an optimistic unchoke.
+func Download(t *types.TorrentFile, ln *Listener, slots int, sources ...PeerSource) error {
 	if len(t.Pieces) == 0 {
 		return fmt.Errorf("torrent has no piece hashes; cannot download")
 	}
 	if t.PieceLength == 0 {
 		return fmt.Errorf("torrent has no piece length; cannot download")
 	}
-	if len(t.Peers) == 0 {
+
+	pool := NewPeerPool()
+	for addr := range t.Peers {
+		pool.Add(addr)
+	}
+	stats := NewStats(t.Length)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	announcer := NewAnnouncer(t, pool, stats)
+	if len(t.Tiers) > 0 {
+		go announcer.Run(ctx)
+		defer func() {
+			cancel()
+			<-announcer.Done()
+		}()
+	} else {
+		defer cancel()
+	}
+
+	feedPool(ctx, t, pool, sources)
+	watchPool(ctx, t, pool, sources)
+
+	ext, pex, err := sessionExtensions(t, pool)
+	if err != nil {
+		return err
+	}
+
+	if pool.Len() == 0 && len(t.Tiers) == 0 && len(sources) == 0 {
 		return fmt.Errorf("no peers discovered; cannot download")
 	}
+	if pool.Len() == 0 {
+		select {
+		case <-pool.Changed():
+		case <-time.After(peerWaitTimeout):
+			return fmt.Errorf("no peers discovered; cannot download")
+		}
+	}
 
 	fmt.Fprintf(os.Stderr, "Validating peers...\n")
-	validAddrs := validatePeers(t)
+	addrs := pool.Peers()
+	validAddrs := validatePeers(addrs, t)
 	if len(validAddrs) == 0 {
 		return fmt.Errorf("no reachable peers found")
 	}
 	fmt.Fprintf(os.Stderr, "%d reachable peer(s) found\n", len(validAddrs))
+	if len(validAddrs) > maxPeers {
+		validAddrs = validAddrs[:maxPeers]
+	}
 
 	fmt.Fprintf(os.Stderr, "Connecting and collecting piece availability...\n")
-	pcs := collectBitfields(validAddrs, t)
+	pcs := collectBitfields(validAddrs, t, ext, nil)
 	if len(pcs) == 0 {
 		return fmt.Errorf("no peers provided piece availability")
 	}
@@ -82,36 +174,78 @@ func Download(t *types.TorrentFile) error {
 
 	queue := buildRarestFirstQueue(pcs, t)
 
-	f, err := os.Create(t.Name)
+	f, err := openStorage(".", t)
 	if err != nil {
-		return fmt.Errorf("creating output file %q: %w", t.Name, err)
+		return err
 	}
 	defer f.Close()
 
-	if err := f.Truncate(t.Length); err != nil {
-		return fmt.Errorf("pre-allocating output file: %w", err)
+	uploader := NewUploader(t, f, stats, slots)
+	if ln != nil {
+		ln.Serve(uploader)
+		defer ln.Remove(t.InfoHash)
+		go uploader.Run(ctx)
 	}
 
 	numPieces := len(t.Pieces)
 	resultCh := make(chan pieceResult, numPieces)
 
-	var wg sync.WaitGroup
 	var alivePeers atomic.Int64
+	var connecting atomic.Int64
 	var remaining atomic.Int64
 	alivePeers.Store(int64(len(pcs)))
 	remaining.Store(int64(numPieces))
 
 	for _, pc := range pcs {
-		wg.Add(1)
-		go peerWorker(pc, queue, resultCh, &wg, &alivePeers, &remaining)
+		go peerWorker(pc, queue, resultCh, pex, &alivePeers, &remaining)
 	}
 
-	doneCh := make(chan struct{})
+	// Peers that arrive in the pool later are connected as they come, at
+	// most maxDials at a time and while fewer than maxPeers are connected.
+	// The pool only grows, so the peers not tried yet are those past next.
 	go func() {
-		wg.Wait()
-		close(doneCh)
+		next := len(addrs)
+		dials := make(chan struct{}, maxDials)
+		retry := time.NewTicker(time.Second) // picks up again when peers leave
+		defer retry.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-pool.Changed():
+			case <-retry.C:
+			}
+			peers := pool.Peers()
+			for next < len(peers) && alivePeers.Load()+connecting.Load() < int64(maxPeers) {
+				select {
+				case <-ctx.Done():
+					return
+				case dials <- struct{}{}:
+				}
+				addr := peers[next]
+				next++
+				connecting.Add(1)
+				go func(addr string) {
+					defer func() { <-dials }()
+					defer connecting.Add(-1)
+					pcs := collectBitfields([]string{addr}, t, ext, uploader.Bitfield())
+					if len(pcs) == 0 || ctx.Err() != nil {
+						for _, pc := range pcs {
+							pc.Close()
+						}
+						return
+					}
+					alivePeers.Add(1)
+					go peerWorker(pcs[0], queue, resultCh, pex, &alivePeers, &remaining)
+				}(addr)
+			}
+		}
 	}()
 
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var idleSince time.Time
+
 	completed := 0
 	var downloaded int64
 
@@ -122,27 +256,32 @@ func Download(t *types.TorrentFile) error {
 			if _, err := f.WriteAt(res.data, offset); err != nil {
 				return fmt.Errorf("writing piece %d: %w", res.index, err)
 			}
+			uploader.SetHave(res.index)
+			uploader.Credit(res.peer, len(res.data))
 			completed++
 			downloaded += int64(len(res.data))
+			stats.Downloaded.Add(int64(len(res.data)))
+			stats.Left.Add(-int64(len(res.data)))
 			printProgress(downloaded, t.Length, int(alivePeers.Load()))
-		case <-doneCh:
-			for len(resultCh) > 0 {
-				res := <-resultCh
-				offset := int64(res.index) * t.PieceLength
-				if _, err := f.WriteAt(res.data, offset); err != nil {
-					return fmt.Errorf("writing piece %d: %w", res.index, err)
-				}
-				completed++
-				downloaded += int64(len(res.data))
-				printProgress(downloaded, t.Length, 0)
+		case <-ticker.C:
+			if alivePeers.Load() > 0 || connecting.Load() > 0 || len(resultCh) > 0 {
+				idleSince = time.Time{}
+				continue
+			}
+			if idleSince.IsZero() {
+				idleSince = time.Now()
+				announcer.NeedPeers()
+				feedPool(ctx, t, pool, sources)
+				continue
 			}
-			if completed < numPieces {
+			if time.Since(idleSince) >= peerWaitTimeout {
 				fmt.Fprintln(os.Stderr, "")
 				return fmt.Errorf("download incomplete: %d/%d pieces received (all peers disconnected)", completed, numPieces)
 			}
 		}
 	}
 
+	announcer.Completed()
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintf(os.Stdout, "Download complete: %s\n", t.Name)
 	return nil
@@ -152,26 +291,60 @@ func peerWorker(
 	pc *PeerConn,
 	queue *workQueue,
 	resultCh chan<- pieceResult,
-	wg *sync.WaitGroup,
+	pex *PEXExtension,
 	alivePeers *atomic.Int64,
 	remaining *atomic.Int64,
 ) {
-	defer wg.Done()
 	defer alivePeers.Add(-1)
 	defer pc.Close()
 
+	if pex != nil {
+		pex.Connected(pc)
+		defer pex.Disconnected(pc)
+	}
+
 	for {
 		if remaining.Load() == 0 {
 			return
 		}
 
-		pw, ok := queue.pop()
+		pw, ok := queue.popFor(pc)
 		if !ok {
-			time.Sleep(10 * time.Millisecond)
+			if queue.len() == 0 {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			// Nothing left that this peer can give us now; wait for it to
+			// unchoke us or to announce more pieces.
+			pc.SetDeadline(time.Now().Add(30 * time.Second))
+			msg, err := pc.ReadMsg()
+			if err != nil {
+				logger.Log.Warn("peer has no pieces we need",
+					slog.String("peer", pc.Addr),
+					slog.String("error", err.Error()),
+				)
+				return
+			}
+			// ReadMsg keeps track of chokes, haves and the fast messages;
+			// a bitfield sent late is taken here so that popFor sees the
+			// pieces it announces.
+			if msg != nil && msg.ID == MsgBitfield {
+				pc.Bitfield = msg.Payload
+			}
 			continue
 		}
 
 		data, err := downloadPiece(pc, pw)
+		if errors.Is(err, errRejected) {
+			// The peer keeps the connection; another peer, or this one
+			// later, can still provide the piece.
+			logger.Log.Debug("piece request rejected",
+				slog.String("peer", pc.Addr),
+				slog.Int("piece", pw.index),
+			)
+			queue.push(pw)
+			continue
+		}
 		if err != nil {
 			logger.Log.Warn("piece download failed",
 				slog.String("peer", pc.Addr),
@@ -192,21 +365,46 @@ func peerWorker(
 		}
 
 		remaining.Add(-1)
-		resultCh <- pieceResult{index: pw.index, data: data}
+		resultCh <- pieceResult{index: pw.index, data: data, peer: pc.Addr}
+
+		if pex != nil {
+			if err := pex.SendUpdate(pc); err != nil {
+				logger.Log.Warn("failed to send pex message",
+					slog.String("peer", pc.Addr),
+					slog.String("error", err.Error()),
+				)
+				return
+			}
+		}
 	}
 }
 
-func validatePeers(t *types.TorrentFile) []string {
+// sessionExtensions returns the extensions download connections use: ut_pex,
+// unless t is private (BEP 27), in which case peers may only come from its
+// trackers and no extension is returned.
+func sessionExtensions(t *types.TorrentFile, pool *PeerPool) (*Extensions, *PEXExtension, error) {
+	if t.Private {
+		return nil, nil, nil
+	}
+	pex := NewPEXExtension(pool)
+	ext, err := NewExtensions(pex)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ext, pex, nil
+}
+
+func validatePeers(addrs []string, t *types.TorrentFile) []string {
 	type result struct {
 		addr string
 		ok   bool
 	}
 
 	sem := make(chan struct{}, 20)
-	resCh := make(chan result, len(t.Peers))
+	resCh := make(chan result, len(addrs))
 	var wg sync.WaitGroup
 
-	for addr := range t.Peers {
+	for _, addr := range addrs {
 		wg.Add(1)
 		sem <- struct{}{}
 		go func(addr string) {
@@ -240,7 +438,10 @@ func validatePeers(t *types.TorrentFile) []string {
 	return valid
 }
 
-func collectBitfields(addrs []string, t *types.TorrentFile) []*PeerConn {
+// collectBitfields connects to addrs, tells them the pieces in have and
+// waits for their bitfields. When ext is not nil it is enabled on
+// connections to peers that support the extension protocol.
+func collectBitfields(addrs []string, t *types.TorrentFile, ext *Extensions, have []byte) []*PeerConn {
 	var mu sync.Mutex
 	var pcs []*PeerConn
 	var wg sync.WaitGroup
@@ -250,7 +451,7 @@ func collectBitfields(addrs []string, t *types.TorrentFile) []*PeerConn {
 		go func(addr string) {
 			defer wg.Done()
 
-			conn, err := Handshake(addr, t.InfoHash)
+			pc, err := DialPeer(addr, t.InfoHash)
 			if err != nil {
 				logger.Log.Warn("handshake failed for download connection",
 					slog.String("addr", addr),
@@ -258,10 +459,30 @@ func collectBitfields(addrs []string, t *types.TorrentFile) []*PeerConn {
 				)
 				return
 			}
-
-			pc := NewPeerConn(conn, addr)
+			pc.NumPieces = len(t.Pieces)
 			pc.SetDeadline(time.Now().Add(30 * time.Second))
 
+			if ext != nil && pc.Reserved.SupportsExtensions() {
+				pc.UseExtensions(ext)
+				if err := pc.SendExtHandshake(); err != nil {
+					logger.Log.Warn("failed to send extended handshake",
+						slog.String("addr", addr),
+						slog.String("error", err.Error()),
+					)
+					pc.Close()
+					return
+				}
+			}
+
+			if err := pc.sendHaves(have, len(t.Pieces)); err != nil {
+				logger.Log.Warn("failed to send our pieces",
+					slog.String("addr", addr),
+					slog.String("error", err.Error()),
+				)
+				pc.Close()
+				return
+			}
+
 			if err := pc.SendMsg(MsgInterested, nil); err != nil {
 				logger.Log.Warn("failed to send Interested",
 					slog.String("addr", addr),
@@ -271,6 +492,7 @@ func collectBitfields(addrs []string, t *types.TorrentFile) []*PeerConn {
 				return
 			}
 
+			announced := false
 			unchokedWithoutBitfield := false
 			deadline := time.Now().Add(15 * time.Second)
 
@@ -293,18 +515,28 @@ func collectBitfields(addrs []string, t *types.TorrentFile) []*PeerConn {
 				switch msg.ID {
 				case MsgBitfield:
 					pc.Bitfield = msg.Payload
+					announced = true
+					break loop
+				case MsgHaveAll, MsgHaveNone:
+					announced = true
 					break loop
 				case MsgUnchoke:
 					unchokedWithoutBitfield = true
 					// Some seeders skip the bitfield — keep waiting a bit.
 				case MsgChoke:
+					if pc.Fast() {
+						// Allowed fast pieces can still be fetched.
+						continue
+					}
 					logger.Log.Warn("peer choked us during setup", slog.String("addr", addr))
 					pc.Close()
 					return
 				}
 			}
 
-			if len(pc.Bitfield) == 0 && unchokedWithoutBitfield {
+			// Fast Extension peers always announce their pieces, so only
+			// other peers are taken for seeders when they skip it.
+			if !announced && unchokedWithoutBitfield && !pc.Fast() {
 				numBytes := (len(t.Pieces) + 7) / 8
 				pc.Bitfield = make([]byte, numBytes)
 				for i := range pc.Bitfield {
@@ -312,7 +544,7 @@ func collectBitfields(addrs []string, t *types.TorrentFile) []*PeerConn {
 				}
 			}
 
-			if len(pc.Bitfield) == 0 {
+			if len(pc.Bitfield) == 0 && !announced {
 				logger.Log.Warn("peer provided no bitfield", slog.String("addr", addr))
 				pc.Close()
 				return
@@ -380,24 +612,37 @@ func calcPieceLen(t *types.TorrentFile, i int) int {
 	return int(t.PieceLength)
 }
 
+// downloadPiece fetches pw from pc with pipelined requests. Only blocks
+// answering a request still outstanding are taken, so late blocks of an
+// earlier attempt are not counted twice. When a Fast Extension peer
+// rejects a request, the requests still outstanding are drained before
+// errRejected is returned, leaving the connection ready for the next piece.
 func downloadPiece(pc *PeerConn, pw pieceWork) ([]byte, error) {
 	pc.SetDeadline(time.Now().Add(30 * time.Second))
 
 	buf := make([]byte, pw.length)
 	downloaded := 0
 	requested := 0
-	backlog := 0
+	pending := make(map[int]int) // begin -> length of outstanding requests
+	rejected := false
 	maxBacklog := 5 // pipelined requests in flight
 
-	for downloaded < pw.length {
-		for backlog < maxBacklog && requested < pw.length {
+	for {
+		if rejected && len(pending) == 0 {
+			return nil, errRejected
+		}
+		if !rejected && downloaded == pw.length {
+			return buf, nil
+		}
+
+		for !rejected && len(pending) < maxBacklog && requested < pw.length {
 			blockLen := min(BlockSize, pw.length-requested)
 			payload := buildRequestPayload(pw.index, requested, blockLen)
 			if err := pc.SendMsg(MsgRequest, payload); err != nil {
 				return nil, fmt.Errorf("sending request: %w", err)
 			}
+			pending[requested] = blockLen
 			requested += blockLen
-			backlog++
 		}
 
 		// Refresh deadline for each read.
@@ -419,20 +664,39 @@ func downloadPiece(pc *PeerConn, pw pieceWork) ([]byte, error) {
 			}
 			gotIndex := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
 			gotBegin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
-			if gotIndex != pw.index {
+			if gotIndex != pw.index && !pc.Fast() {
 				return nil, fmt.Errorf("piece index mismatch: got %d, want %d", gotIndex, pw.index)
 			}
 			blockData := msg.Payload[8:]
-			if gotBegin+len(blockData) > pw.length {
-				return nil, fmt.Errorf("block overflows piece boundary")
+			if length, ok := pending[gotBegin]; !ok || gotIndex != pw.index || length != len(blockData) {
+				// Not something we are waiting for, such as a block of
+				// a piece whose requests were rejected.
+				continue
+			}
+			delete(pending, gotBegin)
+			if !rejected {
+				copy(buf[gotBegin:], blockData)
+				downloaded += len(blockData)
 			}
-			copy(buf[gotBegin:], blockData)
-			downloaded += len(blockData)
-			backlog--
 
 		case MsgChoke:
+			if pc.Fast() {
+				// Requests survive a choke; those the peer drops are
+				// rejected.
+				continue
+			}
 			return nil, fmt.Errorf("peer choked us mid-download")
 
+		case MsgReject:
+			req, err := parseBlock(msg.Payload)
+			if err != nil {
+				return nil, err
+			}
+			if length, ok := pending[req.begin]; ok && req.index == pw.index && length == req.length {
+				delete(pending, req.begin)
+				rejected = true
+			}
+
 		case MsgHave:
 			// Ignore during download.
 
@@ -440,8 +704,6 @@ func downloadPiece(pc *PeerConn, pw pieceWork) ([]byte, error) {
 			// Ignore unknown messages.
 		}
 	}
-
-	return buf, nil
 }
 
 func checkPieceHash(data []byte, pw pieceWork) error {
@@ -0,0 +1,225 @@
+package net
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+
+	"kbit/internal/bencode"
+)
+
+const (
+	MsgExtended uint8 = 20
+
+	// extHandshakeID is the extended message ID of the extended handshake.
+	extHandshakeID = 0
+
+	// localReqQ is the number of outstanding requests we advertise as
+	// acceptable in the extended handshake.
+	localReqQ = 250
+
+	// maxExtendedLength bounds an extended message, counting its extended
+	// message ID. The largest we expect is a ut_metadata piece: 16 KiB of
+	// data after a short dictionary.
+	maxExtendedLength = MetadataPieceSize + 1024
+)
+
+// ClientVersion is sent as "v" in the extended handshake.
+var ClientVersion = "kbit-torrent 1.1.0"
+
+// ExtensionHandler is one extension protocol (BEP 10) extension, such as
+// ut_metadata or ut_pex. Handlers are shared by every connection they are
+// registered on, so per-connection state belongs in the PeerConn or in the
+// handler keyed by it.
+type ExtensionHandler interface {
+	// Name is the extension's key in the "m" dictionary.
+	Name() string
+
+	// HandleMessage is called from ReadMsg with every message the peer
+	// sends for this extension, minus the extended message ID. A returned
+	// error is returned by ReadMsg.
+	HandleMessage(pc *PeerConn, payload []byte) error
+}
+
+// HandshakeExtender is implemented by handlers that add their own fields to
+// the extended handshake, like metadata_size for ut_metadata.
+type HandshakeExtender interface {
+	ExtendHandshake(pc *PeerConn, hs *ExtendedHandshake)
+}
+
+// ExtendedHandshake is the bencoded dictionary exchanged as extended
+// message 0. M maps extension names to the message IDs the sender wants to
+// receive them under; an ID of 0 disables the extension.
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	V            string         `bencode:"v,omitempty"`
+	P            int            `bencode:"p,omitempty"`
+	ReqQ         int            `bencode:"reqq,omitempty"`
+	YourIP       []byte         `bencode:"yourip,omitempty"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+// Extensions is a set of extension handlers. Each gets a local message ID
+// in registration order, starting at 1.
+type Extensions struct {
+	handlers []ExtensionHandler
+}
+
+func NewExtensions(handlers ...ExtensionHandler) (*Extensions, error) {
+	e := &Extensions{}
+	for _, h := range handlers {
+		if err := e.Register(h); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// Register adds h. Handlers must be registered before the set is used on
+// a connection.
+func (e *Extensions) Register(h ExtensionHandler) error {
+	if len(e.handlers) == 255 {
+		return fmt.Errorf("too many extensions")
+	}
+	for _, other := range e.handlers {
+		if other.Name() == h.Name() {
+			return fmt.Errorf("extension %s already registered", h.Name())
+		}
+	}
+	e.handlers = append(e.handlers, h)
+	return nil
+}
+
+func (e *Extensions) handler(id uint8) ExtensionHandler {
+	if id == 0 || int(id) > len(e.handlers) {
+		return nil
+	}
+	return e.handlers[id-1]
+}
+
+// extState is the extension protocol state of one connection.
+type extState struct {
+	extensions *Extensions
+
+	mu      sync.Mutex
+	peer    *ExtendedHandshake
+	peerIDs map[string]uint8
+}
+
+// UseExtensions enables the extension protocol on pc with the given
+// handlers. Extended messages read by ReadMsg are dispatched to them.
+func (p *PeerConn) UseExtensions(e *Extensions) {
+	p.ext = &extState{extensions: e, peerIDs: make(map[string]uint8)}
+}
+
+// SendExtHandshake sends our extended handshake, listing every registered
+// extension.
+func (p *PeerConn) SendExtHandshake() error {
+	if p.ext == nil {
+		return fmt.Errorf("extensions are not enabled on this connection")
+	}
+
+	hs := &ExtendedHandshake{
+		M:    make(map[string]int, len(p.ext.extensions.handlers)),
+		V:    ClientVersion,
+		P:    ListenPort,
+		ReqQ: localReqQ,
+	}
+	if addr, ok := p.conn.RemoteAddr().(*net.TCPAddr); ok {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			hs.YourIP = ip4
+		} else {
+			hs.YourIP = addr.IP.To16()
+		}
+	}
+	for i, h := range p.ext.extensions.handlers {
+		hs.M[h.Name()] = i + 1
+		if ext, ok := h.(HandshakeExtender); ok {
+			ext.ExtendHandshake(p, hs)
+		}
+	}
+
+	payload, err := bencode.Marshal(hs)
+	if err != nil {
+		return err
+	}
+	return p.SendMsg(MsgExtended, append([]byte{extHandshakeID}, payload...))
+}
+
+// PeerExtHandshake returns the peer's latest extended handshake, or nil if
+// none has arrived yet.
+func (p *PeerConn) PeerExtHandshake() *ExtendedHandshake {
+	if p.ext == nil {
+		return nil
+	}
+	p.ext.mu.Lock()
+	defer p.ext.mu.Unlock()
+	return p.ext.peer
+}
+
+// PeerSupports reports whether the peer's extended handshake enabled the
+// named extension.
+func (p *PeerConn) PeerSupports(name string) bool {
+	if p.ext == nil {
+		return false
+	}
+	p.ext.mu.Lock()
+	defer p.ext.mu.Unlock()
+	_, ok := p.ext.peerIDs[name]
+	return ok
+}
+
+// SendExtended sends payload as a message of the named extension, using
+// the ID the peer asked for.
+func (p *PeerConn) SendExtended(name string, payload []byte) error {
+	if p.ext == nil {
+		return fmt.Errorf("extensions are not enabled on this connection")
+	}
+	p.ext.mu.Lock()
+	id, ok := p.ext.peerIDs[name]
+	p.ext.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("peer does not support %s", name)
+	}
+	return p.SendMsg(MsgExtended, append([]byte{id}, payload...))
+}
+
+func (p *PeerConn) handleExtended(payload []byte) error {
+	if len(payload) == 0 {
+		return fmt.Errorf("empty extended message")
+	}
+
+	id := payload[0]
+	if id != extHandshakeID {
+		h := p.ext.extensions.handler(id)
+		if h == nil {
+			// Not something we advertised; ignore it like unknown
+			// message types.
+			return nil
+		}
+		return h.HandleMessage(p, payload[1:])
+	}
+
+	var hs ExtendedHandshake
+	dec := bencode.NewDecoder(bytes.NewReader(payload[1:]))
+	dec.SetOptions(bencode.HardenedOptions)
+	if err := dec.DecodeInto(&hs); err != nil {
+		return fmt.Errorf("decoding extended handshake: %w", err)
+	}
+
+	// Later handshakes update the earlier one; an ID of 0 disables an
+	// extension.
+	p.ext.mu.Lock()
+	defer p.ext.mu.Unlock()
+	for name, id := range hs.M {
+		switch {
+		case id == 0:
+			delete(p.ext.peerIDs, name)
+		case id > 0 && id <= 255:
+			p.ext.peerIDs[name] = uint8(id)
+		}
+	}
+	p.ext.peer = &hs
+	return nil
+}
@@ -0,0 +1,177 @@
+package net
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// recordingHandler stores the payloads it receives on a channel.
+type recordingHandler struct {
+	name string
+	got  chan []byte
+}
+
+func (h *recordingHandler) Name() string { return h.name }
+
+func (h *recordingHandler) HandleMessage(pc *PeerConn, payload []byte) error {
+	h.got <- append([]byte(nil), payload...)
+	return nil
+}
+
+// connPair returns the two ends of a loopback TCP connection as PeerConns.
+func connPair(t *testing.T) (*PeerConn, *PeerConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	remote := <-accepted
+	if remote == nil {
+		t.Fatal("accept failed")
+	}
+
+	a, b := NewPeerConn(dialed, "b"), NewPeerConn(remote, "a")
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	a.SetDeadline(time.Now().Add(5 * time.Second))
+	b.SetDeadline(time.Now().Add(5 * time.Second))
+	return a, b
+}
+
+func TestExtensions_HandshakeAndDispatch(t *testing.T) {
+	a, b := connPair(t)
+
+	pexA := &recordingHandler{name: "ut_pex", got: make(chan []byte, 1)}
+	extA, err := NewExtensions(NewMetadataExtension([]byte("d4:name1:xe")), pexA)
+	if err != nil {
+		t.Fatalf("NewExtensions failed: %v", err)
+	}
+	a.UseExtensions(extA)
+
+	// b registers ut_pex first, so the two sides use different IDs for it.
+	pexB := &recordingHandler{name: "ut_pex", got: make(chan []byte, 1)}
+	extB, _ := NewExtensions(pexB)
+	b.UseExtensions(extB)
+
+	if err := a.SendExtHandshake(); err != nil {
+		t.Fatalf("SendExtHandshake failed: %v", err)
+	}
+	if err := b.SendExtHandshake(); err != nil {
+		t.Fatalf("SendExtHandshake failed: %v", err)
+	}
+
+	if _, err := b.ReadMsg(); err != nil {
+		t.Fatalf("ReadMsg failed: %v", err)
+	}
+	hs := b.PeerExtHandshake()
+	if hs == nil {
+		t.Fatal("expected peer handshake after reading it")
+	}
+	if hs.M["ut_metadata"] != 1 || hs.M["ut_pex"] != 2 {
+		t.Errorf("unexpected m dictionary %v", hs.M)
+	}
+	if hs.V != ClientVersion || hs.P != ListenPort || hs.ReqQ != localReqQ {
+		t.Errorf("unexpected v/p/reqq: %q %d %d", hs.V, hs.P, hs.ReqQ)
+	}
+	if net.IP(hs.YourIP).String() != "127.0.0.1" {
+		t.Errorf("unexpected yourip %v", hs.YourIP)
+	}
+	if hs.MetadataSize != 11 {
+		t.Errorf("expected metadata_size from the ut_metadata handler, got %d", hs.MetadataSize)
+	}
+	if !b.PeerSupports("ut_pex") || b.PeerSupports("lt_donthave") {
+		t.Error("unexpected PeerSupports result")
+	}
+
+	if err := b.SendExtended("ut_pex", []byte("hello")); err != nil {
+		t.Fatalf("SendExtended failed: %v", err)
+	}
+	if err := b.SendExtended("lt_donthave", nil); err == nil {
+		t.Error("expected error sending an extension the peer lacks")
+	}
+
+	// a reads b's handshake, then the ut_pex message.
+	for range 2 {
+		if _, err := a.ReadMsg(); err != nil {
+			t.Fatalf("ReadMsg failed: %v", err)
+		}
+	}
+	select {
+	case got := <-pexA.got:
+		if string(got) != "hello" {
+			t.Errorf("expected payload hello, got %q", got)
+		}
+	default:
+		t.Error("ut_pex handler was not called")
+	}
+}
+
+func TestExtensions_DisableWithZeroID(t *testing.T) {
+	a, b := connPair(t)
+	extA, _ := NewExtensions(&recordingHandler{name: "ut_pex"})
+	a.UseExtensions(extA)
+	b.UseExtensions(&Extensions{})
+
+	a.SendExtHandshake() //nolint:errcheck
+	b.ReadMsg()          //nolint:errcheck
+	if !b.PeerSupports("ut_pex") {
+		t.Fatal("expected ut_pex to be enabled")
+	}
+
+	a.SendMsg(MsgExtended, append([]byte{extHandshakeID}, "d1:md6:ut_pexi0eee"...)) //nolint:errcheck
+	b.ReadMsg()                                                                     //nolint:errcheck
+	if b.PeerSupports("ut_pex") {
+		t.Error("expected ut_pex to be disabled by ID 0")
+	}
+}
+
+func TestExtensions_RejectsDuplicateAndMalformed(t *testing.T) {
+	if _, err := NewExtensions(&recordingHandler{name: "x"}, &recordingHandler{name: "x"}); err == nil {
+		t.Error("expected error for duplicate extension")
+	}
+
+	a, b := connPair(t)
+	b.UseExtensions(&Extensions{})
+	a.SendMsg(MsgExtended, append([]byte{extHandshakeID}, "d1:mi1ee"...)) //nolint:errcheck
+	if _, err := b.ReadMsg(); err == nil {
+		t.Error("expected error for malformed extended handshake")
+	}
+}
+
+func TestDialPeer_RecordsReserved(t *testing.T) {
+	PeerID = []byte("-GT0001-LOCALPEERID-")
+	infoHash := []byte("01234567890123456789")
+
+	addr := startMockPeer(t, infoHash)
+	pc, err := DialPeer(addr, infoHash)
+	if err != nil {
+		t.Fatalf("DialPeer failed: %v", err)
+	}
+	defer pc.Close()
+
+	if pc.Reserved.SupportsExtensions() {
+		t.Error("mock peer does not set the extension bit")
+	}
+	if string(pc.PeerID) != "-GT0001-TESTPEERID-\x00" {
+		t.Errorf("unexpected peer ID %q", pc.PeerID)
+	}
+}
@@ -0,0 +1,151 @@
+package net
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Messages of the Fast Extension (BEP 6).
+const (
+	MsgSuggest     uint8 = 13
+	MsgHaveAll     uint8 = 14
+	MsgHaveNone    uint8 = 15
+	MsgReject      uint8 = 16
+	MsgAllowedFast uint8 = 17
+)
+
+// allowedFastCount is how many pieces we let a peer download while it is
+// choked, and how many allowed fast pieces we remember from a peer.
+const allowedFastCount = 10
+
+// maxSuggested caps the suggestions remembered per connection.
+const maxSuggested = 16
+
+// suggestCount is how many of the pieces we verified last are suggested to
+// a peer that connects while we still download.
+const suggestCount = 4
+
+// errRejected is returned for a request the peer rejected. Unlike other
+// failures it leaves the connection usable.
+var errRejected = errors.New("request rejected by peer")
+
+// Fast reports whether both sides of the connection set the Fast Extension
+// bit, enabling the messages of BEP 6.
+func (p *PeerConn) Fast() bool {
+	return p.Reserved.SupportsFast() && localReserved.SupportsFast()
+}
+
+// handleFast updates the connection's view of the peer from a Fast
+// Extension message. Receiving one on a connection that did not negotiate
+// the extension is a protocol error.
+func (p *PeerConn) handleFast(msg *PeerMsg) error {
+	if !p.Fast() {
+		return fmt.Errorf("fast extension message %d without the fast extension", msg.ID)
+	}
+
+	switch msg.ID {
+	case MsgHaveAll, MsgHaveNone:
+		if len(msg.Payload) != 0 {
+			return fmt.Errorf("malformed have all/none message")
+		}
+		p.haveAll = msg.ID == MsgHaveAll
+		p.Bitfield = []byte{}
+	case MsgSuggest, MsgAllowedFast:
+		if len(msg.Payload) != 4 {
+			return fmt.Errorf("malformed message %d", msg.ID)
+		}
+		index := int(binary.BigEndian.Uint32(msg.Payload))
+		if err := p.checkPiece(index); err != nil {
+			return err
+		}
+		switch {
+		case p.NumPieces == 0:
+			// Not a download connection; nothing to remember.
+		case msg.ID == MsgAllowedFast:
+			if p.AllowedFast == nil {
+				p.AllowedFast = make(map[int]bool)
+			}
+			if len(p.AllowedFast) < allowedFastCount {
+				p.AllowedFast[index] = true
+			}
+		case len(p.Suggested) < maxSuggested:
+			p.Suggested = append(p.Suggested, index)
+		}
+	case MsgReject:
+		if len(msg.Payload) != 12 {
+			return fmt.Errorf("malformed reject message")
+		}
+	}
+	return nil
+}
+
+// sendHaves tells the peer which pieces we have, as the first message
+// after the handshakes: HaveAll or HaveNone when they say it in one byte
+// on a Fast Extension connection, a bitfield otherwise. Peers without the
+// extension are told nothing when we have nothing.
+func (p *PeerConn) sendHaves(bitfield []byte, numPieces int) error {
+	count := 0
+	for i := range numPieces {
+		if i/8 < len(bitfield) && bitfield[i/8]&(0x80>>(i%8)) != 0 {
+			count++
+		}
+	}
+
+	switch {
+	case p.Fast() && count == 0:
+		return p.SendMsg(MsgHaveNone, nil)
+	case p.Fast() && count == numPieces:
+		return p.SendMsg(MsgHaveAll, nil)
+	case count == 0:
+		return nil
+	default:
+		return p.SendMsg(MsgBitfield, bitfield)
+	}
+}
+
+// allowedFastSet computes the canonical allowed fast set of BEP 6: k
+// pieces, out of numPieces, derived from the peer's IPv4 /24 and the
+// infohash so that every client offers a peer the same pieces. It is nil
+// for other addresses.
+func allowedFastSet(ip net.IP, infoHash []byte, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+	k = min(k, numPieces)
+
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash...)
+
+	var set []int
+	seen := make(map[int]bool)
+	for len(set) < k {
+		h := sha1.Sum(x)
+		x = h[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// parseBlock reads the index, begin and length of a request, cancel or
+// reject message.
+func parseBlock(payload []byte) (blockRequest, error) {
+	if len(payload) != 12 {
+		return blockRequest{}, fmt.Errorf("malformed block message")
+	}
+	return blockRequest{
+		index:  int(binary.BigEndian.Uint32(payload[0:4])),
+		begin:  int(binary.BigEndian.Uint32(payload[4:8])),
+		length: int(binary.BigEndian.Uint32(payload[8:12])),
+	}, nil
+}
@@ -0,0 +1,362 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"kbit/pkg/types"
+)
+
+func TestAllowedFastSet_SpecVector(t *testing.T) {
+	// The example from BEP 6.
+	ip := net.ParseIP("80.4.4.200")
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+
+	got := allowedFastSet(ip, infoHash, 1313, 7)
+	want := []int{1059, 431, 808, 1217, 287, 376, 1188}
+	if !slices.Equal(got, want) {
+		t.Errorf("k=7: got %v, want %v", got, want)
+	}
+
+	got = allowedFastSet(ip, infoHash, 1313, 9)
+	want = append(want, 353, 508)
+	if !slices.Equal(got, want) {
+		t.Errorf("k=9: got %v, want %v", got, want)
+	}
+
+	if got := allowedFastSet(net.ParseIP("::1"), infoHash, 1313, 7); got != nil {
+		t.Errorf("IPv6 peer: got %v, want no set", got)
+	}
+}
+
+// fastPipe returns the two ends of a connection on which the Fast
+// Extension was negotiated when fast is true.
+func fastPipe(t *testing.T, fast bool) (local, remote *PeerConn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	local, remote = NewPeerConn(a, "remote"), NewPeerConn(b, "local")
+	if fast {
+		local.Reserved, remote.Reserved = localReserved, localReserved
+	}
+	return local, remote
+}
+
+func TestReadMsg_TracksFastMessages(t *testing.T) {
+	local, remote := fastPipe(t, true)
+	local.NumPieces = 2000
+
+	index := func(i int) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(i))
+	}
+	go func() {
+		remote.SendMsg(MsgHaveAll, nil)
+		remote.SendMsg(MsgAllowedFast, index(3))
+		remote.SendMsg(MsgSuggest, index(7))
+		remote.SendMsg(MsgUnchoke, nil)
+		remote.SendMsg(MsgReject, buildRequestPayload(3, 0, BlockSize))
+	}()
+	for range 5 {
+		if _, err := local.ReadMsg(); err != nil {
+			t.Fatalf("ReadMsg: %v", err)
+		}
+	}
+
+	if !local.HasPiece(0) || !local.HasPiece(1000) {
+		t.Error("HaveAll did not mark every piece")
+	}
+	if !local.AllowedFast[3] {
+		t.Error("piece 3 not recorded as allowed fast")
+	}
+	if !slices.Equal(local.Suggested, []int{7}) {
+		t.Errorf("Suggested = %v, want [7]", local.Suggested)
+	}
+	if local.Choked {
+		t.Error("still choked after Unchoke")
+	}
+}
+
+func TestReadMsg_PieceIndexOutOfRange(t *testing.T) {
+	for _, id := range []uint8{MsgHave, MsgAllowedFast, MsgSuggest} {
+		local, remote := fastPipe(t, true)
+		local.NumPieces = 20
+
+		go remote.SendMsg(id, binary.BigEndian.AppendUint32(nil, 0xFFFFFFFF))
+		if _, err := local.ReadMsg(); err == nil {
+			t.Errorf("message %d: expected an index past the last piece to fail", id)
+		}
+		if len(local.Bitfield) != 0 {
+			t.Errorf("message %d: bitfield grew to %d bytes", id, len(local.Bitfield))
+		}
+	}
+}
+
+func TestReadMsg_AllowedFastIsCapped(t *testing.T) {
+	local, remote := fastPipe(t, true)
+	local.NumPieces = 100
+
+	go func() {
+		for i := range 50 {
+			remote.SendMsg(MsgAllowedFast, binary.BigEndian.AppendUint32(nil, uint32(i)))
+		}
+	}()
+	for range 50 {
+		if _, err := local.ReadMsg(); err != nil {
+			t.Fatalf("ReadMsg: %v", err)
+		}
+	}
+	if len(local.AllowedFast) != allowedFastCount {
+		t.Errorf("remembered %d allowed fast pieces, want %d", len(local.AllowedFast), allowedFastCount)
+	}
+}
+
+func TestReadMsg_FastMessageWithoutExtension(t *testing.T) {
+	local, remote := fastPipe(t, false)
+
+	go remote.SendMsg(MsgHaveAll, nil)
+	if _, err := local.ReadMsg(); err == nil {
+		t.Error("expected HaveAll on a connection without the fast extension to fail")
+	}
+}
+
+func TestSendHaves(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		fast     bool
+		bitfield []byte
+		want     int // message ID, or -1 for none
+	}{
+		{"fast, nothing", true, []byte{0x00}, int(MsgHaveNone)},
+		{"fast, everything", true, []byte{0xe0}, int(MsgHaveAll)},
+		{"fast, some", true, []byte{0xa0}, int(MsgBitfield)},
+		{"plain, nothing", false, nil, -1},
+		{"plain, everything", false, []byte{0xe0}, int(MsgBitfield)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			local, remote := fastPipe(t, tc.fast)
+			go func() {
+				local.sendHaves(tc.bitfield, 3)
+				local.SendMsg(MsgInterested, nil)
+			}()
+
+			msg, err := remote.ReadMsg()
+			if err != nil {
+				t.Fatalf("ReadMsg: %v", err)
+			}
+			got := int(msg.ID)
+			if msg.ID == MsgInterested {
+				got = -1
+			}
+			if got != tc.want {
+				t.Errorf("first message = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+// manyPieceTorrent returns a torrent of 20 one-block pieces and its data,
+// enough pieces for some to fall outside the allowed fast set.
+func manyPieceTorrent() (*types.TorrentFile, []byte) {
+	data := make([]byte, 20*BlockSize)
+	for i := range data {
+		data[i] = byte(i * 3)
+	}
+	tor := &types.TorrentFile{
+		Name:        "fast.bin",
+		Length:      int64(len(data)),
+		PieceLength: BlockSize,
+		InfoHash:    bytes.Repeat([]byte{0xcd}, 20),
+		Pieces:      make([][]byte, 20),
+	}
+	return tor, data
+}
+
+func TestUploader_FastPeerWhileChoked(t *testing.T) {
+	if len(PeerID) != 20 {
+		PeerID = []byte("-GT0001-LOCALPEERID-")
+	}
+	tor, data := manyPieceTorrent()
+	u := NewUploader(tor, bytes.NewReader(data), nil, DefaultUploadSlots)
+	for i := range tor.Pieces {
+		u.SetHave(i)
+	}
+	ln := startListener(t, u)
+
+	pc, err := DialPeer(ln.Addr().String(), tor.InfoHash)
+	if err != nil {
+		t.Fatalf("DialPeer: %v", err)
+	}
+	defer pc.Close()
+	pc.NumPieces = len(tor.Pieces)
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	readUntil(t, pc, MsgHaveAll)
+	allowed := allowedFastSet(net.ParseIP("127.0.0.1"), tor.InfoHash, len(tor.Pieces), allowedFastCount)
+	for range allowed {
+		readUntil(t, pc, MsgAllowedFast)
+	}
+	for _, i := range allowed {
+		if !pc.AllowedFast[i] {
+			t.Fatalf("AllowedFast = %v, want %v", pc.AllowedFast, allowed)
+		}
+	}
+
+	var other int
+	for other = range tor.Pieces {
+		if !pc.AllowedFast[other] {
+			break
+		}
+	}
+
+	// Choked, only the allowed fast pieces are served.
+	pc.SendMsg(MsgRequest, buildRequestPayload(other, 0, BlockSize))
+	reject := readUntil(t, pc, MsgReject)
+	if !bytes.Equal(reject.Payload, buildRequestPayload(other, 0, BlockSize)) {
+		t.Errorf("reject = %x, want the request for piece %d", reject.Payload, other)
+	}
+	pc.SendMsg(MsgRequest, buildRequestPayload(allowed[0], 0, BlockSize))
+	piece := readUntil(t, pc, MsgPiece)
+	if int(binary.BigEndian.Uint32(piece.Payload)) != allowed[0] {
+		t.Errorf("got piece %d, want %d", binary.BigEndian.Uint32(piece.Payload), allowed[0])
+	}
+
+	// Unchoked, everything is.
+	pc.SendMsg(MsgInterested, nil)
+	readUntil(t, pc, MsgUnchoke)
+	pc.SendMsg(MsgRequest, buildRequestPayload(other, 0, BlockSize))
+	piece = readUntil(t, pc, MsgPiece)
+	off := other * BlockSize
+	if !bytes.Equal(piece.Payload[8:], data[off:off+BlockSize]) {
+		t.Errorf("piece %d has the wrong data", other)
+	}
+}
+
+func TestUploader_FastPeerPartialSeed(t *testing.T) {
+	if len(PeerID) != 20 {
+		PeerID = []byte("-GT0001-LOCALPEERID-")
+	}
+	tor, data := manyPieceTorrent()
+	u := NewUploader(tor, bytes.NewReader(data), nil, DefaultUploadSlots)
+	for _, i := range []int{1, 2, 3, 4, 5, 6} {
+		u.SetHave(i)
+	}
+	ln := startListener(t, u)
+
+	pc, err := DialPeer(ln.Addr().String(), tor.InfoHash)
+	if err != nil {
+		t.Fatalf("DialPeer: %v", err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	readUntil(t, pc, MsgBitfield)
+	for _, want := range []int{6, 5, 4, 3} {
+		msg := readUntil(t, pc, MsgSuggest)
+		if got := int(binary.BigEndian.Uint32(msg.Payload)); got != want {
+			t.Errorf("suggested piece %d, want %d", got, want)
+		}
+	}
+
+	// A missing piece is rejected rather than closing the connection.
+	pc.SendMsg(MsgInterested, nil)
+	readUntil(t, pc, MsgUnchoke)
+	pc.SendMsg(MsgRequest, buildRequestPayload(10, 0, BlockSize))
+	readUntil(t, pc, MsgReject)
+	pc.SendMsg(MsgRequest, buildRequestPayload(2, 0, BlockSize))
+	readUntil(t, pc, MsgPiece)
+}
+
+func TestWorkQueue_PopFor(t *testing.T) {
+	queue := &workQueue{}
+	for i := range 6 {
+		queue.push(pieceWork{index: i})
+	}
+	pc := &PeerConn{
+		Reserved:    localReserved,
+		Bitfield:    []byte{0x7c}, // pieces 1 to 5
+		Choked:      true,
+		AllowedFast: map[int]bool{0: true, 4: true},
+		Suggested:   []int{0, 5},
+	}
+
+	// Choked, only the allowed fast piece the peer has.
+	if pw, ok := queue.popFor(pc); !ok || pw.index != 4 {
+		t.Fatalf("choked: got %d, %v; want piece 4", pw.index, ok)
+	}
+	if _, ok := queue.popFor(pc); ok {
+		t.Fatal("choked: expected nothing more")
+	}
+
+	// Unchoked, the suggested piece goes first.
+	pc.Choked = false
+	if pw, ok := queue.popFor(pc); !ok || pw.index != 5 {
+		t.Fatalf("unchoked: got %d, %v; want suggested piece 5", pw.index, ok)
+	}
+	if pw, ok := queue.popFor(pc); !ok || pw.index != 1 {
+		t.Fatalf("unchoked: got %d, %v; want piece 1", pw.index, ok)
+	}
+	if !slices.Equal(pc.Suggested, []int{0}) {
+		t.Errorf("Suggested = %v, want [0]: piece 5 was taken", pc.Suggested)
+	}
+}
+
+func TestDownloadPiece_Rejected(t *testing.T) {
+	local, remote := fastPipe(t, true)
+
+	// The first request is rejected and the second answered late with
+	// stale data; every later request is answered with 0x11 bytes.
+	type reply struct {
+		id      uint8
+		payload []byte
+	}
+	replies := make(chan reply, 16)
+	go func() {
+		for r := range replies {
+			remote.SendMsg(r.id, r.payload)
+		}
+	}()
+	go func() {
+		defer close(replies)
+		var first []byte
+		for n := 0; ; {
+			msg, err := remote.ReadMsg()
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.ID != MsgRequest {
+				continue
+			}
+			req, _ := parseBlock(msg.Payload)
+			block := append(append([]byte(nil), msg.Payload[:8]...), bytes.Repeat([]byte{0x11}, req.length)...)
+			switch n++; n {
+			case 1:
+				first = msg.Payload
+			case 2:
+				replies <- reply{MsgReject, first}
+				stale := append([]byte(nil), msg.Payload[:8]...)
+				replies <- reply{MsgPiece, append(stale, bytes.Repeat([]byte{0xee}, req.length)...)}
+			default:
+				replies <- reply{MsgPiece, block}
+			}
+		}
+	}()
+
+	pw := pieceWork{index: 2, length: 2 * BlockSize}
+	if _, err := downloadPiece(local, pw); !errors.Is(err, errRejected) {
+		t.Fatalf("first attempt: got %v, want errRejected", err)
+	}
+
+	// The late block of the first attempt must not count for the second.
+	data, err := downloadPiece(local, pw)
+	if err != nil {
+		t.Fatalf("second attempt: %v", err)
+	}
+	if !bytes.Equal(data, bytes.Repeat([]byte{0x11}, pw.length)) {
+		t.Error("second attempt took a block of the first")
+	}
+}
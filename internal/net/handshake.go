@@ -7,50 +7,134 @@ import (
 	"time"
 )
 
+const pstr = "BitTorrent protocol"
+
+// Reserved is the 8-byte field of the handshake where peers advertise
+// protocol extensions.
+type Reserved [8]byte
+
+// SupportsExtensions reports whether the extension protocol bit (BEP 10) is
+// set.
+func (r Reserved) SupportsExtensions() bool {
+	return r[5]&0x10 != 0
+}
+
+// SupportsFast reports whether the Fast Extension bit (BEP 6) is set.
+func (r Reserved) SupportsFast() bool {
+	return r[7]&0x04 != 0
+}
+
+// localReserved is what we advertise: the extension protocol (BEP 10) and
+// the Fast Extension (BEP 6).
+var localReserved = Reserved{5: 0x10, 7: 0x04}
+
 func Handshake(addr string, infoHash []byte) (net.Conn, error) {
+	pc, err := DialPeer(addr, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	return pc.conn, nil
+}
+
+// DialPeer connects to addr and performs the handshake, returning a
+// PeerConn that records the reserved bytes and peer ID the peer sent.
+func DialPeer(addr string, infoHash []byte) (*PeerConn, error) {
 	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(PeerID) != 20 {
+	reserved, peerID, err := handshake(conn, infoHash)
+	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("peerID must be 20 bytes")
+		return nil, err
 	}
 
-	pstr := "BitTorrent protocol"
-	handshake := make([]byte, 49+len(pstr))
+	pc := NewPeerConn(conn, addr)
+	pc.Reserved = reserved
+	pc.PeerID = peerID
+	return pc, nil
+}
 
-	handshake[0] = byte(len(pstr))
-	copy(handshake[1:], pstr)
-	// 8 reserved bytes are already zero
-	copy(handshake[1+len(pstr)+8:], infoHash)
-	copy(handshake[1+len(pstr)+8+20:], PeerID)
+func handshake(conn net.Conn, infoHash []byte) (Reserved, []byte, error) {
+	var reserved Reserved
+
+	handshake, err := handshakeMsg(infoHash)
+	if err != nil {
+		return reserved, nil, err
+	}
 
 	conn.SetDeadline(time.Now().Add(10 * time.Second))
 
 	_, err = conn.Write(handshake)
 	if err != nil {
-		conn.Close()
-		return nil, err
+		return reserved, nil, err
 	}
 
 	resp := make([]byte, 68)
 	_, err = io.ReadFull(conn, resp)
 	if err != nil {
-		conn.Close()
-		return nil, err
+		return reserved, nil, err
 	}
 
 	if string(resp[1:20]) != pstr {
-		conn.Close()
-		return nil, fmt.Errorf("invalid protocol string")
+		return reserved, nil, fmt.Errorf("invalid protocol string")
 	}
 
 	if string(resp[28:48]) != string(infoHash) {
-		conn.Close()
-		return nil, fmt.Errorf("infohash mismatch")
+		return reserved, nil, fmt.Errorf("infohash mismatch")
+	}
+
+	copy(reserved[:], resp[20:28])
+	return reserved, resp[48:68], nil
+}
+
+// acceptHandshake performs the responder side of the handshake on conn: it
+// reads the peer's handshake, asks known whether we serve the infohash in
+// it, and only then answers with ours. It returns the peer's reserved
+// bytes, the infohash and the peer's ID.
+func acceptHandshake(conn net.Conn, known func(infoHash []byte) bool) (Reserved, []byte, []byte, error) {
+	var reserved Reserved
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	req := make([]byte, 68)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return reserved, nil, nil, err
+	}
+	if req[0] != byte(len(pstr)) || string(req[1:20]) != pstr {
+		return reserved, nil, nil, fmt.Errorf("invalid protocol string")
+	}
+
+	infoHash := req[28:48]
+	if !known(infoHash) {
+		return reserved, nil, nil, fmt.Errorf("unknown infohash %x", infoHash)
+	}
+
+	resp, err := handshakeMsg(infoHash)
+	if err != nil {
+		return reserved, nil, nil, err
+	}
+	if _, err := conn.Write(resp); err != nil {
+		return reserved, nil, nil, err
+	}
+
+	copy(reserved[:], req[20:28])
+	return reserved, infoHash, req[48:68], nil
+}
+
+// handshakeMsg builds our handshake for infoHash.
+func handshakeMsg(infoHash []byte) ([]byte, error) {
+	if len(PeerID) != 20 {
+		return nil, fmt.Errorf("peerID must be 20 bytes")
 	}
 
-	return conn, nil
+	handshake := make([]byte, 49+len(pstr))
+
+	handshake[0] = byte(len(pstr))
+	copy(handshake[1:], pstr)
+	copy(handshake[1+len(pstr):], localReserved[:])
+	copy(handshake[1+len(pstr)+8:], infoHash)
+	copy(handshake[1+len(pstr)+8+20:], PeerID)
+	return handshake, nil
 }
@@ -0,0 +1,101 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// dualListener accepts connections from an IPv4 and an IPv6 listener on
+// the same port, so incoming peers are reached on both stacks even where
+// IPv6 sockets do not accept IPv4 connections.
+type dualListener struct {
+	listeners []net.Listener
+	conns     chan acceptResult
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// ListenDualStack listens for peers on port over both IPv4 and IPv6. It
+// succeeds if either stack is available; a port of 0 picks a free port,
+// the same one on both stacks where possible.
+func ListenDualStack(port int) (net.Listener, error) {
+	ln4, err4 := net.Listen("tcp4", net.JoinHostPort("0.0.0.0", strconv.Itoa(port)))
+	if err4 == nil && port == 0 {
+		port = ln4.Addr().(*net.TCPAddr).Port
+	}
+	ln6, err6 := net.Listen("tcp6", net.JoinHostPort("::", strconv.Itoa(port)))
+
+	var listeners []net.Listener
+	if err4 == nil {
+		listeners = append(listeners, ln4)
+	}
+	if err6 == nil {
+		listeners = append(listeners, ln6)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("cannot listen on port %d: %w", port, errors.Join(err4, err6))
+	}
+
+	d := &dualListener{
+		listeners: listeners,
+		conns:     make(chan acceptResult),
+		done:      make(chan struct{}),
+	}
+	for _, ln := range listeners {
+		go d.acceptLoop(ln)
+	}
+	return d, nil
+}
+
+// acceptLoop passes on what ln accepts. Failed accepts are passed on too,
+// for the caller to log, but only closing ln ends the loop: one bad accept
+// must not take a stack out of service.
+func (d *dualListener) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		select {
+		case d.conns <- acceptResult{conn, err}:
+		case <-d.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+func (d *dualListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-d.conns:
+		return r.conn, r.err
+	case <-d.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (d *dualListener) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.done)
+		for _, ln := range d.listeners {
+			err = errors.Join(err, ln.Close())
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the first listener, IPv4 when available.
+func (d *dualListener) Addr() net.Addr {
+	return d.listeners[0].Addr()
+}
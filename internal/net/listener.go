@@ -0,0 +1,187 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+
+	"kbit/internal/logger"
+)
+
+// maxIncoming caps the connections a Listener serves at once; further
+// peers are turned away until some leave.
+var maxIncoming = 100
+
+// Listener accepts peer connections and hands each to the Uploader of the
+// torrent its handshake names.
+type Listener struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	torrents map[string]*Uploader
+	conns    map[net.Conn]struct{}
+	closed   bool
+	slots    chan struct{}
+	routines sync.WaitGroup
+}
+
+// Listen starts accepting peer connections on addr, such as ":6881". An
+// address without a host is listened on over both IPv4 and IPv6, so peers
+// on either stack can connect. Connections for torrents that are not being
+// served are refused.
+func Listen(addr string) (*Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var ln net.Listener
+	if host == "" {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+		ln, err = ListenDualStack(p)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l := &Listener{
+		ln:       ln,
+		torrents: make(map[string]*Uploader),
+		conns:    make(map[net.Conn]struct{}),
+		slots:    make(chan struct{}, maxIncoming),
+	}
+	l.routines.Add(1)
+	go l.acceptLoop()
+	return l, nil
+}
+
+// Addr returns the address the listener accepts connections on.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Port returns the TCP port the listener accepts connections on.
+func (l *Listener) Port() int {
+	return l.ln.Addr().(*net.TCPAddr).Port
+}
+
+// Serve routes connections for u's torrent to u.
+func (l *Listener) Serve(u *Uploader) {
+	l.mu.Lock()
+	l.torrents[string(u.torrent.InfoHash)] = u
+	l.mu.Unlock()
+}
+
+// Remove stops accepting connections for infoHash. Connections already
+// being served are left to finish.
+func (l *Listener) Remove(infoHash []byte) {
+	l.mu.Lock()
+	delete(l.torrents, string(infoHash))
+	l.mu.Unlock()
+}
+
+// Close stops accepting connections and closes those being served.
+func (l *Listener) Close() error {
+	err := l.ln.Close()
+	l.mu.Lock()
+	l.closed = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+	l.routines.Wait()
+	return err
+}
+
+func (l *Listener) acceptLoop() {
+	defer l.routines.Done()
+
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Log.Warn("accepting peer connection failed", slog.String("error", err.Error()))
+			continue
+		}
+
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			logger.Log.Debug("too many peer connections; refusing",
+				slog.String("addr", conn.RemoteAddr().String()),
+			)
+			conn.Close()
+			continue
+		}
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			conn.Close()
+			return
+		}
+		l.conns[conn] = struct{}{}
+		l.mu.Unlock()
+
+		l.routines.Add(1)
+		go func() {
+			defer l.routines.Done()
+			defer func() { <-l.slots }()
+			l.handle(conn)
+
+			l.mu.Lock()
+			delete(l.conns, conn)
+			l.mu.Unlock()
+		}()
+	}
+}
+
+func (l *Listener) uploader(infoHash []byte) *Uploader {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.torrents[string(infoHash)]
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	defer conn.Close()
+	addr := conn.RemoteAddr().String()
+
+	reserved, infoHash, peerID, err := acceptHandshake(conn, func(infoHash []byte) bool {
+		return l.uploader(infoHash) != nil
+	})
+	if err != nil {
+		logger.Log.Debug("incoming handshake failed",
+			slog.String("addr", addr),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+	u := l.uploader(infoHash)
+	if u == nil {
+		return
+	}
+
+	pc := NewPeerConn(conn, addr)
+	pc.Reserved = reserved
+	pc.PeerID = peerID
+	pc.NumPieces = len(u.torrent.Pieces)
+	logger.Log.Info("peer connected to us", slog.String("addr", addr))
+
+	if err := u.serve(pc); err != nil {
+		logger.Log.Debug("upload connection closed",
+			slog.String("addr", addr),
+			slog.String("error", err.Error()),
+		)
+	}
+}
@@ -0,0 +1,325 @@
+package net
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kbit/pkg/types"
+)
+
+// seedTorrent writes a three-piece torrent into a temporary directory and
+// returns it, its data and the storage holding it.
+func seedTorrent(t *testing.T) (*types.TorrentFile, []byte, *storage) {
+	t.Helper()
+	if len(PeerID) != 20 {
+		PeerID = []byte("-GT0001-LOCALPEERID-")
+	}
+
+	data := make([]byte, 2*BlockSize*2+1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	tor := &types.TorrentFile{
+		Name:        "seed.bin",
+		Length:      int64(len(data)),
+		PieceLength: 2 * BlockSize,
+		InfoHash:    bytes.Repeat([]byte{0xab}, 20),
+	}
+	for off := 0; off < len(data); off += int(tor.PieceLength) {
+		h := sha1.Sum(data[off:min(off+int(tor.PieceLength), len(data))])
+		tor.Pieces = append(tor.Pieces, h[:])
+	}
+
+	st, err := openStorage(t.TempDir(), tor)
+	if err != nil {
+		t.Fatalf("openStorage: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	if _, err := st.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	return tor, data, st
+}
+
+// startListener serves u on a loopback listener.
+func startListener(t *testing.T, u *Uploader) *Listener {
+	t.Helper()
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ln.Serve(u)
+	return ln
+}
+
+// readUntil reads messages from pc until one with the given ID arrives.
+func readUntil(t *testing.T, pc *PeerConn, id uint8) *PeerMsg {
+	t.Helper()
+	for {
+		msg, err := pc.ReadMsg()
+		if err != nil {
+			t.Fatalf("waiting for message %d: %v", id, err)
+		}
+		if msg != nil && msg.ID == id {
+			return msg
+		}
+	}
+}
+
+func TestListener_ServesVerifiedPieces(t *testing.T) {
+	tor, data, st := seedTorrent(t)
+	stats := NewStats(0)
+	u := NewUploader(tor, st, stats, DefaultUploadSlots)
+	u.SetHave(0)
+	u.SetHave(2)
+	ln := startListener(t, u)
+
+	pc, err := DialPeer(ln.Addr().String(), tor.InfoHash)
+	if err != nil {
+		t.Fatalf("DialPeer: %v", err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	bf := readUntil(t, pc, MsgBitfield)
+	if !bytes.Equal(bf.Payload, []byte{0xa0}) {
+		t.Errorf("bitfield = %08b, want 10100000", bf.Payload)
+	}
+
+	pc.SendMsg(MsgInterested, nil)
+	readUntil(t, pc, MsgUnchoke)
+
+	last := 2 * int(tor.PieceLength)
+	for _, req := range []struct{ index, begin, length int }{
+		{0, BlockSize, BlockSize},
+		{2, 0, len(data) - last},
+	} {
+		pc.SendMsg(MsgRequest, buildRequestPayload(req.index, req.begin, req.length))
+		msg := readUntil(t, pc, MsgPiece)
+		if int(binary.BigEndian.Uint32(msg.Payload[0:4])) != req.index || int(binary.BigEndian.Uint32(msg.Payload[4:8])) != req.begin {
+			t.Fatalf("piece header = %x, want piece %d at %d", msg.Payload[:8], req.index, req.begin)
+		}
+		off := req.index*int(tor.PieceLength) + req.begin
+		if !bytes.Equal(msg.Payload[8:], data[off:off+req.length]) {
+			t.Errorf("block %d/%d has the wrong data", req.index, req.begin)
+		}
+	}
+	if got := stats.Uploaded.Load(); got != int64(BlockSize+len(data)-last) {
+		t.Errorf("Uploaded = %d, want %d", got, BlockSize+len(data)-last)
+	}
+
+	// Pieces verified later are announced with Have.
+	u.SetHave(1)
+	have := readUntil(t, pc, MsgHave)
+	if binary.BigEndian.Uint32(have.Payload) != 1 {
+		t.Errorf("have = %x, want piece 1", have.Payload)
+	}
+}
+
+func TestListener_AcceptsBothStacks(t *testing.T) {
+	tor, _, st := seedTorrent(t)
+	ln, err := Listen(":0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	ln.Serve(NewUploader(tor, st, nil, DefaultUploadSlots))
+
+	targets := []string{PeerAddr(net.ParseIP("127.0.0.1"), ln.Port())}
+	if probe, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		probe.Close()
+		targets = append(targets, PeerAddr(net.ParseIP("::1"), ln.Port()))
+	}
+	for _, target := range targets {
+		pc, err := DialPeer(target, tor.InfoHash)
+		if err != nil {
+			t.Errorf("DialPeer %s: %v", target, err)
+			continue
+		}
+		pc.Close()
+	}
+}
+
+func TestListener_RefusesUnknownInfoHash(t *testing.T) {
+	tor, _, st := seedTorrent(t)
+	ln := startListener(t, NewUploader(tor, st, nil, DefaultUploadSlots))
+
+	if pc, err := DialPeer(ln.Addr().String(), bytes.Repeat([]byte{1}, 20)); err == nil {
+		pc.Close()
+		t.Error("expected the handshake for an unknown torrent to fail")
+	}
+
+	ln.Remove(tor.InfoHash)
+	if pc, err := DialPeer(ln.Addr().String(), tor.InfoHash); err == nil {
+		pc.Close()
+		t.Error("expected the handshake for a removed torrent to fail")
+	}
+}
+
+func TestListener_ClosesOnBadRequests(t *testing.T) {
+	tor, _, st := seedTorrent(t)
+	u := NewUploader(tor, st, nil, DefaultUploadSlots)
+	u.SetHave(0)
+	ln := startListener(t, u)
+
+	for name, payload := range map[string][]byte{
+		"past the piece": buildRequestPayload(0, BlockSize, 2*BlockSize),
+		"too long":       buildRequestPayload(0, 0, maxRequestLength+1),
+		"malformed":      {0, 0, 0, 0},
+	} {
+		pc, err := DialPeer(ln.Addr().String(), tor.InfoHash)
+		if err != nil {
+			t.Fatalf("DialPeer: %v", err)
+		}
+		pc.SetDeadline(time.Now().Add(5 * time.Second))
+		pc.SendMsg(MsgInterested, nil)
+		readUntil(t, pc, MsgUnchoke)
+		pc.SendMsg(MsgRequest, payload)
+
+		for {
+			msg, err := pc.ReadMsg()
+			if err != nil {
+				break
+			}
+			if msg != nil && msg.ID == MsgPiece {
+				t.Errorf("%s: request was answered", name)
+			}
+		}
+		pc.Close()
+	}
+}
+
+func TestListener_IgnoresRequestsForMissingPieces(t *testing.T) {
+	// Without the Fast Extension there is no Reject to send.
+	localReserved = Reserved{5: 0x10}
+	t.Cleanup(func() { localReserved = Reserved{5: 0x10, 7: 0x04} })
+
+	tor, _, st := seedTorrent(t)
+	u := NewUploader(tor, st, nil, DefaultUploadSlots)
+	u.SetHave(0)
+	ln := startListener(t, u)
+
+	pc, err := DialPeer(ln.Addr().String(), tor.InfoHash)
+	if err != nil {
+		t.Fatalf("DialPeer: %v", err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	pc.SendMsg(MsgInterested, nil)
+	readUntil(t, pc, MsgUnchoke)
+
+	pc.SendMsg(MsgRequest, buildRequestPayload(1, 0, BlockSize))
+	pc.SendMsg(MsgRequest, buildRequestPayload(0, 0, BlockSize))
+	msg := readUntil(t, pc, MsgPiece)
+	if index := binary.BigEndian.Uint32(msg.Payload); index != 0 {
+		t.Errorf("got piece %d, want 0", index)
+	}
+}
+
+func TestUploadConn_CancelDropsQueuedRequest(t *testing.T) {
+	c := &uploadConn{queue: []blockRequest{{0, 0, BlockSize}, {0, BlockSize, BlockSize}, {1, 0, BlockSize}}}
+
+	c.cancel(blockRequest{0, BlockSize, BlockSize})
+	c.cancel(blockRequest{5, 0, BlockSize}) // never requested
+
+	var got []blockRequest
+	for {
+		req, ok := c.next()
+		if !ok {
+			break
+		}
+		got = append(got, req)
+	}
+	if len(got) != 2 || got[0] != (blockRequest{0, 0, BlockSize}) || got[1] != (blockRequest{1, 0, BlockSize}) {
+		t.Errorf("queue after cancel = %v", got)
+	}
+}
+
+func TestDownload_FromListener(t *testing.T) {
+	tor, data, st := seedTorrent(t)
+	u := NewUploader(tor, st, nil, DefaultUploadSlots)
+	for i := range tor.Pieces {
+		u.SetHave(i)
+	}
+	ln := startListener(t, u)
+
+	leech := *tor
+	leech.Peers = types.HashSet[string]{ln.Addr().String(): {}}
+	t.Chdir(t.TempDir())
+	if err := Download(&leech, nil, DefaultUploadSlots); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+
+	got, err := os.ReadFile(tor.Name)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded file differs from the seed (%v)", err)
+	}
+}
+
+func TestDownload_LimitsPeers(t *testing.T) {
+	saved := maxPeers
+	maxPeers = 1
+	t.Cleanup(func() { maxPeers = saved })
+
+	tor, data, st := seedTorrent(t)
+	leech := *tor
+	leech.Peers = types.HashSet[string]{}
+	var seeds []*Stats
+	for range 2 {
+		stats := NewStats(0)
+		u := NewUploader(tor, st, stats, DefaultUploadSlots)
+		for i := range tor.Pieces {
+			u.SetHave(i)
+		}
+		leech.Peers[startListener(t, u).Addr().String()] = struct{}{}
+		seeds = append(seeds, stats)
+	}
+
+	t.Chdir(t.TempDir())
+	if err := Download(&leech, nil, DefaultUploadSlots); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if got, err := os.ReadFile(tor.Name); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded file differs from the seed (%v)", err)
+	}
+
+	used := 0
+	for _, stats := range seeds {
+		if stats.Uploaded.Load() > 0 {
+			used++
+		}
+	}
+	if used != 1 {
+		t.Errorf("downloaded from %d seeds, want 1", used)
+	}
+}
+
+func TestPeerWorker_TakesLateBitfield(t *testing.T) {
+	local, remote := fastPipe(t, false)
+	local.NumPieces = 1
+	local.Choked = false
+
+	queue := &workQueue{items: []pieceWork{{index: 0, length: BlockSize}}}
+	var alive, remaining atomic.Int64
+	alive.Add(1)
+	remaining.Add(1)
+	go peerWorker(local, queue, make(chan pieceResult, 1), nil, &alive, &remaining)
+
+	// The peer had no pieces when the worker started; its bitfield must
+	// not be dropped while the worker waits.
+	if err := remote.SendMsg(MsgBitfield, []byte{0x80}); err != nil {
+		t.Fatalf("SendMsg: %v", err)
+	}
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	req, err := parseBlock(readUntil(t, remote, MsgRequest).Payload)
+	if err != nil || req.index != 0 {
+		t.Errorf("request = %+v, %v; want piece 0", req, err)
+	}
+}
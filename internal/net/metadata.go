@@ -0,0 +1,329 @@
+package net
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"kbit/internal/bencode"
+	"kbit/internal/logger"
+)
+
+const (
+	// MetadataPieceSize is the size of every ut_metadata piece but the last.
+	MetadataPieceSize = 16 * 1024
+
+	maxMetadataSize  = 8 << 20
+	maxMetadataPeers = 5
+)
+
+// ut_metadata message types (BEP 9).
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// metadataTimeout bounds every read while fetching metadata from a peer.
+var metadataTimeout = 10 * time.Second
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// metadataFetch collects the pieces of an info dictionary from several peers
+// at once. The first peer to report a size fixes it; every piece is handed
+// to one peer at a time and given back if that peer fails.
+type metadataFetch struct {
+	infoHash []byte
+
+	mu      sync.Mutex
+	size    int
+	pieces  [][]byte
+	pending []int
+	missing int
+	done    chan struct{}
+}
+
+// FetchMetadata downloads the info dictionary of the torrent with the given
+// infohash using the ut_metadata extension (BEP 9). Up to maxMetadataPeers
+// peers are asked at once and the pieces are spread among them. The
+// dictionary is returned only if its SHA-1 matches infoHash.
+func FetchMetadata(infoHash []byte, peers []string) ([]byte, error) {
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers to fetch metadata from")
+	}
+
+	f := &metadataFetch{infoHash: infoHash, done: make(chan struct{})}
+
+	sem := make(chan struct{}, maxMetadataPeers)
+	var wg sync.WaitGroup
+
+loop:
+	for _, addr := range peers {
+		select {
+		case <-f.done:
+			break loop
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := f.fetchFrom(addr); err != nil {
+				logger.Log.Warn("metadata fetch failed",
+					slog.String("peer", addr),
+					slog.String("error", err.Error()),
+				)
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	select {
+	case <-f.done:
+	default:
+		return nil, fmt.Errorf("metadata incomplete: no peer could provide the remaining pieces")
+	}
+
+	metadata := bytes.Join(f.pieces, nil)
+	hash := sha1.Sum(metadata)
+	if !bytes.Equal(hash[:], infoHash) {
+		return nil, fmt.Errorf("metadata hash mismatch: expected %x, got %x", infoHash, hash)
+	}
+
+	logger.Log.Info("metadata fetched",
+		slog.String("infohash", fmt.Sprintf("%x", infoHash)),
+		slog.Int("size", len(metadata)),
+	)
+	return metadata, nil
+}
+
+// MetadataExtension implements ut_metadata (BEP 9). When it has the info
+// dictionary it serves it to peers; during a fetch it collects the pieces
+// peers send.
+type MetadataExtension struct {
+	info  []byte
+	fetch *metadataFetch
+}
+
+// NewMetadataExtension returns a ut_metadata handler serving info, which
+// may be nil when the metadata is not known yet.
+func NewMetadataExtension(info []byte) *MetadataExtension {
+	return &MetadataExtension{info: info}
+}
+
+func (m *MetadataExtension) Name() string {
+	return "ut_metadata"
+}
+
+func (m *MetadataExtension) ExtendHandshake(pc *PeerConn, hs *ExtendedHandshake) {
+	if m.info != nil {
+		hs.MetadataSize = len(m.info)
+	}
+}
+
+func (m *MetadataExtension) HandleMessage(pc *PeerConn, payload []byte) error {
+	// The data of a piece follows the bencoded dict in the same message.
+	var msg metadataMsg
+	dec := bencode.NewDecoder(bytes.NewReader(payload))
+	dec.SetOptions(bencode.HardenedOptions)
+	if err := dec.DecodeInto(&msg); err != nil {
+		return fmt.Errorf("decoding metadata message: %w", err)
+	}
+
+	switch msg.MsgType {
+	case metadataRequest:
+		return m.serve(pc, msg.Piece)
+	case metadataData:
+		if m.fetch == nil {
+			return nil
+		}
+		return m.fetch.put(msg.Piece, payload[dec.Offset():])
+	case metadataReject:
+		return fmt.Errorf("peer rejected metadata piece %d", msg.Piece)
+	}
+	return nil
+}
+
+func (m *MetadataExtension) serve(pc *PeerConn, piece int) error {
+	start := piece * MetadataPieceSize
+	if m.info == nil || piece < 0 || start >= len(m.info) {
+		reply, err := bencode.Marshal(metadataMsg{MsgType: metadataReject, Piece: piece})
+		if err != nil {
+			return err
+		}
+		return pc.SendExtended(m.Name(), reply)
+	}
+
+	end := min(start+MetadataPieceSize, len(m.info))
+	reply, err := bencode.Marshal(metadataMsg{MsgType: metadataData, Piece: piece, TotalSize: len(m.info)})
+	if err != nil {
+		return err
+	}
+	return pc.SendExtended(m.Name(), append(reply, m.info[start:end]...))
+}
+
+func (f *metadataFetch) fetchFrom(addr string) error {
+	pc, err := DialPeer(addr, f.infoHash)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	if !pc.Reserved.SupportsExtensions() {
+		return fmt.Errorf("peer does not support the extension protocol")
+	}
+
+	ext, err := NewExtensions(&MetadataExtension{fetch: f})
+	if err != nil {
+		return err
+	}
+	pc.UseExtensions(ext)
+
+	pc.SetDeadline(time.Now().Add(metadataTimeout))
+	if err := pc.SendExtHandshake(); err != nil {
+		return fmt.Errorf("sending extended handshake: %w", err)
+	}
+	for pc.PeerExtHandshake() == nil {
+		if _, err := pc.ReadMsg(); err != nil {
+			return err
+		}
+	}
+
+	if !pc.PeerSupports("ut_metadata") {
+		return fmt.Errorf("peer does not support ut_metadata")
+	}
+	if err := f.init(pc.PeerExtHandshake().MetadataSize); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-f.done:
+			return nil
+		default:
+		}
+
+		piece, ok := f.next()
+		if !ok {
+			// Every remaining piece is with another peer; wait in case
+			// one of them gives up.
+			select {
+			case <-f.done:
+				return nil
+			case <-time.After(100 * time.Millisecond):
+			}
+			continue
+		}
+
+		if err := f.requestPiece(pc, piece); err != nil {
+			f.release(piece)
+			return err
+		}
+	}
+}
+
+// requestPiece asks pc for one piece and reads messages until it arrives;
+// the MetadataExtension handler stores it as ReadMsg dispatches it.
+func (f *metadataFetch) requestPiece(pc *PeerConn, piece int) error {
+	req, err := bencode.Marshal(metadataMsg{MsgType: metadataRequest, Piece: piece})
+	if err != nil {
+		return err
+	}
+
+	pc.SetDeadline(time.Now().Add(metadataTimeout))
+	if err := pc.SendExtended("ut_metadata", req); err != nil {
+		return fmt.Errorf("sending metadata request: %w", err)
+	}
+
+	for !f.has(piece) {
+		if _, err := pc.ReadMsg(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *metadataFetch) init(size int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size != 0 {
+		if size != f.size {
+			return fmt.Errorf("peer reports metadata size %d, others reported %d", size, f.size)
+		}
+		return nil
+	}
+	if size <= 0 || size > maxMetadataSize {
+		return fmt.Errorf("invalid metadata size %d", size)
+	}
+
+	n := (size + MetadataPieceSize - 1) / MetadataPieceSize
+	f.size = size
+	f.pieces = make([][]byte, n)
+	f.missing = n
+	for i := range n {
+		f.pending = append(f.pending, i)
+	}
+	return nil
+}
+
+func (f *metadataFetch) next() (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.pending) == 0 {
+		return 0, false
+	}
+	piece := f.pending[0]
+	f.pending = f.pending[1:]
+	return piece, true
+}
+
+func (f *metadataFetch) release(piece int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pieces[piece] == nil {
+		f.pending = append(f.pending, piece)
+	}
+}
+
+func (f *metadataFetch) put(piece int, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if piece < 0 || piece >= len(f.pieces) {
+		return fmt.Errorf("metadata piece %d out of range", piece)
+	}
+	if want := f.pieceLenLocked(piece); len(data) != want {
+		return fmt.Errorf("metadata piece %d has %d bytes, expected %d", piece, len(data), want)
+	}
+	if f.pieces[piece] != nil {
+		return nil
+	}
+	f.pieces[piece] = append([]byte(nil), data...)
+	f.missing--
+	if f.missing == 0 {
+		close(f.done)
+	}
+	return nil
+}
+
+func (f *metadataFetch) has(piece int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pieces[piece] != nil
+}
+
+func (f *metadataFetch) pieceLenLocked(piece int) int {
+	if piece == len(f.pieces)-1 {
+		return f.size - piece*MetadataPieceSize
+	}
+	return MetadataPieceSize
+}
@@ -0,0 +1,192 @@
+package net
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"kbit/internal/bencode"
+)
+
+type metadataPeerMode int
+
+const (
+	servePieces metadataPeerMode = iota
+	rejectPieces
+	corruptPieces
+	noMetadataExtension
+)
+
+// startMetadataPeer starts a local peer that answers the extended handshake
+// and serves metadata over ut_metadata according to mode. It accepts
+// connections until the test ends.
+func startMetadataPeer(t *testing.T, metadata []byte, mode metadataPeerMode) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	infoHash := sha1.Sum(metadata)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveMetadata(conn, infoHash[:], metadata, mode)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func serveMetadata(conn net.Conn, infoHash, metadata []byte, mode metadataPeerMode) {
+	defer conn.Close()
+
+	buf := make([]byte, 68)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	resp := buildHandshakeResponse(infoHash)
+	resp[25] |= 0x10
+	conn.Write(resp) //nolint:errcheck
+
+	var handlers []ExtensionHandler
+	switch mode {
+	case servePieces:
+		handlers = append(handlers, NewMetadataExtension(metadata))
+	case corruptPieces:
+		handlers = append(handlers, NewMetadataExtension(bytes.Repeat([]byte{0xff}, len(metadata))))
+	case rejectPieces:
+		handlers = append(handlers, rejectingMetadata{size: len(metadata)})
+	}
+	ext, _ := NewExtensions(handlers...)
+
+	pc := NewPeerConn(conn, "client")
+	pc.UseExtensions(ext)
+	if err := pc.SendExtHandshake(); err != nil {
+		return
+	}
+	for {
+		if _, err := pc.ReadMsg(); err != nil {
+			return
+		}
+	}
+}
+
+// rejectingMetadata advertises metadata but rejects every request.
+type rejectingMetadata struct {
+	size int
+}
+
+func (r rejectingMetadata) Name() string { return "ut_metadata" }
+
+func (r rejectingMetadata) ExtendHandshake(pc *PeerConn, hs *ExtendedHandshake) {
+	hs.MetadataSize = r.size
+}
+
+func (r rejectingMetadata) HandleMessage(pc *PeerConn, payload []byte) error {
+	var req metadataMsg
+	if err := bencode.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+	reply, _ := bencode.Marshal(metadataMsg{MsgType: metadataReject, Piece: req.Piece})
+	return pc.SendExtended("ut_metadata", reply)
+}
+
+func testMetadata(size int) []byte {
+	metadata := make([]byte, size)
+	for i := range metadata {
+		metadata[i] = byte(i * 7)
+	}
+	return metadata
+}
+
+func TestFetchMetadata_SeveralPeers(t *testing.T) {
+	PeerID = []byte("-GT0001-LOCALPEERID-")
+	metadata := testMetadata(3*MetadataPieceSize + 123)
+	hash := sha1.Sum(metadata)
+
+	peers := []string{
+		startMetadataPeer(t, metadata, servePieces),
+		startMetadataPeer(t, metadata, rejectPieces),
+		startMetadataPeer(t, metadata, servePieces),
+	}
+
+	got, err := FetchMetadata(hash[:], peers)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(got, metadata) {
+		t.Error("fetched metadata does not match")
+	}
+}
+
+func TestFetchMetadata_HashMismatch(t *testing.T) {
+	PeerID = []byte("-GT0001-LOCALPEERID-")
+	metadata := testMetadata(MetadataPieceSize + 1)
+	hash := sha1.Sum(metadata)
+
+	addr := startMetadataPeer(t, metadata, corruptPieces)
+	_, err := FetchMetadata(hash[:], []string{addr})
+	if err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Errorf("expected hash mismatch error, got: %v", err)
+	}
+}
+
+func TestFetchMetadata_NoCapablePeers(t *testing.T) {
+	PeerID = []byte("-GT0001-LOCALPEERID-")
+	metadata := testMetadata(100)
+	hash := sha1.Sum(metadata)
+
+	peers := []string{
+		startMetadataPeer(t, metadata, noMetadataExtension),
+		startMetadataPeer(t, metadata, rejectPieces),
+	}
+	if _, err := FetchMetadata(hash[:], peers); err == nil {
+		t.Error("expected error when no peer serves metadata")
+	}
+	if _, err := FetchMetadata(hash[:], nil); err == nil {
+		t.Error("expected error without peers")
+	}
+}
+
+func TestHandshake_SetsExtensionBit(t *testing.T) {
+	PeerID = []byte("-GT0001-LOCALPEERID-")
+	infoHash := []byte("01234567890123456789")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer ln.Close()
+
+	reserved := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 68)
+		io.ReadFull(conn, buf) //nolint:errcheck
+		reserved <- buf[20:28]
+		conn.Write(buildHandshakeResponse(infoHash)) //nolint:errcheck
+	}()
+
+	conn, err := Handshake(ln.Addr().String(), infoHash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conn.Close()
+
+	if got := <-reserved; binary.BigEndian.Uint64(got) != 0x100004 {
+		t.Errorf("expected the extension and fast bits in reserved bytes, got %x", got)
+	}
+}
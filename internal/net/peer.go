@@ -20,6 +20,10 @@ const (
 	MsgCancel        uint8 = 8
 
 	BlockSize = 16 * 1024
+
+	// maxUnknownLength bounds messages of types we do not know, like the
+	// DHT port message, which are read and ignored.
+	maxUnknownLength = 1024
 )
 
 type PeerMsg struct {
@@ -31,10 +35,25 @@ type PeerConn struct {
 	conn     net.Conn
 	Addr     string
 	Bitfield []byte
+	Reserved Reserved // from the peer's handshake
+	PeerID   []byte
+
+	// NumPieces is the torrent's piece count, or 0 while it is unknown, as
+	// when fetching metadata. Piece indices the peer sends are checked
+	// against it.
+	NumPieces int
+
+	// Kept up to date by ReadMsg.
+	Choked      bool         // whether the peer chokes us
+	AllowedFast map[int]bool // pieces we may request while choked (BEP 6)
+	Suggested   []int        // pieces the peer suggested we download (BEP 6)
+	haveAll     bool         // the peer sent HaveAll
+
+	ext *extState // nil unless UseExtensions was called
 }
 
 func NewPeerConn(conn net.Conn, addr string) *PeerConn {
-	return &PeerConn{conn: conn, Addr: addr}
+	return &PeerConn{conn: conn, Addr: addr, Choked: true}
 }
 
 func (p *PeerConn) SendMsg(id uint8, payload []byte) error {
@@ -58,11 +77,70 @@ func (p *PeerConn) ReadMsg() (*PeerMsg, error) {
 		return nil, nil
 	}
 
-	msgBuf := make([]byte, length)
-	if _, err := io.ReadFull(p.conn, msgBuf); err != nil {
+	// The length comes from the peer; check it against the message type
+	// before allocating anything.
+	var id [1]byte
+	if _, err := io.ReadFull(p.conn, id[:]); err != nil {
+		return nil, fmt.Errorf("reading message id: %w", err)
+	}
+	if limit := p.maxLength(id[0]); length > limit {
+		return nil, fmt.Errorf("message %d is %d bytes long, more than the %d allowed", id[0], length, limit)
+	}
+
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(p.conn, payload); err != nil {
 		return nil, fmt.Errorf("reading message body: %w", err)
 	}
-	return &PeerMsg{ID: msgBuf[0], Payload: msgBuf[1:]}, nil
+	msg := &PeerMsg{ID: id[0], Payload: payload}
+	switch msg.ID {
+	case MsgChoke:
+		p.Choked = true
+	case MsgUnchoke:
+		p.Choked = false
+	case MsgHave:
+		if len(msg.Payload) == 4 {
+			if err := p.setPiece(int(binary.BigEndian.Uint32(msg.Payload))); err != nil {
+				return nil, err
+			}
+		}
+	case MsgSuggest, MsgHaveAll, MsgHaveNone, MsgReject, MsgAllowedFast:
+		if err := p.handleFast(msg); err != nil {
+			return nil, err
+		}
+	case MsgExtended:
+		if p.ext != nil {
+			if err := p.handleExtended(msg.Payload); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return msg, nil
+}
+
+// maxLength returns the longest message with the given ID that ReadMsg
+// accepts, counting the ID.
+func (p *PeerConn) maxLength(id uint8) uint32 {
+	switch id {
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+		return 1
+	case MsgHave, MsgSuggest, MsgAllowedFast:
+		return 5
+	case MsgRequest, MsgCancel, MsgReject:
+		return 13
+	case MsgPiece:
+		return 9 + BlockSize
+	case MsgBitfield:
+		numPieces := p.NumPieces
+		if numPieces == 0 {
+			// As many pieces as the largest metadata we accept can hash.
+			numPieces = maxMetadataSize / 20
+		}
+		return 1 + uint32(numPieces+7)/8
+	case MsgExtended:
+		return 1 + maxExtendedLength
+	default:
+		return maxUnknownLength
+	}
 }
 
 func (p *PeerConn) SetDeadline(t time.Time) error {
@@ -74,6 +152,9 @@ func (p *PeerConn) Close() error {
 }
 
 func (p *PeerConn) HasPiece(i int) bool {
+	if p.haveAll {
+		return true
+	}
 	byteIdx := i / 8
 	bitIdx := 7 - (i % 8)
 	if byteIdx >= len(p.Bitfield) {
@@ -82,6 +163,32 @@ func (p *PeerConn) HasPiece(i int) bool {
 	return p.Bitfield[byteIdx]>>uint(bitIdx)&1 == 1
 }
 
+// setPiece records that the peer has piece i, growing the bitfield to the
+// torrent's size if it is shorter. Nothing is recorded while the piece
+// count is unknown.
+func (p *PeerConn) setPiece(i int) error {
+	if err := p.checkPiece(i); err != nil {
+		return err
+	}
+	if p.NumPieces == 0 || p.haveAll {
+		return nil
+	}
+	if n := (p.NumPieces + 7) / 8; len(p.Bitfield) < n {
+		p.Bitfield = append(p.Bitfield, make([]byte, n-len(p.Bitfield))...)
+	}
+	p.Bitfield[i/8] |= 0x80 >> (i % 8)
+	return nil
+}
+
+// checkPiece fails for a piece index the peer sent that is outside the
+// torrent.
+func (p *PeerConn) checkPiece(i int) error {
+	if i < 0 || (p.NumPieces > 0 && i >= p.NumPieces) {
+		return fmt.Errorf("piece index %d out of range (%d pieces)", i, p.NumPieces)
+	}
+	return nil
+}
+
 func buildRequestPayload(index, begin, length int) []byte {
 	payload := make([]byte, 12)
 	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
@@ -0,0 +1,44 @@
+package net
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestReadMsg_LimitsLength(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		id     uint8
+		length uint32 // counting the ID
+		ok     bool
+	}{
+		{"block", MsgPiece, 9 + BlockSize, true},
+		{"oversized block", MsgPiece, 10 + BlockSize, false},
+		{"bitfield", MsgBitfield, 4, true},
+		{"oversized bitfield", MsgBitfield, 5, false},
+		{"oversized have", MsgHave, 6, false},
+		{"oversized extended", MsgExtended, 2 + maxExtendedLength, false},
+		{"4 GiB request", MsgRequest, 0xFFFFFFFF, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			local, remote := fastPipe(t, false)
+			local.NumPieces = 20 // a bitfield of 3 bytes
+
+			go func() {
+				header := binary.BigEndian.AppendUint32(nil, tc.length)
+				remote.conn.Write(append(header, tc.id))
+				if tc.ok {
+					remote.conn.Write(make([]byte, tc.length-1))
+				}
+			}()
+
+			_, err := local.ReadMsg()
+			if tc.ok && err != nil {
+				t.Errorf("ReadMsg: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("expected the message to be refused")
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package net
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"kbit/internal/logger"
+	"kbit/pkg/types"
+)
+
+// PeerSource finds peers for a torrent: its trackers, and later the DHT
+// or the local network. Parsing a torrent never touches the network;
+// sessions ask their sources explicitly. A source may return peers along
+// with an error, such as a DHT lookup whose announce went unanswered; the
+// peers are kept either way.
+type PeerSource interface {
+	Name() string
+	FindPeers(ctx context.Context, t *types.TorrentFile) ([]string, error)
+}
+
+// PeerWatcher is a PeerSource that also learns of peers on its own, like
+// the local network where peers announce themselves.
+type PeerWatcher interface {
+	PeerSource
+	// WatchPeers calls found with every peer of t it learns of until ctx
+	// is done. It returns at once.
+	WatchPeers(ctx context.Context, t *types.TorrentFile, found func(addr string))
+}
+
+// TrackerSource asks the trackers of a torrent once.
+var TrackerSource PeerSource = trackerSource{}
+
+// DefaultPeerSources are the sources DiscoverPeers asks when given none.
+var DefaultPeerSources = []PeerSource{TrackerSource}
+
+// DiscoverPeers asks every source for peers of torrent at once and adds
+// what they find to torrent.Peers, keeping the peers already there. A
+// source that fails is logged; an unreachable swarm is not an error, it
+// just leaves no new peers.
+func DiscoverPeers(torrent *types.TorrentFile, sources ...PeerSource) error {
+	if len(sources) == 0 {
+		sources = DefaultPeerSources
+	}
+	if torrent.Peers == nil {
+		torrent.Peers = make(types.HashSet[string])
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, src := range sources {
+		wg.Add(1)
+		go func(src PeerSource) {
+			defer wg.Done()
+
+			peers, err := src.FindPeers(context.Background(), torrent)
+			mu.Lock()
+			for _, p := range peers {
+				torrent.Peers[p] = struct{}{}
+			}
+			mu.Unlock()
+			if err != nil {
+				logger.Log.Warn("peer source failed",
+					slog.String("source", src.Name()),
+					slog.String("error", err.Error()),
+				)
+				if len(peers) == 0 {
+					return
+				}
+			}
+			logger.Log.Info("peers found",
+				slog.String("source", src.Name()),
+				slog.Int("count", len(peers)),
+			)
+		}(src)
+	}
+	wg.Wait()
+	return nil
+}
+
+// feedPool asks every source for peers in the background and adds what
+// they find to pool. It returns at once.
+func feedPool(ctx context.Context, t *types.TorrentFile, pool *PeerPool, sources []PeerSource) {
+	for _, src := range sources {
+		go func(src PeerSource) {
+			peers, err := src.FindPeers(ctx, t)
+			added := pool.Add(peers...)
+			if err != nil {
+				logger.Log.Warn("peer source failed",
+					slog.String("source", src.Name()),
+					slog.String("error", err.Error()),
+				)
+				if len(peers) == 0 {
+					return
+				}
+			}
+			logger.Log.Info("peers found",
+				slog.String("source", src.Name()),
+				slog.Int("count", len(peers)),
+				slog.Int("new", added),
+			)
+		}(src)
+	}
+}
+
+// watchPool adds the peers every PeerWatcher among sources learns of to
+// pool until ctx is done.
+func watchPool(ctx context.Context, t *types.TorrentFile, pool *PeerPool, sources []PeerSource) {
+	for _, src := range sources {
+		if w, ok := src.(PeerWatcher); ok {
+			w.WatchPeers(ctx, t, func(addr string) { pool.Add(addr) })
+		}
+	}
+}
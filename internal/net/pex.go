@@ -0,0 +1,230 @@
+package net
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"kbit/internal/bencode"
+	"kbit/internal/logger"
+)
+
+const (
+	// pexInterval is the least time between two PEX messages to one peer.
+	pexInterval = time.Minute
+
+	// pexMaxPeers caps the added and dropped lists of one message, sent or
+	// received.
+	pexMaxPeers = 50
+
+	// pexMinReceiveInterval is the least time between two PEX messages
+	// taken from one peer; sooner ones are ignored. Peers send one a
+	// minute, so this leaves room for their timers.
+	pexMinReceiveInterval = 45 * time.Second
+
+	// pexFlagReachable marks a peer we reached with an outgoing connection.
+	pexFlagReachable = 0x10
+)
+
+// pexMsg is a ut_pex message (BEP 11) as we send it. The peer lists are
+// compact: 6 bytes per IPv4 peer and 18 per IPv6 peer, with one flag byte
+// per added peer in the .f lists.
+type pexMsg struct {
+	Added    []byte `bencode:"added,omitempty"`
+	AddedF   []byte `bencode:"added.f,omitempty"`
+	Added6   []byte `bencode:"added6,omitempty"`
+	Added6F  []byte `bencode:"added6.f,omitempty"`
+	Dropped  []byte `bencode:"dropped,omitempty"`
+	Dropped6 []byte `bencode:"dropped6,omitempty"`
+}
+
+// pexReceived is the part of a received ut_pex message we use: the added
+// peers go into the pool, and nothing needs their flags or the dropped
+// peers.
+type pexReceived struct {
+	Added  []byte `bencode:"added,omitempty"`
+	Added6 []byte `bencode:"added6,omitempty"`
+}
+
+// PEXExtension implements ut_pex: peers that connected peers tell us
+// about go into the pool, and every connection is told, at most once a
+// minute, which peers we connected to or dropped since the last message.
+// Received messages are limited the same way: one a minute per peer, with
+// at most 50 added peers. It must not be registered for private torrents.
+type PEXExtension struct {
+	pool *PeerPool
+	now  func() time.Time // replaced in tests
+
+	mu        sync.Mutex
+	connected map[string]struct{}
+	sent      map[*PeerConn]*pexSent
+	received  map[*PeerConn]time.Time // when each peer's last message was taken
+}
+
+// pexSent is what one connection was last told.
+type pexSent struct {
+	at    time.Time
+	peers map[string]struct{}
+}
+
+func NewPEXExtension(pool *PeerPool) *PEXExtension {
+	return &PEXExtension{
+		pool:      pool,
+		now:       time.Now,
+		connected: make(map[string]struct{}),
+		sent:      make(map[*PeerConn]*pexSent),
+		received:  make(map[*PeerConn]time.Time),
+	}
+}
+
+func (x *PEXExtension) Name() string { return "ut_pex" }
+
+func (x *PEXExtension) HandleMessage(pc *PeerConn, payload []byte) error {
+	var m pexReceived
+	dec := bencode.NewDecoder(bytes.NewReader(payload))
+	dec.SetOptions(bencode.HardenedOptions)
+	if err := dec.DecodeInto(&m); err != nil {
+		return fmt.Errorf("decoding ut_pex message: %w", err)
+	}
+
+	x.mu.Lock()
+	last, ok := x.received[pc]
+	if ok && x.now().Sub(last) < pexMinReceiveInterval {
+		x.mu.Unlock()
+		logger.Log.Debug("pex message too soon; ignored", slog.String("peer", pc.Addr))
+		return nil
+	}
+	x.received[pc] = x.now()
+	x.mu.Unlock()
+
+	// Only the first pexMaxPeers entries of each list are read; longer
+	// lists are cut rather than decoded in full.
+	added := parseCompactPeers(m.Added[:min(len(m.Added), pexMaxPeers*6)])
+	added6 := parseCompactPeers6(m.Added6[:min(len(m.Added6), pexMaxPeers*18)])
+	added = append(added, added6...)
+	if len(added) > pexMaxPeers {
+		added = added[:pexMaxPeers]
+	}
+
+	n := x.pool.Add(added...)
+	logger.Log.Debug("pex received",
+		slog.String("peer", pc.Addr),
+		slog.Int("added", len(added)),
+		slog.Int("new", n),
+	)
+	return nil
+}
+
+// Connected records that pc is a live connection, to be advertised to the
+// other peers.
+func (x *PEXExtension) Connected(pc *PeerConn) {
+	x.mu.Lock()
+	x.connected[pc.Addr] = struct{}{}
+	x.mu.Unlock()
+}
+
+// Disconnected records that pc is gone; it is listed as dropped in the
+// next messages.
+func (x *PEXExtension) Disconnected(pc *PeerConn) {
+	x.mu.Lock()
+	delete(x.connected, pc.Addr)
+	delete(x.sent, pc)
+	delete(x.received, pc)
+	x.mu.Unlock()
+}
+
+// SendUpdate sends pc the peers connected or dropped since its last PEX
+// message. It does nothing when the peer does not support ut_pex, when
+// the last message was sent less than a minute ago, or when nothing
+// changed.
+func (x *PEXExtension) SendUpdate(pc *PeerConn) error {
+	if !pc.PeerSupports(x.Name()) {
+		return nil
+	}
+
+	x.mu.Lock()
+	last := x.sent[pc]
+	if last != nil && x.now().Sub(last.at) < pexInterval {
+		x.mu.Unlock()
+		return nil
+	}
+	if last == nil {
+		last = &pexSent{peers: make(map[string]struct{})}
+	}
+
+	var added, dropped []string
+	for addr := range x.connected {
+		if _, ok := last.peers[addr]; !ok && addr != pc.Addr && len(added) < pexMaxPeers {
+			added = append(added, addr)
+		}
+	}
+	for addr := range last.peers {
+		if _, ok := x.connected[addr]; !ok && len(dropped) < pexMaxPeers {
+			dropped = append(dropped, addr)
+		}
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		x.mu.Unlock()
+		return nil
+	}
+
+	next := &pexSent{at: x.now(), peers: make(map[string]struct{}, len(last.peers)+len(added))}
+	for addr := range last.peers {
+		next.peers[addr] = struct{}{}
+	}
+	for _, addr := range added {
+		next.peers[addr] = struct{}{}
+	}
+	for _, addr := range dropped {
+		delete(next.peers, addr)
+	}
+	x.sent[pc] = next
+	x.mu.Unlock()
+
+	payload, err := bencode.Marshal(encodePEX(added, dropped))
+	if err != nil {
+		return err
+	}
+	return pc.SendExtended(x.Name(), payload)
+}
+
+// encodePEX builds a message from peer addresses, splitting them by
+// address family. Addresses that are not ip:port, like host names, are
+// left out.
+func encodePEX(added, dropped []string) *pexMsg {
+	m := &pexMsg{}
+	for _, a := range added {
+		addr, err := netip.ParseAddrPort(a)
+		if err != nil {
+			continue
+		}
+		if addr.Addr().Unmap().Is4() {
+			m.Added = appendCompact(m.Added, addr)
+			m.AddedF = append(m.AddedF, pexFlagReachable)
+		} else {
+			m.Added6 = appendCompact(m.Added6, addr)
+			m.Added6F = append(m.Added6F, pexFlagReachable)
+		}
+	}
+	for _, a := range dropped {
+		addr, err := netip.ParseAddrPort(a)
+		if err != nil {
+			continue
+		}
+		if addr.Addr().Unmap().Is4() {
+			m.Dropped = appendCompact(m.Dropped, addr)
+		} else {
+			m.Dropped6 = appendCompact(m.Dropped6, addr)
+		}
+	}
+	return m
+}
+
+func appendCompact(b []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	b = append(b, ip.AsSlice()...)
+	return append(b, byte(addr.Port()>>8), byte(addr.Port()))
+}
@@ -0,0 +1,193 @@
+package net
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"kbit/internal/bencode"
+	"kbit/pkg/types"
+)
+
+// exchangeExtHandshakes sends both extended handshakes and reads them.
+func exchangeExtHandshakes(t *testing.T, a, b *PeerConn) {
+	t.Helper()
+	for _, pc := range []*PeerConn{a, b} {
+		if err := pc.SendExtHandshake(); err != nil {
+			t.Fatalf("SendExtHandshake failed: %v", err)
+		}
+	}
+	for _, pc := range []*PeerConn{a, b} {
+		for pc.PeerExtHandshake() == nil {
+			if _, err := pc.ReadMsg(); err != nil {
+				t.Fatalf("reading extended handshake: %v", err)
+			}
+		}
+	}
+}
+
+// readPEX reads messages on pc until h receives one and decodes it.
+func readPEX(t *testing.T, pc *PeerConn, h *recordingHandler) pexMsg {
+	t.Helper()
+	for {
+		select {
+		case payload := <-h.got:
+			var m pexMsg
+			if err := bencode.Unmarshal(payload, &m); err != nil {
+				t.Fatalf("decoding pex message: %v", err)
+			}
+			return m
+		default:
+		}
+		if _, err := pc.ReadMsg(); err != nil {
+			t.Fatalf("reading pex message: %v", err)
+		}
+	}
+}
+
+func TestPEX_AddsPeersToPool(t *testing.T) {
+	pool := NewPeerPool("10.0.0.1:6881")
+	x := NewPEXExtension(pool)
+
+	v4 := encodePEX([]string{"10.0.0.1:6881", "10.0.0.2:51413"}, nil)
+	v6 := encodePEX([]string{"[2001:db8::1]:6881"}, nil)
+	payload, err := bencode.Marshal(&pexMsg{
+		Added:   v4.Added,
+		AddedF:  v4.AddedF,
+		Added6:  v6.Added6,
+		Added6F: v6.Added6F,
+		Dropped: encodePEX(nil, []string{"10.0.0.9:6881"}).Dropped,
+	})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	if err := x.HandleMessage(&PeerConn{Addr: "peer"}, payload); err != nil {
+		t.Fatalf("HandleMessage failed: %v", err)
+	}
+	want := []string{"10.0.0.1:6881", "10.0.0.2:51413", "[2001:db8::1]:6881"}
+	got := pool.Peers()
+	if len(got) != len(want) {
+		t.Fatalf("pool = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("pool[%d] = %s, want %s", i, got[i], want[i])
+		}
+	}
+
+	if err := x.HandleMessage(&PeerConn{Addr: "peer"}, []byte("d5:added")); err == nil {
+		t.Error("expected an error for a truncated message")
+	}
+}
+
+func TestPEX_LimitsReceivedMessages(t *testing.T) {
+	pool := NewPeerPool()
+	x := NewPEXExtension(pool)
+	now := time.Now()
+	x.now = func() time.Time { return now }
+	pc := &PeerConn{Addr: "peer"}
+
+	message := func(first, count int) []byte {
+		var m pexMsg
+		for i := range count {
+			addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 1, byte(first + i), 1}), 6881)
+			m.Added = appendCompact(m.Added, addr)
+		}
+		payload, err := bencode.Marshal(&m)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		return payload
+	}
+
+	// Past 50 added peers, the rest of a message is ignored.
+	if err := x.HandleMessage(pc, message(0, 80)); err != nil {
+		t.Fatalf("HandleMessage failed: %v", err)
+	}
+	if got := pool.Len(); got != pexMaxPeers {
+		t.Fatalf("pool has %d peers, want %d", got, pexMaxPeers)
+	}
+
+	// A second message within the minute is ignored ...
+	now = now.Add(10 * time.Second)
+	x.HandleMessage(pc, message(100, 1))
+	if got := pool.Len(); got != pexMaxPeers {
+		t.Errorf("pool has %d peers after an early message, want %d", got, pexMaxPeers)
+	}
+
+	// ... and one a minute after the first is taken.
+	now = now.Add(50 * time.Second)
+	x.HandleMessage(pc, message(100, 1))
+	if got := pool.Len(); got != pexMaxPeers+1 {
+		t.Errorf("pool has %d peers, want %d", got, pexMaxPeers+1)
+	}
+}
+
+func TestPEX_SendUpdateIsRateLimited(t *testing.T) {
+	a, b := connPair(t)
+
+	x := NewPEXExtension(NewPeerPool())
+	now := time.Now()
+	x.now = func() time.Time { return now }
+	extA, _ := NewExtensions(x)
+	a.UseExtensions(extA)
+
+	got := &recordingHandler{name: "ut_pex", got: make(chan []byte, 4)}
+	extB, _ := NewExtensions(got)
+	b.UseExtensions(extB)
+
+	exchangeExtHandshakes(t, a, b)
+
+	first, second := &PeerConn{Addr: "10.0.0.1:6881"}, &PeerConn{Addr: "[2001:db8::2]:6881"}
+	x.Connected(a)
+	x.Connected(first)
+	if err := x.SendUpdate(a); err != nil {
+		t.Fatalf("SendUpdate failed: %v", err)
+	}
+	m := readPEX(t, b, got)
+	if !bytes.Equal(m.Added, encodePEX([]string{first.Addr}, nil).Added) || len(m.AddedF) != 1 {
+		t.Errorf("first message = %+v, want only %s added", m, first.Addr)
+	}
+
+	// Within the interval, changes are held back ...
+	x.Disconnected(first)
+	x.Connected(second)
+	if err := x.SendUpdate(a); err != nil {
+		t.Fatalf("SendUpdate failed: %v", err)
+	}
+
+	// ... and sent together once it has passed.
+	now = now.Add(pexInterval)
+	if err := x.SendUpdate(a); err != nil {
+		t.Fatalf("SendUpdate failed: %v", err)
+	}
+	m = readPEX(t, b, got)
+	want := encodePEX([]string{second.Addr}, []string{first.Addr})
+	if len(m.Added) != 0 || !bytes.Equal(m.Added6, want.Added6) || !bytes.Equal(m.Dropped, want.Dropped) {
+		t.Errorf("second message = %+v, want %s added and %s dropped", m, second.Addr, first.Addr)
+	}
+}
+
+func TestPEX_SkipsPeersWithoutSupport(t *testing.T) {
+	a, _ := connPair(t)
+	x := NewPEXExtension(NewPeerPool())
+	x.Connected(&PeerConn{Addr: "10.0.0.1:6881"})
+
+	if err := x.SendUpdate(a); err != nil {
+		t.Errorf("SendUpdate to a peer without extensions = %v, want nil", err)
+	}
+}
+
+func TestSessionExtensions_PrivateTorrentHasNoPEX(t *testing.T) {
+	ext, pex, err := sessionExtensions(&types.TorrentFile{Private: true}, NewPeerPool())
+	if err != nil || ext != nil || pex != nil {
+		t.Errorf("private torrent: extensions = %v, %v, %v; want none", ext, pex, err)
+	}
+
+	ext, pex, err = sessionExtensions(&types.TorrentFile{}, NewPeerPool())
+	if err != nil || pex == nil || ext == nil {
+		t.Fatalf("public torrent: extensions = %v, %v, %v; want ut_pex", ext, pex, err)
+	}
+}
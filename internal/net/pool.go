@@ -0,0 +1,67 @@
+package net
+
+import "sync"
+
+// PeerPool is the set of peer addresses known for a torrent. Trackers and
+// other peer sources add to it while a session runs; consumers wait on
+// Changed and pick up the new entries from Peers.
+type PeerPool struct {
+	mu      sync.Mutex
+	peers   map[string]struct{}
+	order   []string
+	changed chan struct{}
+}
+
+// NewPeerPool returns a pool holding addrs.
+func NewPeerPool(addrs ...string) *PeerPool {
+	p := &PeerPool{
+		peers:   make(map[string]struct{}),
+		changed: make(chan struct{}, 1),
+	}
+	p.Add(addrs...)
+	return p
+}
+
+// Add puts addrs into the pool and returns how many of them were new.
+// Consumers are woken only when something was added.
+func (p *PeerPool) Add(addrs ...string) int {
+	p.mu.Lock()
+	added := 0
+	for _, addr := range addrs {
+		if _, ok := p.peers[addr]; ok {
+			continue
+		}
+		p.peers[addr] = struct{}{}
+		p.order = append(p.order, addr)
+		added++
+	}
+	p.mu.Unlock()
+
+	if added > 0 {
+		select {
+		case p.changed <- struct{}{}:
+		default:
+		}
+	}
+	return added
+}
+
+// Peers returns the addresses in the order they were added.
+func (p *PeerPool) Peers() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.order...)
+}
+
+// Len returns the number of peers in the pool.
+func (p *PeerPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.order)
+}
+
+// Changed is signalled after peers are added. Several additions between
+// two receives collapse into one signal.
+func (p *PeerPool) Changed() <-chan struct{} {
+	return p.changed
+}
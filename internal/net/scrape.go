@@ -0,0 +1,130 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"kbit/internal/bencode"
+)
+
+// ErrScrapeUnsupported is returned for HTTP trackers whose announce URL
+// does not follow the convention scrape URLs are derived from.
+var ErrScrapeUnsupported = errors.New("tracker does not support scrape")
+
+// httpScrapeResponse is the bencoded body of an HTTP scrape response,
+// keyed by raw infohash.
+type httpScrapeResponse struct {
+	FailureReason string                    `bencode:"failure reason"`
+	Files         map[string]httpScrapeFile `bencode:"files"`
+}
+
+type httpScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+// Scrape asks tracker for the swarm statistics of each infohash, in the
+// same order. Infohashes the tracker does not know get zero counts.
+func Scrape(ctx context.Context, tracker string, infoHashes [][]byte) ([]ScrapeStats, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "udp":
+		stats := make([]ScrapeStats, 0, len(infoHashes))
+		for len(infoHashes) > 0 {
+			n := min(len(infoHashes), udpMaxScrape)
+			batch, err := udpScrape(ctx, u.Host, infoHashes[:n])
+			if err != nil {
+				return nil, err
+			}
+			stats = append(stats, batch...)
+			infoHashes = infoHashes[n:]
+		}
+		return stats, nil
+	case "http", "https":
+		return httpScrape(ctx, tracker, infoHashes)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+// ScrapeURL derives the scrape URL of an HTTP tracker from its announce
+// URL: the last path segment must start with "announce", which is
+// replaced by "scrape".
+func ScrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", fmt.Errorf("invalid tracker URL: %w", err)
+	}
+
+	i := strings.LastIndex(u.Path, "/")
+	last := u.Path[i+1:]
+	if !strings.HasPrefix(last, "announce") {
+		return "", fmt.Errorf("%s: %w", announce, ErrScrapeUnsupported)
+	}
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(last, "announce")
+	return u.String(), nil
+}
+
+func httpScrape(ctx context.Context, tracker string, infoHashes [][]byte) ([]ScrapeStats, error) {
+	scrapeURL, err := ScrapeURL(tracker)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(scrapeURL)
+	if err != nil {
+		return nil, err
+	}
+
+	params := u.Query()
+	for _, h := range infoHashes {
+		params.Add("info_hash", string(h))
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := readTrackerBody(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading scrape response: %w", err)
+	}
+
+	var raw httpScrapeResponse
+	dec := bencode.NewDecoder(bytes.NewReader(body))
+	dec.SetOptions(bencode.HardenedOptions)
+	if err := dec.DecodeInto(&raw); err != nil {
+		return nil, fmt.Errorf("malformed scrape response: %w", err)
+	}
+	if raw.FailureReason != "" {
+		return nil, &TrackerFailure{Reason: raw.FailureReason}
+	}
+
+	stats := make([]ScrapeStats, len(infoHashes))
+	for i, h := range infoHashes {
+		f := raw.Files[string(h)]
+		stats[i] = ScrapeStats{
+			Seeders:   f.Complete,
+			Completed: f.Downloaded,
+			Leechers:  f.Incomplete,
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,119 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kbit/internal/bencode"
+)
+
+func TestScrapeURL(t *testing.T) {
+	cases := []struct {
+		announce string
+		want     string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644"},
+	}
+	for _, c := range cases {
+		got, err := ScrapeURL(c.announce)
+		if err != nil {
+			t.Errorf("ScrapeURL(%q): %v", c.announce, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("ScrapeURL(%q) = %q, want %q", c.announce, got, c.want)
+		}
+	}
+
+	for _, announce := range []string{
+		"http://example.com/a",
+		"http://example.com/announce/x",
+		"http://example.com/x%064announce",
+	} {
+		if _, err := ScrapeURL(announce); !errors.Is(err, ErrScrapeUnsupported) {
+			t.Errorf("ScrapeURL(%q) error = %v, want ErrScrapeUnsupported", announce, err)
+		}
+	}
+}
+
+func TestScrape_HTTP(t *testing.T) {
+	known := []byte("aaaaaaaaaaaaaaaaaaaa")
+	unknown := []byte("bbbbbbbbbbbbbbbbbbbb")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			t.Errorf("request path = %q, want /scrape", r.URL.Path)
+		}
+		if got := r.URL.Query()["info_hash"]; len(got) != 2 {
+			t.Errorf("got %d info_hash parameters, want 2", len(got))
+		}
+		fmt.Fprintf(w, "d5:filesd20:%sd8:completei5e10:downloadedi50e10:incompletei10eeee", known)
+	}))
+	defer server.Close()
+
+	stats, err := Scrape(context.Background(), server.URL+"/announce", [][]byte{known, unknown})
+	if err != nil {
+		t.Fatalf("Scrape: %v", err)
+	}
+	want := []ScrapeStats{{Seeders: 5, Completed: 50, Leechers: 10}, {}}
+	if fmt.Sprint(stats) != fmt.Sprint(want) {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestScrape_HTTPFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "d14:failure reason9:forbiddene")
+	}))
+	defer server.Close()
+
+	_, err := Scrape(context.Background(), server.URL+"/announce", [][]byte{make([]byte, 20)})
+	var failure *TrackerFailure
+	if !errors.As(err, &failure) || failure.Reason != "forbidden" {
+		t.Errorf("error = %v, want tracker failure %q", err, "forbidden")
+	}
+}
+
+func TestScrape_HTTPRefusesHugeResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "d5:filesd")
+		w.Write(make([]byte, bencode.HardenedOptions.MaxSize))
+	}))
+	defer server.Close()
+
+	_, err := Scrape(context.Background(), server.URL+"/announce", [][]byte{make([]byte, 20)})
+	if err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("error = %v, want the response refused for its size", err)
+	}
+}
+
+func TestScrape_UDPSplitsLargeRequests(t *testing.T) {
+	s := startUDPStandIn(t)
+
+	hashes := make([][]byte, udpMaxScrape+3)
+	for i := range hashes {
+		hashes[i] = make([]byte, 20)
+		hashes[i][0] = byte(i)
+	}
+
+	stats, err := Scrape(context.Background(), "udp://"+s.addr()+"/announce", hashes)
+	if err != nil {
+		t.Fatalf("Scrape: %v", err)
+	}
+	if len(stats) != len(hashes) {
+		t.Fatalf("got %d stats, want %d", len(stats), len(hashes))
+	}
+	// The stand-in numbers entries within each request, so the second
+	// batch starts over.
+	if stats[udpMaxScrape] != (ScrapeStats{Seeders: 10, Completed: 20, Leechers: 30}) {
+		t.Errorf("first entry of second batch = %+v", stats[udpMaxScrape])
+	}
+}
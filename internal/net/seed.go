@@ -0,0 +1,144 @@
+package net
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"kbit/pkg/types"
+)
+
+// Timings of a seeding session. Variables so tests can speed them up.
+var (
+	seedCheckInterval = time.Second      // how often limits and progress are checked
+	seedFindInterval  = 15 * time.Minute // how often sources are asked again, keeping DHT announces fresh
+)
+
+// SeedLimits end a seeding session early; zero values mean no limit.
+type SeedLimits struct {
+	// Ratio stops seeding once the bytes uploaded reach Ratio times the
+	// torrent's length.
+	Ratio float64
+	// Duration stops seeding after this long.
+	Duration time.Duration
+}
+
+// Seed serves t from the data at path, which is the file itself for a
+// single-file torrent and the torrent's directory for a multi-file one.
+// The data is verified first and must be complete. Peers reach us through
+// ln; the trackers are told we are a seeder (left=0) and sources are asked
+// for peers so that they announce us, and slots of them are uploaded to at
+// a time besides an optimistic unchoke. Seed returns when ctx is done or a
+// limit is reached.
+func Seed(ctx context.Context, t *types.TorrentFile, path string, ln *Listener, slots int, limits SeedLimits, sources ...PeerSource) error {
+	if len(t.Pieces) == 0 {
+		return fmt.Errorf("torrent has no piece hashes; cannot seed")
+	}
+	if t.PieceLength <= 0 {
+		return fmt.Errorf("torrent has no piece length; cannot seed")
+	}
+	if t.Length <= 0 {
+		return fmt.Errorf("torrent has no length; cannot seed")
+	}
+	// Piece lengths are derived from the total length, so the two must
+	// agree before any piece is read.
+	if want := (t.Length + t.PieceLength - 1) / t.PieceLength; int64(len(t.Pieces)) != want {
+		return fmt.Errorf("torrent has %d piece hashes, but its length needs %d; cannot seed", len(t.Pieces), want)
+	}
+
+	data, err := openExisting(path, t)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	fmt.Fprintf(os.Stderr, "Verifying local data...\n")
+	valid, err := verifyPieces(t, data)
+	if err != nil {
+		return err
+	}
+	if valid != len(t.Pieces) {
+		return fmt.Errorf("local data is incomplete: %d/%d pieces match the torrent", valid, len(t.Pieces))
+	}
+
+	stats := NewStats(0)
+	uploader := NewUploader(t, data, stats, slots)
+	for i := range t.Pieces {
+		uploader.SetHave(i)
+	}
+	ln.Serve(uploader)
+	defer ln.Remove(t.InfoHash)
+
+	ctx, cancel := context.WithCancel(ctx)
+	pool := NewPeerPool()
+	announcer := NewAnnouncer(t, pool, stats)
+	if len(t.Tiers) > 0 {
+		go announcer.Run(ctx)
+		defer func() {
+			cancel()
+			<-announcer.Done()
+		}()
+	} else {
+		defer cancel()
+	}
+	go uploader.Run(ctx)
+	feedPool(ctx, t, pool, sources)
+	watchPool(ctx, t, pool, sources)
+
+	fmt.Fprintf(os.Stderr, "Seeding %s on port %d\n", t.Name, ln.Port())
+
+	ticker := time.NewTicker(seedCheckInterval)
+	defer ticker.Stop()
+	find := time.NewTicker(seedFindInterval)
+	defer find.Stop()
+	start := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(os.Stderr, "")
+			return nil
+		case <-find.C:
+			feedPool(ctx, t, pool, sources)
+		case <-ticker.C:
+		}
+
+		uploaded := stats.Uploaded.Load()
+		ratio := float64(uploaded) / float64(t.Length)
+		printSeeding(uploaded, ratio, uploader.Peers())
+
+		if limits.Ratio > 0 && ratio >= limits.Ratio {
+			fmt.Fprintln(os.Stderr, "")
+			fmt.Fprintf(os.Stdout, "Ratio %.2f reached; stopped seeding %s\n", ratio, t.Name)
+			return nil
+		}
+		if limits.Duration > 0 && time.Since(start) >= limits.Duration {
+			fmt.Fprintln(os.Stderr, "")
+			fmt.Fprintf(os.Stdout, "Seeded %s for %s\n", t.Name, limits.Duration)
+			return nil
+		}
+	}
+}
+
+// verifyPieces hashes every piece of data and returns how many match t.
+func verifyPieces(t *types.TorrentFile, data io.ReaderAt) (int, error) {
+	valid := 0
+	buf := make([]byte, t.PieceLength)
+	for i, want := range t.Pieces {
+		piece := buf[:calcPieceLen(t, i)]
+		if _, err := data.ReadAt(piece, int64(i)*t.PieceLength); err != nil {
+			return valid, fmt.Errorf("reading piece %d: %w", i, err)
+		}
+		if h := sha1.Sum(piece); string(h[:]) == string(want) {
+			valid++
+		}
+	}
+	return valid, nil
+}
+
+func printSeeding(uploaded int64, ratio float64, peers int) {
+	fmt.Fprintf(os.Stderr, "\rSeeding: uploaded %s (ratio %.2f) | %d peers   ", formatBytes(uploaded), ratio, peers)
+}
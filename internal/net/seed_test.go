@@ -0,0 +1,169 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kbit/pkg/types"
+)
+
+func TestOpenExisting_RenamedRoots(t *testing.T) {
+	dir := t.TempDir()
+	st, err := openStorage(dir, multiFileTorrent())
+	if err != nil {
+		t.Fatalf("openStorage: %v", err)
+	}
+	st.WriteAt([]byte("abcdefghij"), 0)
+	st.Close()
+
+	// The top directory of a multi-file torrent may have another name.
+	renamed := filepath.Join(dir, "renamed")
+	if err := os.Rename(filepath.Join(dir, "multi"), renamed); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	st, err = openExisting(renamed, multiFileTorrent())
+	if err != nil {
+		t.Fatalf("openExisting multi-file: %v", err)
+	}
+	got := make([]byte, 10)
+	if _, err := st.ReadAt(got, 0); err != nil || string(got) != "abcdefghij" {
+		t.Errorf("ReadAt = %q, %v", got, err)
+	}
+	st.Close()
+
+	// So may the file of a single-file torrent.
+	single := filepath.Join(dir, "other-name.bin")
+	os.WriteFile(single, []byte("data"), 0o644)
+	st, err = openExisting(single, &types.TorrentFile{Name: "single", Length: 4})
+	if err != nil {
+		t.Fatalf("openExisting single file: %v", err)
+	}
+	st.Close()
+
+	if _, err := openExisting(single, &types.TorrentFile{Name: "single", Length: 5}); err == nil {
+		t.Error("expected an error for a file of the wrong size")
+	}
+	if _, err := openExisting(filepath.Join(dir, "missing"), multiFileTorrent()); err == nil {
+		t.Error("expected an error for missing files")
+	}
+}
+
+// seedPath writes data to a file of its own and returns its path.
+func seedPath(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "seed.bin")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func listenLoopback(t *testing.T) *Listener {
+	t.Helper()
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+func TestSeed_RejectsCorruptData(t *testing.T) {
+	tor, data, _ := seedTorrent(t)
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)-1]++
+
+	err := Seed(context.Background(), tor, seedPath(t, corrupt), listenLoopback(t), DefaultUploadSlots, SeedLimits{})
+	if err == nil {
+		t.Fatal("expected an error seeding corrupt data")
+	}
+}
+
+func TestSeed_RejectsInconsistentTorrent(t *testing.T) {
+	tor, data, _ := seedTorrent(t)
+	path := seedPath(t, data)
+
+	for name, change := range map[string]func(*types.TorrentFile){
+		"too long":        func(t *types.TorrentFile) { t.Length += 2 * t.PieceLength },
+		"too short":       func(t *types.TorrentFile) { t.Length = t.PieceLength },
+		"no length":       func(t *types.TorrentFile) { t.Length = 0 },
+		"negative pieces": func(t *types.TorrentFile) { t.PieceLength = -1 },
+	} {
+		bad := *tor
+		change(&bad)
+		if err := Seed(context.Background(), &bad, path, listenLoopback(t), DefaultUploadSlots, SeedLimits{}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSeed_StopsAtRatio(t *testing.T) {
+	seedCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() { seedCheckInterval = time.Second })
+
+	tor, data, _ := seedTorrent(t)
+	ln := listenLoopback(t)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Seed(context.Background(), tor, seedPath(t, data), ln, DefaultUploadSlots, SeedLimits{Ratio: 1})
+	}()
+
+	// Wait for the seed to take connections.
+	for i := 0; ; i++ {
+		pc, err := DialPeer(ln.Addr().String(), tor.InfoHash)
+		if err == nil {
+			pc.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("seed never accepted a connection: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	leech := *tor
+	leech.Peers = types.HashSet[string]{ln.Addr().String(): {}}
+	t.Chdir(t.TempDir())
+	if err := Download(&leech, nil, DefaultUploadSlots); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if got, _ := os.ReadFile(tor.Name); !bytes.Equal(got, data) {
+		t.Error("downloaded file differs from the seed")
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Seed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("seeding did not stop at ratio 1")
+	}
+}
+
+func TestSeed_StopsAfterDurationOrCancel(t *testing.T) {
+	seedCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() { seedCheckInterval = time.Second })
+
+	tor, data, _ := seedTorrent(t)
+	path := seedPath(t, data)
+
+	start := time.Now()
+	if err := Seed(context.Background(), tor, path, listenLoopback(t), DefaultUploadSlots, SeedLimits{Duration: 50 * time.Millisecond}); err != nil {
+		t.Fatalf("Seed: %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("Seed returned before its time limit")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := Seed(ctx, tor, path, listenLoopback(t), DefaultUploadSlots, SeedLimits{}); err != nil {
+		t.Errorf("Seed after cancel: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package net
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"kbit/pkg/types"
+)
+
+// storage presents the files of a torrent as one contiguous byte range, the
+// way pieces see them, and splits reads and writes at file boundaries.
+type storage struct {
+	files  []*os.File
+	layout []types.File
+}
+
+// openStorage creates every file of t under dir, building parent
+// directories as needed and pre-allocating each file to its final size.
+func openStorage(dir string, t *types.TorrentFile) (*storage, error) {
+	layout := t.Files
+	if len(layout) == 0 {
+		layout = []types.File{{Path: []string{t.Name}, Length: t.Length}}
+	}
+
+	s := &storage{layout: layout}
+	for _, f := range layout {
+		// Paths are sanitized when the torrent is parsed; this is the last
+		// line of defence against writing outside dir.
+		rel := filepath.Join(f.Path...)
+		if !filepath.IsLocal(rel) {
+			s.Close()
+			return nil, fmt.Errorf("refusing to write outside the download directory: %q", rel)
+		}
+
+		path := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("creating directory for %q: %w", path, err)
+		}
+
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("creating output file %q: %w", path, err)
+		}
+		s.files = append(s.files, file)
+
+		if err := file.Truncate(f.Length); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("pre-allocating output file %q: %w", path, err)
+		}
+	}
+
+	return s, nil
+}
+
+// openExisting opens the files of t, already on disk, for reading. root is
+// the file itself for single-file torrents and the torrent's directory for
+// multi-file ones, so either may have been renamed; the paths inside a
+// multi-file torrent must match. Every file must exist and have its full
+// length.
+func openExisting(root string, t *types.TorrentFile) (*storage, error) {
+	layout := t.Files
+	if len(layout) == 0 {
+		layout = []types.File{{Path: []string{t.Name}, Length: t.Length}}
+	}
+
+	s := &storage{layout: layout}
+	for _, f := range layout {
+		path := root
+		if len(f.Path) > 1 {
+			rel := filepath.Join(f.Path[1:]...)
+			if !filepath.IsLocal(rel) {
+				s.Close()
+				return nil, fmt.Errorf("refusing to read outside %q: %q", root, rel)
+			}
+			path = filepath.Join(root, rel)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, file)
+
+		info, err := file.Stat()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if info.IsDir() || info.Size() != f.Length {
+			s.Close()
+			return nil, fmt.Errorf("%q should be a file of %d bytes", path, f.Length)
+		}
+	}
+
+	return s, nil
+}
+
+// WriteAt writes p at offset off of the torrent's concatenated data.
+func (s *storage) WriteAt(p []byte, off int64) (int, error) {
+	return s.span(p, off, func(f *os.File, b []byte, at int64) (int, error) {
+		return f.WriteAt(b, at)
+	})
+}
+
+// ReadAt reads len(p) bytes at offset off of the torrent's concatenated data.
+func (s *storage) ReadAt(p []byte, off int64) (int, error) {
+	return s.span(p, off, func(f *os.File, b []byte, at int64) (int, error) {
+		return f.ReadAt(b, at)
+	})
+}
+
+func (s *storage) span(p []byte, off int64, op func(*os.File, []byte, int64) (int, error)) (int, error) {
+	// Find the first file that ends after off; zero-length files never do.
+	i := sort.Search(len(s.layout), func(i int) bool {
+		return s.layout[i].Offset+s.layout[i].Length > off
+	})
+
+	done := 0
+	for ; done < len(p) && i < len(s.layout); i++ {
+		f := s.layout[i]
+		at := off + int64(done) - f.Offset
+		chunk := min(int64(len(p)-done), f.Length-at)
+		if chunk <= 0 {
+			continue
+		}
+
+		n, err := op(s.files[i], p[done:done+int(chunk)], at)
+		done += n
+		if err != nil {
+			return done, err
+		}
+	}
+
+	if done < len(p) {
+		return done, io.ErrUnexpectedEOF
+	}
+	return done, nil
+}
+
+func (s *storage) Close() error {
+	var firstErr error
+	for _, f := range s.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,108 @@
+package net
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kbit/pkg/types"
+)
+
+func multiFileTorrent() *types.TorrentFile {
+	return &types.TorrentFile{
+		Name:   "multi",
+		Length: 10,
+		Files: []types.File{
+			{Path: []string{"multi", "a.txt"}, Length: 3, Offset: 0},
+			{Path: []string{"multi", "empty"}, Length: 0, Offset: 3},
+			{Path: []string{"multi", "sub", "b.txt"}, Length: 5, Offset: 3},
+			{Path: []string{"multi", "c.txt"}, Length: 2, Offset: 8},
+		},
+	}
+}
+
+func TestStorage_WriteAcrossFileBoundaries(t *testing.T) {
+	dir := t.TempDir()
+	st, err := openStorage(dir, multiFileTorrent())
+	if err != nil {
+		t.Fatalf("openStorage: %v", err)
+	}
+
+	// Two "pieces" of 4 bytes and a final piece of 2.
+	for i, piece := range []string{"abcd", "efgh", "ij"} {
+		if _, err := st.WriteAt([]byte(piece), int64(i*4)); err != nil {
+			t.Fatalf("WriteAt piece %d: %v", i, err)
+		}
+	}
+	st.Close()
+
+	expected := map[string]string{
+		"multi/a.txt":     "abc",
+		"multi/empty":     "",
+		"multi/sub/b.txt": "defgh",
+		"multi/c.txt":     "ij",
+	}
+	for rel, want := range expected {
+		got, err := os.ReadFile(filepath.Join(dir, rel))
+		if err != nil {
+			t.Errorf("reading %s: %v", rel, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s: expected %q, got %q", rel, want, got)
+		}
+	}
+}
+
+func TestStorage_ReadAt(t *testing.T) {
+	st, err := openStorage(t.TempDir(), multiFileTorrent())
+	if err != nil {
+		t.Fatalf("openStorage: %v", err)
+	}
+	defer st.Close()
+
+	st.WriteAt([]byte("abcdefghij"), 0)
+
+	buf := make([]byte, 6)
+	if _, err := st.ReadAt(buf, 2); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if !bytes.Equal(buf, []byte("cdefgh")) {
+		t.Errorf("expected cdefgh, got %q", buf)
+	}
+
+	if _, err := st.ReadAt(make([]byte, 4), 8); err == nil {
+		t.Error("expected error when reading past the end")
+	}
+}
+
+func TestStorage_SingleFileFallback(t *testing.T) {
+	dir := t.TempDir()
+	st, err := openStorage(dir, &types.TorrentFile{Name: "single", Length: 4})
+	if err != nil {
+		t.Fatalf("openStorage: %v", err)
+	}
+	st.WriteAt([]byte("data"), 0)
+	st.Close()
+
+	got, err := os.ReadFile(filepath.Join(dir, "single"))
+	if err != nil || string(got) != "data" {
+		t.Errorf("expected single file with data, got %q (%v)", got, err)
+	}
+}
+
+func TestStorage_RejectsEscapingPaths(t *testing.T) {
+	for _, path := range [][]string{
+		{"..", "evil"},
+		{"/etc", "passwd"},
+		{"a", "..", "..", "b"},
+		{""},
+	} {
+		tor := &types.TorrentFile{Name: "x", Length: 1, Files: []types.File{{Path: path, Length: 1}}}
+		if st, err := openStorage(t.TempDir(), tor); err == nil {
+			st.Close()
+			t.Errorf("%q: expected error for path escaping the download directory", path)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package net
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"kbit/internal/bencode"
+)
+
+// trackerTimeout bounds a one-off announce made while discovering peers.
+// It covers the first two attempts of the UDP retransmit schedule.
+var trackerTimeout = 45 * time.Second
+
+// announceEvent is the event an announce reports. The values are the UDP
+// tracker event codes of BEP 15.
+type announceEvent uint32
+
+const (
+	eventNone announceEvent = iota
+	eventCompleted
+	eventStarted
+	eventStopped
+)
+
+// String returns the event as the HTTP tracker protocol spells it, empty
+// for a regular announce.
+func (e announceEvent) String() string {
+	switch e {
+	case eventCompleted:
+		return "completed"
+	case eventStarted:
+		return "started"
+	case eventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+// announceParams are the per-announce values sent to a tracker.
+type announceParams struct {
+	event      announceEvent
+	uploaded   int64
+	downloaded int64
+	left       int64
+	trackerID  string // echoed back to HTTP trackers that sent one
+}
+
+// AnnounceResponse is a tracker's answer to an announce.
+type AnnounceResponse struct {
+	WarningMessage string
+	Interval       int // seconds until the next regular announce
+	MinInterval    int // seconds announces must at least be apart; 0 if unset
+	TrackerID      string
+	Complete       int // seeders
+	Incomplete     int // leechers
+	Peers          []string
+}
+
+// TrackerFailure is returned when a tracker refuses an announce or scrape
+// with a "failure reason" or a UDP error action.
+type TrackerFailure struct {
+	Reason string
+}
+
+func (e *TrackerFailure) Error() string {
+	return "tracker failure: " + e.Reason
+}
+
+// ScrapeStats are a tracker's counts for one torrent.
+type ScrapeStats struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+// httpAnnounceResponse is the bencoded body of an HTTP announce response.
+// Peers is either a compact string or a list of dictionaries, so it is
+// decoded in a second step.
+type httpAnnounceResponse struct {
+	FailureReason  string             `bencode:"failure reason"`
+	WarningMessage string             `bencode:"warning message"`
+	Interval       int                `bencode:"interval"`
+	MinInterval    int                `bencode:"min interval"`
+	TrackerID      string             `bencode:"tracker id"`
+	Complete       int                `bencode:"complete"`
+	Incomplete     int                `bencode:"incomplete"`
+	Peers          bencode.RawMessage `bencode:"peers"`
+	Peers6         []byte             `bencode:"peers6"`
+}
+
+type dictPeer struct {
+	IP   string `bencode:"ip"`
+	Port int    `bencode:"port"`
+}
+
+// readTrackerBody reads the body of an HTTP tracker response, stopping
+// past the size the hardened decoder accepts so that an endless or huge
+// response is refused rather than buffered.
+func readTrackerBody(r io.Reader) ([]byte, error) {
+	limit := bencode.HardenedOptions.MaxSize
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("response is larger than %d bytes", limit)
+	}
+	return body, nil
+}
+
+// decodeAnnounceResponse decodes the body of an HTTP announce response
+// with the hardened decoder. A "failure reason" is returned as a
+// *TrackerFailure.
+func decodeAnnounceResponse(body []byte) (*AnnounceResponse, error) {
+	var raw httpAnnounceResponse
+	dec := bencode.NewDecoder(bytes.NewReader(body))
+	dec.SetOptions(bencode.HardenedOptions)
+	if err := dec.DecodeInto(&raw); err != nil {
+		return nil, fmt.Errorf("malformed tracker response: %w", err)
+	}
+
+	if raw.FailureReason != "" {
+		return nil, &TrackerFailure{Reason: raw.FailureReason}
+	}
+
+	resp := &AnnounceResponse{
+		WarningMessage: raw.WarningMessage,
+		Interval:       raw.Interval,
+		MinInterval:    raw.MinInterval,
+		TrackerID:      raw.TrackerID,
+		Complete:       raw.Complete,
+		Incomplete:     raw.Incomplete,
+	}
+
+	// BEP 7: IPv6 peers come in their own compact string.
+	resp.Peers = parseCompactPeers6(raw.Peers6)
+
+	if len(raw.Peers) == 0 {
+		return resp, nil
+	}
+
+	if raw.Peers[0] == 'l' {
+		// Dictionary model: a list of {ip, port, peer id}.
+		var peers []dictPeer
+		if err := bencode.Unmarshal(raw.Peers, &peers); err != nil {
+			return nil, fmt.Errorf("malformed peer list: %w", err)
+		}
+		for _, p := range peers {
+			if p.IP == "" || p.Port <= 0 || p.Port > 65535 {
+				continue
+			}
+			if ip := net.ParseIP(p.IP); ip != nil {
+				resp.Peers = append(resp.Peers, PeerAddr(ip, p.Port))
+			} else {
+				resp.Peers = append(resp.Peers, net.JoinHostPort(p.IP, strconv.Itoa(p.Port)))
+			}
+		}
+		return resp, nil
+	}
+
+	var compact []byte
+	if err := bencode.Unmarshal(raw.Peers, &compact); err != nil {
+		return nil, fmt.Errorf("malformed compact peers: %w", err)
+	}
+	resp.Peers = append(resp.Peers, parseCompactPeers(compact)...)
+	return resp, nil
+}
@@ -0,0 +1,273 @@
+package net
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15).
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// udpConnIDLifetime is how long a client may reuse a connection ID.
+	udpConnIDLifetime = time.Minute
+
+	// udpMaxScrape is the most infohashes one scrape request may carry.
+	udpMaxScrape = 74
+)
+
+// The retransmit schedule: the n-th attempt waits udpTimeout * 2^n for a
+// reply, for n from 0 up to udpMaxRetries. Variables so tests can shorten it.
+var (
+	udpTimeout    = 15 * time.Second
+	udpMaxRetries = 8
+)
+
+// announceKey identifies this client to trackers across IP changes.
+var announceKey = func() uint32 {
+	var b [4]byte
+	rand.Read(b[:]) //nolint:errcheck // crypto/rand.Read never fails
+	return binary.BigEndian.Uint32(b[:])
+}()
+
+type udpConnID struct {
+	id      uint64
+	expires time.Time
+}
+
+// udpConnIDs caches connection IDs per tracker host so announces and
+// scrapes within a minute skip the connect round trip.
+var udpConnIDs = struct {
+	sync.Mutex
+	m map[string]udpConnID
+}{m: make(map[string]udpConnID)}
+
+// udpTracker talks to one UDP tracker over a connected socket.
+type udpTracker struct {
+	host string
+	conn net.Conn
+}
+
+var errUDPTimeout = errors.New("udp tracker timed out")
+
+func dialUDPTracker(ctx context.Context, host string) (*udpTracker, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", host)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTracker{host: host, conn: conn}, nil
+}
+
+func (u *udpTracker) Close() error {
+	return u.conn.Close()
+}
+
+func (u *udpTracker) isIPv6() bool {
+	addr, ok := u.conn.RemoteAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() == nil
+}
+
+// udpAnnounce announces infoHash to the UDP tracker at host.
+func udpAnnounce(ctx context.Context, host string, infoHash []byte, p announceParams) (*AnnounceResponse, error) {
+	u, err := dialUDPTracker(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	defer u.Close()
+
+	body := make([]byte, 82)
+	copy(body[0:20], infoHash)
+	copy(body[20:40], PeerID)
+	binary.BigEndian.PutUint64(body[40:48], uint64(p.downloaded))
+	binary.BigEndian.PutUint64(body[48:56], uint64(p.left))
+	binary.BigEndian.PutUint64(body[56:64], uint64(p.uploaded))
+	binary.BigEndian.PutUint32(body[64:68], uint32(p.event))
+	binary.BigEndian.PutUint32(body[68:72], 0) // ip: the sender's
+	binary.BigEndian.PutUint32(body[72:76], announceKey)
+	binary.BigEndian.PutUint32(body[76:80], 0xFFFFFFFF) // num_want: default
+	binary.BigEndian.PutUint16(body[80:82], uint16(ListenPort))
+
+	resp, err := u.request(ctx, udpActionAnnounce, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 {
+		return nil, fmt.Errorf("announce response too short: %d bytes", len(resp))
+	}
+
+	result := &AnnounceResponse{
+		Interval:   int(binary.BigEndian.Uint32(resp[0:4])),
+		Incomplete: int(binary.BigEndian.Uint32(resp[4:8])),
+		Complete:   int(binary.BigEndian.Uint32(resp[8:12])),
+	}
+
+	// Trackers reached over IPv6 answer with 18-byte IPv6 peer entries.
+	if u.isIPv6() {
+		result.Peers = parseCompactPeers6(resp[12:])
+	} else {
+		result.Peers = parseCompactPeers(resp[12:])
+	}
+	return result, nil
+}
+
+// udpScrape asks the UDP tracker at host for the swarm statistics of each
+// infohash, in the same order.
+func udpScrape(ctx context.Context, host string, infoHashes [][]byte) ([]ScrapeStats, error) {
+	if len(infoHashes) == 0 || len(infoHashes) > udpMaxScrape {
+		return nil, fmt.Errorf("scrape needs between 1 and %d infohashes, got %d", udpMaxScrape, len(infoHashes))
+	}
+
+	u, err := dialUDPTracker(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	defer u.Close()
+
+	body := make([]byte, 0, 20*len(infoHashes))
+	for _, h := range infoHashes {
+		body = append(body, h...)
+	}
+
+	resp, err := u.request(ctx, udpActionScrape, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12*len(infoHashes) {
+		return nil, fmt.Errorf("scrape response too short: %d bytes for %d infohashes", len(resp), len(infoHashes))
+	}
+
+	stats := make([]ScrapeStats, len(infoHashes))
+	for i := range stats {
+		entry := resp[i*12:]
+		stats[i] = ScrapeStats{
+			Seeders:   int(binary.BigEndian.Uint32(entry[0:4])),
+			Completed: int(binary.BigEndian.Uint32(entry[4:8])),
+			Leechers:  int(binary.BigEndian.Uint32(entry[8:12])),
+		}
+	}
+	return stats, nil
+}
+
+// request sends action with body and returns the response payload after
+// the action and transaction ID. Lost packets are retransmitted on the
+// BEP 15 schedule, connecting first whenever there is no valid cached
+// connection ID.
+func (u *udpTracker) request(ctx context.Context, action uint32, body []byte) ([]byte, error) {
+	for n := 0; n <= udpMaxRetries; n++ {
+		connID, ok := u.cachedConnID()
+		if !ok {
+			resp, err := u.exchange(ctx, n, udpProtocolID, udpActionConnect, nil)
+			if errors.Is(err, errUDPTimeout) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(resp) < 8 {
+				return nil, fmt.Errorf("connect response too short: %d bytes", len(resp))
+			}
+			connID = binary.BigEndian.Uint64(resp[0:8])
+			u.storeConnID(connID)
+		}
+
+		resp, err := u.exchange(ctx, n, connID, action, body)
+		if errors.Is(err, errUDPTimeout) {
+			continue
+		}
+		return resp, err
+	}
+	return nil, fmt.Errorf("tracker %s: no response after %d attempts", u.host, udpMaxRetries+1)
+}
+
+// exchange sends one packet and waits for the matching reply for the
+// timeout of attempt n, ignoring packets with another transaction ID.
+func (u *udpTracker) exchange(ctx context.Context, n int, connID uint64, action uint32, body []byte) ([]byte, error) {
+	var tx [4]byte
+	rand.Read(tx[:]) //nolint:errcheck // crypto/rand.Read never fails
+	txID := binary.BigEndian.Uint32(tx[:])
+
+	packet := make([]byte, 16+len(body))
+	binary.BigEndian.PutUint64(packet[0:8], connID)
+	binary.BigEndian.PutUint32(packet[8:12], action)
+	binary.BigEndian.PutUint32(packet[12:16], txID)
+	copy(packet[16:], body)
+
+	if _, err := u.conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(udpTimeout << n)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	u.conn.SetReadDeadline(deadline)
+
+	buf := make([]byte, 2048)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		read, err := u.conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return nil, ctxErr
+				}
+				return nil, errUDPTimeout
+			}
+			return nil, err
+		}
+		if read < 8 || binary.BigEndian.Uint32(buf[4:8]) != txID {
+			continue
+		}
+
+		gotAction := binary.BigEndian.Uint32(buf[0:4])
+		if gotAction == udpActionError {
+			if action != udpActionConnect {
+				// The tracker may have forgotten our connection ID.
+				u.dropConnID()
+			}
+			return nil, &TrackerFailure{Reason: string(buf[8:read])}
+		}
+		if gotAction != action {
+			return nil, fmt.Errorf("unexpected action %d in reply to %d", gotAction, action)
+		}
+		return append([]byte(nil), buf[8:read]...), nil
+	}
+}
+
+func (u *udpTracker) cachedConnID() (uint64, bool) {
+	udpConnIDs.Lock()
+	defer udpConnIDs.Unlock()
+	c, ok := udpConnIDs.m[u.host]
+	if !ok || time.Now().After(c.expires) {
+		return 0, false
+	}
+	return c.id, true
+}
+
+func (u *udpTracker) storeConnID(id uint64) {
+	udpConnIDs.Lock()
+	defer udpConnIDs.Unlock()
+	udpConnIDs.m[u.host] = udpConnID{id: id, expires: time.Now().Add(udpConnIDLifetime)}
+}
+
+func (u *udpTracker) dropConnID() {
+	udpConnIDs.Lock()
+	defer udpConnIDs.Unlock()
+	delete(udpConnIDs.m, u.host)
+}
@@ -0,0 +1,255 @@
+package net
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kbit/pkg/types"
+)
+
+// udpStandIn is a minimal UDP tracker that answers connect, announce and
+// scrape requests on loopback.
+type udpStandIn struct {
+	conn net.PacketConn
+
+	mu        sync.Mutex
+	drop      int // packets to ignore before answering
+	fail      string
+	connects  int
+	announces int
+	lastLeft  uint64
+}
+
+const standInConnID = 0x1122334455667788
+
+func startUDPStandIn(t *testing.T) *udpStandIn {
+	t.Helper()
+	return startUDPStandInOn(t, "127.0.0.1:0")
+}
+
+func startUDPStandInOn(t *testing.T, addr string) *udpStandIn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skipf("could not listen on %s: %v", addr, err)
+	}
+	s := &udpStandIn{conn: conn}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *udpStandIn) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *udpStandIn) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 16 {
+			continue
+		}
+
+		s.mu.Lock()
+		if s.drop > 0 {
+			s.drop--
+			s.mu.Unlock()
+			continue
+		}
+
+		connID := binary.BigEndian.Uint64(buf[0:8])
+		action := binary.BigEndian.Uint32(buf[8:12])
+		reply := append([]byte{0, 0, 0, 0}, buf[12:16]...)
+		binary.BigEndian.PutUint32(reply[0:4], action)
+
+		switch {
+		case action == udpActionConnect && connID == udpProtocolID:
+			s.connects++
+			reply = binary.BigEndian.AppendUint64(reply, standInConnID)
+		case connID != standInConnID:
+			binary.BigEndian.PutUint32(reply[0:4], udpActionError)
+			reply = append(reply, "bad connection id"...)
+		case s.fail != "":
+			binary.BigEndian.PutUint32(reply[0:4], udpActionError)
+			reply = append(reply, s.fail...)
+		case action == udpActionAnnounce && n >= 98:
+			s.announces++
+			s.lastLeft = binary.BigEndian.Uint64(buf[64:72])
+			reply = binary.BigEndian.AppendUint32(reply, 1800) // interval
+			reply = binary.BigEndian.AppendUint32(reply, 2)    // leechers
+			reply = binary.BigEndian.AppendUint32(reply, 3)    // seeders
+			if from.(*net.UDPAddr).IP.To4() == nil {
+				reply = append(reply, net.ParseIP("2001:db8::1")...)
+				reply = append(reply, 0x1A, 0xE1)
+			} else {
+				reply = append(reply, 10, 0, 0, 1, 0x1A, 0xE1, 10, 0, 0, 2, 0x1A, 0xE2)
+			}
+		case action == udpActionScrape:
+			for i := range (n - 16) / 20 {
+				reply = binary.BigEndian.AppendUint32(reply, uint32(10+i)) // seeders
+				reply = binary.BigEndian.AppendUint32(reply, uint32(20+i)) // completed
+				reply = binary.BigEndian.AppendUint32(reply, uint32(30+i)) // leechers
+			}
+		default:
+			s.mu.Unlock()
+			continue
+		}
+		s.mu.Unlock()
+
+		s.conn.WriteTo(reply, from) //nolint:errcheck
+	}
+}
+
+func shortUDPSchedule(t *testing.T, timeout time.Duration, retries int) {
+	t.Helper()
+	oldTimeout, oldRetries := udpTimeout, udpMaxRetries
+	udpTimeout, udpMaxRetries = timeout, retries
+	t.Cleanup(func() { udpTimeout, udpMaxRetries = oldTimeout, oldRetries })
+}
+
+func TestUDPAnnounce_ReusesConnectionID(t *testing.T) {
+	PeerID = []byte("-GT0001-LOCALPEERID-")
+	s := startUDPStandIn(t)
+	infoHash := []byte("01234567890123456789")
+
+	for range 2 {
+		resp, err := udpAnnounce(context.Background(), s.addr(), infoHash, announceParams{left: 4096})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resp.Interval != 1800 || resp.Incomplete != 2 || resp.Complete != 3 {
+			t.Errorf("unexpected response %+v", resp)
+		}
+		if len(resp.Peers) != 2 || resp.Peers[0] != "10.0.0.1:6881" || resp.Peers[1] != "10.0.0.2:6882" {
+			t.Errorf("unexpected peers %v", resp.Peers)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connects != 1 || s.announces != 2 {
+		t.Errorf("expected 1 connect and 2 announces, got %d and %d", s.connects, s.announces)
+	}
+	if s.lastLeft != 4096 {
+		t.Errorf("expected left 4096, got %d", s.lastLeft)
+	}
+}
+
+func TestUDPAnnounce_Retransmits(t *testing.T) {
+	PeerID = []byte("-GT0001-LOCALPEERID-")
+	shortUDPSchedule(t, 20*time.Millisecond, 3)
+	s := startUDPStandIn(t)
+	s.mu.Lock()
+	s.drop = 2
+	s.mu.Unlock()
+
+	if _, err := udpAnnounce(context.Background(), s.addr(), make([]byte, 20), announceParams{}); err != nil {
+		t.Fatalf("expected announce to succeed after retransmits, got: %v", err)
+	}
+}
+
+func TestUDPAnnounce_GivesUp(t *testing.T) {
+	PeerID = []byte("-GT0001-LOCALPEERID-")
+	shortUDPSchedule(t, 10*time.Millisecond, 1)
+	s := startUDPStandIn(t)
+	s.mu.Lock()
+	s.drop = 100
+	s.mu.Unlock()
+
+	_, err := udpAnnounce(context.Background(), s.addr(), make([]byte, 20), announceParams{})
+	if err == nil || !strings.Contains(err.Error(), "no response") {
+		t.Errorf("expected no response error, got: %v", err)
+	}
+}
+
+func TestUDPAnnounce_ContextCancel(t *testing.T) {
+	PeerID = []byte("-GT0001-LOCALPEERID-")
+	s := startUDPStandIn(t)
+	s.mu.Lock()
+	s.drop = 100
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := udpAnnounce(ctx, s.addr(), make([]byte, 20), announceParams{}); err == nil {
+		t.Error("expected error when the context expires")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("announce did not stop at the context deadline")
+	}
+}
+
+func TestUDPAnnounce_TrackerError(t *testing.T) {
+	PeerID = []byte("-GT0001-LOCALPEERID-")
+	s := startUDPStandIn(t)
+	s.mu.Lock()
+	s.fail = "torrent not registered"
+	s.mu.Unlock()
+
+	_, err := udpAnnounce(context.Background(), s.addr(), make([]byte, 20), announceParams{})
+	if err == nil || !strings.Contains(err.Error(), "torrent not registered") {
+		t.Errorf("expected tracker error, got: %v", err)
+	}
+	if _, ok := (&udpTracker{host: s.addr()}).cachedConnID(); ok {
+		t.Error("expected connection ID to be dropped after an error")
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	s := startUDPStandIn(t)
+	hashes := [][]byte{make([]byte, 20), make([]byte, 20)}
+
+	stats, err := udpScrape(context.Background(), s.addr(), hashes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []ScrapeStats{{10, 20, 30}, {11, 21, 31}}
+	if len(stats) != 2 || stats[0] != expected[0] || stats[1] != expected[1] {
+		t.Errorf("expected %v, got %v", expected, stats)
+	}
+
+	if _, err := udpScrape(context.Background(), s.addr(), nil); err == nil {
+		t.Error("expected error for empty scrape")
+	}
+}
+
+func TestDiscoverPeers_UDPTracker(t *testing.T) {
+	PeerID = []byte("-GT0001-LOCALPEERID-")
+	s := startUDPStandIn(t)
+
+	torrent := &types.TorrentFile{
+		InfoHash: make([]byte, 20),
+		Length:   1,
+		Tiers:    [][]string{{"udp://" + s.addr() + "/announce"}},
+	}
+	if err := DiscoverPeers(torrent); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := torrent.Peers["10.0.0.1:6881"]; !ok || len(torrent.Peers) != 2 {
+		t.Errorf("unexpected peers %v", torrent.Peers)
+	}
+}
+
+func TestUDPAnnounce_IPv6Peers(t *testing.T) {
+	PeerID = []byte("-GT0001-LOCALPEERID-")
+	s := startUDPStandInOn(t, "[::1]:0")
+
+	resp, err := udpAnnounce(context.Background(), s.addr(), make([]byte, 20), announceParams{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0] != "[2001:db8::1]:6881" {
+		t.Errorf("unexpected peers %v", resp.Peers)
+	}
+}
@@ -0,0 +1,452 @@
+package net
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kbit/internal/logger"
+	"kbit/pkg/types"
+)
+
+const (
+	// maxRequestLength is the largest block a peer may request; longer
+	// requests close the connection.
+	maxRequestLength = 128 * 1024
+
+	// uploadIdleTimeout closes connections that send nothing, not even a
+	// keep-alive, for this long.
+	uploadIdleTimeout = 3 * time.Minute
+)
+
+// Uploader serves the verified pieces of one torrent to the peers that
+// connect to us, giving its upload slots out with a choker.
+type Uploader struct {
+	torrent *types.TorrentFile
+	data    io.ReaderAt
+	stats   *Stats
+	choker  *choker
+
+	mu     sync.Mutex
+	have   []byte // bitfield of verified pieces
+	count  int    // pieces set in have
+	recent []int  // the pieces verified last, newest last
+	conns  map[*uploadConn]struct{}
+	credit map[string]int64 // bytes downloaded from each host
+}
+
+// NewUploader returns an Uploader for t reading piece data from data,
+// which holds the torrent's files as one contiguous range. It starts
+// with no pieces; mark them with SetHave once verified. stats, when not
+// nil, counts the bytes uploaded. slots peers are unchoked for their rates,
+// besides one optimistic unchoke.
+func NewUploader(t *types.TorrentFile, data io.ReaderAt, stats *Stats, slots int) *Uploader {
+	u := &Uploader{
+		torrent: t,
+		data:    data,
+		stats:   stats,
+		have:    make([]byte, (len(t.Pieces)+7)/8),
+		conns:   make(map[*uploadConn]struct{}),
+		credit:  make(map[string]int64),
+	}
+	u.choker = newChoker(slots, u.complete)
+	return u
+}
+
+// Run rechokes the connected peers every 10 seconds until ctx is done.
+// Without it, upload slots are only handed out as peers come and go.
+func (u *Uploader) Run(ctx context.Context) {
+	u.choker.run(ctx)
+}
+
+// Credit records n bytes downloaded from the peer at addr. While we are
+// downloading, upload slots go to the hosts we download from fastest.
+func (u *Uploader) Credit(addr string, n int) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	u.mu.Lock()
+	u.credit[host] += int64(n)
+	u.mu.Unlock()
+}
+
+// complete reports whether every piece is verified, that is, whether we
+// are seeding.
+func (u *Uploader) complete() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.count == len(u.torrent.Pieces)
+}
+
+// SetHave marks piece i as verified, so it is served from now on, and
+// tells the connected peers about it.
+func (u *Uploader) SetHave(i int) {
+	u.mu.Lock()
+	if u.has(i) {
+		u.mu.Unlock()
+		return
+	}
+	u.have[i/8] |= 0x80 >> (i % 8)
+	u.count++
+	u.recent = append(u.recent, i)
+	if len(u.recent) > suggestCount {
+		u.recent = u.recent[1:]
+	}
+	conns := make([]*uploadConn, 0, len(u.conns))
+	for c := range u.conns {
+		conns = append(conns, c)
+	}
+	u.mu.Unlock()
+
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(i))
+	for _, c := range conns {
+		c.pc.SendMsg(MsgHave, payload) //nolint:errcheck // the reader notices a dead connection
+	}
+}
+
+// Peers returns how many peers are connected to u.
+func (u *Uploader) Peers() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.conns)
+}
+
+// Bitfield returns a copy of the bitfield of verified pieces.
+func (u *Uploader) Bitfield() []byte {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]byte(nil), u.have...)
+}
+
+func (u *Uploader) has(i int) bool {
+	return i >= 0 && i < len(u.torrent.Pieces) && u.have[i/8]&(0x80>>(i%8)) != 0
+}
+
+// blockRequest is a block a peer asked for.
+type blockRequest struct {
+	index, begin, length int
+}
+
+// uploadConn is one peer we upload to. Requests are queued by the reading
+// side and answered in order by the writing side, so a cancel can still
+// take back a request that is waiting.
+type uploadConn struct {
+	pc   *PeerConn
+	u    *Uploader
+	sent atomic.Int64
+
+	fast    bool         // the peer negotiated the Fast Extension
+	allowed map[int]bool // pieces served even while the peer is choked
+
+	mu         sync.Mutex
+	queue      []blockRequest
+	choked     bool
+	interested bool
+	wake       chan struct{}
+}
+
+func (c *uploadConn) isInterested() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.interested
+}
+
+func (c *uploadConn) uploaded() int64 { return c.sent.Load() }
+
+func (c *uploadConn) downloaded() int64 {
+	host, _, err := net.SplitHostPort(c.pc.Addr)
+	if err != nil {
+		host = c.pc.Addr
+	}
+	c.u.mu.Lock()
+	defer c.u.mu.Unlock()
+	return c.u.credit[host]
+}
+
+// setChoked sends Choke or Unchoke when the state changes. Choking drops
+// the requests still queued, as BEP 3 has peers expect; a Fast Extension
+// peer keeps those for allowed fast pieces and is sent a Reject for each
+// of the others.
+func (c *uploadConn) setChoked(choked bool) {
+	c.mu.Lock()
+	if c.choked == choked {
+		c.mu.Unlock()
+		return
+	}
+	c.choked = choked
+	var rejected []blockRequest
+	if choked {
+		kept := c.queue[:0]
+		for _, req := range c.queue {
+			switch {
+			case c.allowed[req.index]:
+				kept = append(kept, req)
+			case c.fast:
+				rejected = append(rejected, req)
+			}
+		}
+		c.queue = kept
+	}
+	c.mu.Unlock()
+
+	id := MsgUnchoke
+	if choked {
+		id = MsgChoke
+	}
+	c.pc.SendMsg(id, nil) //nolint:errcheck // the reader notices a dead connection
+	for _, req := range rejected {
+		c.reject(req)
+	}
+}
+
+// reject tells a Fast Extension peer that req will not be answered.
+func (c *uploadConn) reject(req blockRequest) {
+	c.pc.SendMsg(MsgReject, buildRequestPayload(req.index, req.begin, req.length)) //nolint:errcheck // the reader notices a dead connection
+}
+
+func (c *uploadConn) setInterested(interested bool) {
+	c.mu.Lock()
+	c.interested = interested
+	c.mu.Unlock()
+	c.u.choker.update()
+}
+
+// serve answers pc until it disconnects or breaks the protocol: our
+// bitfield is sent first, the choker decides when the peer may download,
+// and requests for verified pieces are answered from disk. A Fast
+// Extension peer may also download its allowed fast pieces while choked,
+// and has requests we cannot answer rejected rather than ignored.
+func (u *Uploader) serve(pc *PeerConn) error {
+	c := &uploadConn{pc: pc, u: u, fast: pc.Fast(), choked: true, wake: make(chan struct{}, 1)}
+	if c.fast {
+		c.allowed = make(map[int]bool)
+	}
+
+	u.mu.Lock()
+	bitfield := append([]byte(nil), u.have...)
+	count := u.count
+	suggest := append([]int(nil), u.recent...)
+	u.mu.Unlock()
+
+	u.mu.Lock()
+	u.conns[c] = struct{}{}
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		delete(u.conns, c)
+		u.mu.Unlock()
+	}()
+
+	pc.SetDeadline(time.Now().Add(uploadIdleTimeout))
+	if err := pc.sendHaves(bitfield, len(u.torrent.Pieces)); err != nil {
+		return err
+	}
+	if c.fast {
+		if err := u.sendFast(c, count, suggest); err != nil {
+			return err
+		}
+	}
+
+	u.choker.add(c)
+	defer u.choker.remove(c)
+
+	done := make(chan struct{})
+	defer close(done)
+	go u.writeLoop(c, done)
+
+	for {
+		pc.SetDeadline(time.Now().Add(uploadIdleTimeout))
+		msg, err := pc.ReadMsg()
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case MsgInterested:
+			c.setInterested(true)
+
+		case MsgNotInterested:
+			c.setInterested(false)
+
+		case MsgRequest:
+			req, err := u.parseRequest(msg.Payload)
+			if err != nil {
+				// Asking for a piece we lack is a mistake, not an abuse;
+				// only malformed or oversized requests close the
+				// connection.
+				if errors.Is(err, errMissingPiece) {
+					if c.fast {
+						c.reject(req)
+					}
+					continue
+				}
+				return err
+			}
+			c.mu.Lock()
+			queued := (!c.choked || c.allowed[req.index]) && len(c.queue) < localReqQ
+			if queued {
+				c.queue = append(c.queue, req)
+			}
+			c.mu.Unlock()
+			if !queued {
+				if c.fast {
+					c.reject(req)
+				}
+				continue
+			}
+			select {
+			case c.wake <- struct{}{}:
+			default:
+			}
+
+		case MsgCancel:
+			req, err := parseBlock(msg.Payload)
+			if err != nil {
+				return err
+			}
+			if c.cancel(req) && c.fast {
+				c.reject(req)
+			}
+
+		case MsgBitfield:
+			pc.Bitfield = msg.Payload
+
+		default:
+			// Have and unknown messages need no answer.
+		}
+	}
+}
+
+// sendFast sends a Fast Extension peer its allowed fast pieces among
+// those we have, and suggests the pieces we verified last while we still
+// download: those are the ones the peer is least likely to find elsewhere.
+func (u *Uploader) sendFast(c *uploadConn, count int, suggest []int) error {
+	host, _, err := net.SplitHostPort(c.pc.Addr)
+	if err != nil {
+		host = c.pc.Addr
+	}
+	payload := make([]byte, 4)
+	for _, i := range allowedFastSet(net.ParseIP(host), u.torrent.InfoHash, len(u.torrent.Pieces), allowedFastCount) {
+		c.allowed[i] = true
+		u.mu.Lock()
+		have := u.has(i)
+		u.mu.Unlock()
+		if !have {
+			continue
+		}
+		binary.BigEndian.PutUint32(payload, uint32(i))
+		if err := c.pc.SendMsg(MsgAllowedFast, payload); err != nil {
+			return err
+		}
+	}
+
+	if count == len(u.torrent.Pieces) {
+		return nil
+	}
+	for i := len(suggest) - 1; i >= 0; i-- {
+		binary.BigEndian.PutUint32(payload, uint32(suggest[i]))
+		if err := c.pc.SendMsg(MsgSuggest, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errMissingPiece is returned by parseRequest for a well-formed request
+// for a piece we have not verified.
+var errMissingPiece = errors.New("request for a piece we do not have")
+
+// parseRequest checks that a request asks for a block we can serve.
+func (u *Uploader) parseRequest(payload []byte) (blockRequest, error) {
+	req, err := parseBlock(payload)
+	if err != nil {
+		return req, err
+	}
+
+	u.mu.Lock()
+	have := u.has(req.index)
+	u.mu.Unlock()
+	if !have {
+		return req, fmt.Errorf("piece %d: %w", req.index, errMissingPiece)
+	}
+	if req.length <= 0 || req.length > maxRequestLength ||
+		req.begin+req.length > calcPieceLen(u.torrent, req.index) {
+		return req, fmt.Errorf("invalid request for %d bytes at %d of piece %d", req.length, req.begin, req.index)
+	}
+	return req, nil
+}
+
+// cancel drops a queued request that has not been answered yet, and
+// reports whether there was one.
+func (c *uploadConn) cancel(req blockRequest) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, r := range c.queue {
+		if r == req {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// next takes the oldest queued request.
+func (c *uploadConn) next() (blockRequest, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.queue) == 0 {
+		return blockRequest{}, false
+	}
+	req := c.queue[0]
+	c.queue = c.queue[1:]
+	return req, true
+}
+
+func (u *Uploader) writeLoop(c *uploadConn, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-c.wake:
+		}
+
+		for {
+			req, ok := c.next()
+			if !ok {
+				break
+			}
+
+			payload := make([]byte, 8+req.length)
+			binary.BigEndian.PutUint32(payload[0:4], uint32(req.index))
+			binary.BigEndian.PutUint32(payload[4:8], uint32(req.begin))
+			off := int64(req.index)*u.torrent.PieceLength + int64(req.begin)
+			if _, err := u.data.ReadAt(payload[8:], off); err != nil {
+				logger.Log.Warn("reading block to upload failed",
+					slog.Int("piece", req.index),
+					slog.String("error", err.Error()),
+				)
+				c.pc.Close()
+				return
+			}
+			if err := c.pc.SendMsg(MsgPiece, payload); err != nil {
+				return
+			}
+			c.sent.Add(int64(req.length))
+			if u.stats != nil {
+				u.stats.Uploaded.Add(int64(req.length))
+			}
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"kbit/pkg/types"
+)
+
+const (
+	minPieceLength = 16 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+
+	// targetPieces is roughly how many pieces an automatically chosen piece
+	// length aims for.
+	targetPieces = 1500
+)
+
+type CreateOptions struct {
+	Name        string     // defaults to the base name of the source path
+	PieceLength int64      // 0 picks one from the total size
+	Trackers    [][]string // announce URLs grouped into tiers
+	WebSeeds    []string
+	Private     bool
+	Comment     string
+	Source      string
+	CreatedBy   string
+	CreatedAt   time.Time // the zero time leaves out "creation date"
+	Workers     int       // 0 uses one hashing goroutine per CPU
+}
+
+type sourceFile struct {
+	path   string // on disk
+	rel    []string
+	length int64
+}
+
+// Create builds the metainfo dictionary for the file or directory at path.
+// Directories become multi-file torrents with their regular files in
+// lexical order; the pieces are hashed in parallel.
+func Create(path string, opts CreateOptions) (types.BencodeDict, error) {
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	name := opts.Name
+	if name == "" {
+		name = filepath.Base(root)
+	}
+
+	var files []sourceFile
+	if stat.IsDir() {
+		files, err = collectFiles(root)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("directory %s contains no files", path)
+		}
+	} else {
+		files = []sourceFile{{path: root, length: stat.Size()}}
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.length
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = ChoosePieceLength(total)
+	} else if pieceLength < minPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length %d must be a power of two of at least %d", pieceLength, minPieceLength)
+	}
+
+	pieces, err := hashPieces(files, total, pieceLength, opts.Workers)
+	if err != nil {
+		return nil, err
+	}
+
+	info := types.BencodeDict{
+		"name":         types.BencodeString(name),
+		"piece length": types.BencodeInt(pieceLength),
+		"pieces":       types.BencodeString(pieces),
+	}
+	if stat.IsDir() {
+		list := make(types.BencodeList, 0, len(files))
+		for _, f := range files {
+			pathList := make(types.BencodeList, 0, len(f.rel))
+			for _, c := range f.rel {
+				pathList = append(pathList, types.BencodeString(c))
+			}
+			list = append(list, types.BencodeDict{
+				"length": types.BencodeInt(f.length),
+				"path":   pathList,
+			})
+		}
+		info["files"] = list
+	} else {
+		info["length"] = types.BencodeInt(total)
+	}
+	if opts.Private {
+		info["private"] = types.BencodeInt(1)
+	}
+	if opts.Source != "" {
+		info["source"] = types.BencodeString(opts.Source)
+	}
+
+	meta := types.BencodeDict{"info": info}
+	addTrackers(meta, opts.Trackers)
+
+	if len(opts.WebSeeds) > 0 {
+		list := make(types.BencodeList, 0, len(opts.WebSeeds))
+		for _, ws := range opts.WebSeeds {
+			list = append(list, types.BencodeString(ws))
+		}
+		meta["url-list"] = list
+	}
+	if opts.Comment != "" {
+		meta["comment"] = types.BencodeString(opts.Comment)
+	}
+	if opts.CreatedBy != "" {
+		meta["created by"] = types.BencodeString(opts.CreatedBy)
+	}
+	if !opts.CreatedAt.IsZero() {
+		meta["creation date"] = types.BencodeInt(opts.CreatedAt.Unix())
+	}
+
+	return meta, nil
+}
+
+// ChoosePieceLength picks a power-of-two piece length that splits total
+// into about targetPieces pieces, within the sizes clients commonly accept.
+func ChoosePieceLength(total int64) int64 {
+	length := int64(minPieceLength)
+	for length < maxPieceLength && total/length > targetPieces {
+		length *= 2
+	}
+	return length
+}
+
+// addTrackers sets "announce" to the first tracker and, when there is more
+// than one, "announce-list" to every tier (BEP 12).
+func addTrackers(meta types.BencodeDict, tiers [][]string) {
+	var list types.BencodeList
+	count := 0
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+		urls := make(types.BencodeList, 0, len(tier))
+		for _, url := range tier {
+			urls = append(urls, types.BencodeString(url))
+		}
+		list = append(list, urls)
+		count += len(tier)
+	}
+
+	if count == 0 {
+		return
+	}
+	meta["announce"] = list[0].(types.BencodeList)[0]
+	if count > 1 {
+		meta["announce-list"] = list
+	}
+}
+
+func collectFiles(root string) ([]sourceFile, error) {
+	var files []sourceFile
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, sourceFile{
+			path:   path,
+			rel:    strings.Split(filepath.ToSlash(rel), "/"),
+			length: info.Size(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// hashPieces returns the concatenated SHA-1 hashes of every piece of the
+// files laid end to end.
+func hashPieces(files []sourceFile, total, pieceLength int64, workers int) ([]byte, error) {
+	handles := make([]*os.File, len(files))
+	defer func() {
+		for _, h := range handles {
+			if h != nil {
+				h.Close()
+			}
+		}
+	}()
+	for i, f := range files {
+		h, err := os.Open(f.path)
+		if err != nil {
+			return nil, err
+		}
+		handles[i] = h
+	}
+
+	numPieces := int((total + pieceLength - 1) / pieceLength)
+	hashes := make([]byte, numPieces*sha1.Size)
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	indexes := make(chan int)
+	errCh := make(chan error, workers)
+	var wg sync.WaitGroup
+
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for i := range indexes {
+				start := int64(i) * pieceLength
+				n := min(pieceLength, total-start)
+				if err := readSpan(files, handles, buf[:n], start); err != nil {
+					errCh <- fmt.Errorf("hashing piece %d: %w", i, err)
+					return
+				}
+				h := sha1.Sum(buf[:n])
+				copy(hashes[i*sha1.Size:], h[:])
+			}
+		}()
+	}
+
+	go func() {
+		defer close(indexes)
+		for i := range numPieces {
+			select {
+			case indexes <- i:
+			case err := <-errCh:
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	select {
+	case err := <-errCh:
+		return nil, err
+	default:
+	}
+	return hashes, nil
+}
+
+// readSpan fills buf with the bytes at offset off of the files laid end to
+// end.
+func readSpan(files []sourceFile, handles []*os.File, buf []byte, off int64) error {
+	var fileStart int64
+	done := 0
+	for i, f := range files {
+		fileEnd := fileStart + f.length
+		if done < len(buf) && off+int64(done) < fileEnd {
+			at := off + int64(done) - fileStart
+			n := min(int64(len(buf)-done), f.length-at)
+			if _, err := handles[i].ReadAt(buf[done:done+int(n)], at); err != nil {
+				if err == io.EOF {
+					return fmt.Errorf("%s changed size while hashing", f.path)
+				}
+				return err
+			}
+			done += int(n)
+		}
+		fileStart = fileEnd
+	}
+	if done < len(buf) {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
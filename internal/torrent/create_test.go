@@ -0,0 +1,169 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"kbit/pkg/types"
+)
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	rand.Read(b) //nolint:errcheck // crypto/rand.Read never fails
+	return b
+}
+
+func TestCreate_DirectoryRoundTrip(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "content")
+	a := randomBytes(t, 20000)
+	b := randomBytes(t, 30000)
+	writeFile(t, filepath.Join(dir, "a.bin"), a)
+	writeFile(t, filepath.Join(dir, "sub", "b.bin"), b)
+	writeFile(t, filepath.Join(dir, "sub", "empty"), nil)
+
+	meta, err := Create(dir, CreateOptions{
+		PieceLength: 16 * 1024,
+		Trackers:    [][]string{{"udp://a.example:80", "udp://b.example:80"}, {"udp://c.example:80"}},
+		WebSeeds:    []string{"http://seed.example/"},
+		Private:     true,
+		Comment:     "hello",
+		Source:      "TEST",
+		CreatedBy:   "kbit-test",
+		CreatedAt:   time.Unix(1700000000, 0),
+		Workers:     3,
+	})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	encoded, err := Encode(meta)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	infoEncoded, _ := Encode(meta["info"])
+	expectedHash := sha1.Sum([]byte(infoEncoded))
+
+	torrent, err := ParseTorrentFile(writeTempTorrent(t, encoded))
+	if err != nil {
+		t.Fatalf("ParseTorrentFile failed: %v", err)
+	}
+
+	if !bytes.Equal(torrent.InfoHash, expectedHash[:]) {
+		t.Errorf("infohash mismatch: expected %x, got %x", expectedHash, torrent.InfoHash)
+	}
+	if torrent.Name != "content" || !torrent.Private {
+		t.Errorf("unexpected name %q or private %t", torrent.Name, torrent.Private)
+	}
+	if torrent.Length != 50000 {
+		t.Errorf("expected length 50000, got %d", torrent.Length)
+	}
+
+	expectedFiles := []types.File{
+		{Path: []string{"content", "a.bin"}, Length: 20000, Offset: 0},
+		{Path: []string{"content", "sub", "b.bin"}, Length: 30000, Offset: 20000},
+		{Path: []string{"content", "sub", "empty"}, Length: 0, Offset: 50000},
+	}
+	if !reflect.DeepEqual(torrent.Files, expectedFiles) {
+		t.Errorf("expected files %+v, got %+v", expectedFiles, torrent.Files)
+	}
+
+	data := append(append([]byte{}, a...), b...)
+	if len(torrent.Pieces) != 4 {
+		t.Fatalf("expected 4 pieces, got %d", len(torrent.Pieces))
+	}
+	for i, hash := range torrent.Pieces {
+		end := min((i+1)*16*1024, len(data))
+		want := sha1.Sum(data[i*16*1024 : end])
+		if !bytes.Equal(hash, want[:]) {
+			t.Errorf("piece %d hash mismatch", i)
+		}
+	}
+
+	if meta["announce"] != types.BencodeString("udp://a.example:80") {
+		t.Errorf("unexpected announce %v", meta["announce"])
+	}
+	if tiers := meta["announce-list"].(types.BencodeList); len(tiers) != 2 {
+		t.Errorf("expected 2 tiers, got %v", tiers)
+	}
+	for _, key := range []string{"url-list", "comment", "created by", "creation date"} {
+		if _, ok := meta[key]; !ok {
+			t.Errorf("expected %q in metainfo", key)
+		}
+	}
+	if meta["info"].(types.BencodeDict)["source"] != types.BencodeString("TEST") {
+		t.Error("expected source tag in info dict")
+	}
+}
+
+func TestCreate_SingleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "single.bin")
+	writeFile(t, path, randomBytes(t, 1000))
+
+	meta, err := Create(path, CreateOptions{})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	info := meta["info"].(types.BencodeDict)
+	if info["length"] != types.BencodeInt(1000) || info["name"] != types.BencodeString("single.bin") {
+		t.Errorf("unexpected info %v", info)
+	}
+	if _, ok := info["files"]; ok {
+		t.Error("single-file torrent must not have a files list")
+	}
+	if _, ok := meta["announce"]; ok {
+		t.Error("expected no announce without trackers")
+	}
+	if _, ok := meta["creation date"]; ok {
+		t.Error("expected no creation date for the zero time")
+	}
+}
+
+func TestCreate_Errors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	writeFile(t, path, []byte("x"))
+
+	if _, err := Create(path, CreateOptions{PieceLength: 3000}); err == nil {
+		t.Error("expected error for non power of two piece length")
+	}
+	if _, err := Create(path, CreateOptions{PieceLength: 8192}); err == nil {
+		t.Error("expected error for piece length below 16 KiB")
+	}
+	if _, err := Create(filepath.Join(t.TempDir(), "missing"), CreateOptions{}); err == nil {
+		t.Error("expected error for missing source")
+	}
+	if _, err := Create(t.TempDir(), CreateOptions{}); err == nil {
+		t.Error("expected error for empty directory")
+	}
+}
+
+func TestChoosePieceLength(t *testing.T) {
+	tests := map[int64]int64{
+		0:       16 * 1024,
+		1 << 20: 16 * 1024,
+		1 << 30: 1 << 20,
+		1 << 40: 16 << 20,
+	}
+	for total, want := range tests {
+		if got := ChoosePieceLength(total); got != want {
+			t.Errorf("ChoosePieceLength(%d): expected %d, got %d", total, want, got)
+		}
+	}
+}
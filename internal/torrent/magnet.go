@@ -0,0 +1,143 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"kbit/internal/logger"
+	"kbit/pkg/types"
+)
+
+const btihPrefix = "urn:btih:"
+
+// IsMagnet reports whether s looks like a magnet URI rather than a path.
+func IsMagnet(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), "magnet:")
+}
+
+// ParseMagnet reads a magnet URI into a partial TorrentFile. Only the
+// infohash is guaranteed; the name (dn), length (xl), trackers (tr), direct
+// peers (x.pe) and web seeds (ws) are filled in when present. The info
+// dictionary itself, and so the pieces and file list, must be fetched from
+// peers before the torrent can be downloaded.
+func ParseMagnet(uri string) (types.TorrentFile, error) {
+	var torrent types.TorrentFile
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return torrent, fmt.Errorf("invalid magnet URI: %w", err)
+	}
+	if !strings.EqualFold(u.Scheme, "magnet") {
+		return torrent, fmt.Errorf("not a magnet URI: scheme %q", u.Scheme)
+	}
+
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return torrent, fmt.Errorf("invalid magnet URI query: %w", err)
+	}
+
+	for _, xt := range params["xt"] {
+		if !strings.HasPrefix(strings.ToLower(xt), btihPrefix) {
+			continue
+		}
+		torrent.InfoHash, err = decodeBTIH(xt[len(btihPrefix):])
+		if err != nil {
+			return torrent, err
+		}
+		break
+	}
+	if torrent.InfoHash == nil {
+		return torrent, fmt.Errorf("magnet URI has no urn:btih exact topic")
+	}
+
+	torrent.Name = fmt.Sprintf("%x", torrent.InfoHash)
+	if dn := params.Get("dn"); dn != "" {
+		clean, rewrites, err := SanitizePath([]string{dn})
+		if err == nil {
+			logRewrites(rewrites)
+			torrent.Name = clean[0]
+		}
+	}
+
+	if xl := params.Get("xl"); xl != "" {
+		length, err := strconv.ParseInt(xl, 10, 64)
+		if err != nil || length < 0 {
+			return torrent, fmt.Errorf("invalid exact length %q", xl)
+		}
+		torrent.Length = length
+	}
+
+	for _, tr := range params["tr"] {
+		if !supportedTracker(tr) {
+			logger.Log.Warn("skipping unsupported tracker in magnet URI",
+				slog.String("tracker", tr),
+			)
+			continue
+		}
+		if torrent.TrackerURL == "" {
+			torrent.TrackerURL = tr
+		}
+		// Every tr gets a tier of its own, so they are tried in order.
+		torrent.Tiers = append(torrent.Tiers, []string{tr})
+	}
+
+	for _, pe := range params["x.pe"] {
+		if !validPeerAddr(pe) {
+			return torrent, fmt.Errorf("invalid peer address %q", pe)
+		}
+		if torrent.Peers == nil {
+			torrent.Peers = make(types.HashSet[string])
+		}
+		torrent.Peers[pe] = struct{}{}
+	}
+
+	torrent.WebSeeds = params["ws"]
+
+	logger.Log.Info("magnet parsed",
+		slog.String("infohash", fmt.Sprintf("%x", torrent.InfoHash)),
+		slog.String("name", torrent.Name),
+	)
+
+	return torrent, nil
+}
+
+// decodeBTIH accepts the 40-character hex and 32-character base32 forms of
+// a v1 infohash.
+func decodeBTIH(s string) ([]byte, error) {
+	switch len(s) {
+	case 40:
+		hash, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex infohash %q: %w", s, err)
+		}
+		return hash, nil
+	case 32:
+		hash, err := base32.StdEncoding.DecodeString(strings.ToUpper(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base32 infohash %q: %w", s, err)
+		}
+		return hash, nil
+	default:
+		return nil, fmt.Errorf("infohash %q must be 40 hex or 32 base32 characters", s)
+	}
+}
+
+// validPeerAddr checks a host:port or [ipv6]:port peer address.
+func validPeerAddr(addr string) bool {
+	if _, err := netip.ParseAddrPort(addr); err == nil {
+		return true
+	}
+
+	host, port, ok := strings.Cut(addr, ":")
+	if !ok || host == "" || strings.ContainsAny(host, "[]") {
+		return false
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && n > 0
+}
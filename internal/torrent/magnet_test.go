@@ -0,0 +1,99 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+const magnetHash = "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+
+func TestParseMagnet_AllFields(t *testing.T) {
+	uri := "magnet:?xt=urn:btih:" + magnetHash +
+		"&dn=Some+Name" +
+		"&xl=12345" +
+		"&tr=http%3A%2F%2Ftracker.example%2Fannounce" +
+		"&tr=udp%3A%2F%2Fudp.example%3A80" +
+		"&x.pe=10.0.0.1%3A6881&x.pe=%5B2001%3Adb8%3A%3A1%5D%3A51413&x.pe=peer.example%3A6881" +
+		"&ws=http%3A%2F%2Fseed.example%2F"
+
+	torrent, err := ParseMagnet(uri)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if hex.EncodeToString(torrent.InfoHash) != magnetHash {
+		t.Errorf("unexpected infohash %x", torrent.InfoHash)
+	}
+	if torrent.Name != "Some Name" {
+		t.Errorf("unexpected name %q", torrent.Name)
+	}
+	if torrent.Length != 12345 {
+		t.Errorf("unexpected length %d", torrent.Length)
+	}
+	expectedTiers := [][]string{{"http://tracker.example/announce"}, {"udp://udp.example:80"}}
+	if torrent.TrackerURL != "http://tracker.example/announce" || !reflect.DeepEqual(torrent.Tiers, expectedTiers) {
+		t.Errorf("unexpected trackers %q %v", torrent.TrackerURL, torrent.Tiers)
+	}
+	for _, peer := range []string{"10.0.0.1:6881", "[2001:db8::1]:51413", "peer.example:6881"} {
+		if _, ok := torrent.Peers[peer]; !ok {
+			t.Errorf("expected peer %s in %v", peer, torrent.Peers)
+		}
+	}
+	if !reflect.DeepEqual(torrent.WebSeeds, []string{"http://seed.example/"}) {
+		t.Errorf("unexpected web seeds %v", torrent.WebSeeds)
+	}
+	if torrent.InfoBytes != nil || torrent.Pieces != nil {
+		t.Error("expected a partial torrent without metadata")
+	}
+}
+
+func TestParseMagnet_Base32(t *testing.T) {
+	torrent, err := ParseMagnet("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hex.EncodeToString(torrent.InfoHash) != magnetHash {
+		t.Errorf("unexpected infohash %x", torrent.InfoHash)
+	}
+	if torrent.Name != magnetHash {
+		t.Errorf("expected name to default to the infohash, got %q", torrent.Name)
+	}
+}
+
+func TestParseMagnet_SanitizesName(t *testing.T) {
+	torrent, err := ParseMagnet("magnet:?xt=urn:btih:" + magnetHash + "&dn=..%2Fetc")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if torrent.Name != ".._etc" {
+		t.Errorf("unexpected name %q", torrent.Name)
+	}
+}
+
+func TestParseMagnet_Errors(t *testing.T) {
+	tests := map[string]string{
+		"wrong scheme":   "http://example.com/?xt=urn:btih:" + magnetHash,
+		"missing xt":     "magnet:?dn=name",
+		"other urn only": "magnet:?xt=urn:sha1:" + magnetHash,
+		"short hash":     "magnet:?xt=urn:btih:abcd",
+		"bad hex":        "magnet:?xt=urn:btih:" + "zz" + magnetHash[2:],
+		"bad length":     "magnet:?xt=urn:btih:" + magnetHash + "&xl=-1",
+		"bad peer":       "magnet:?xt=urn:btih:" + magnetHash + "&x.pe=nope",
+		"bad peer port":  "magnet:?xt=urn:btih:" + magnetHash + "&x.pe=host%3A99999",
+	}
+	for name, uri := range tests {
+		if _, err := ParseMagnet(uri); err == nil {
+			t.Errorf("%s: expected error for %s", name, uri)
+		}
+	}
+}
+
+func TestIsMagnet(t *testing.T) {
+	if !IsMagnet("MAGNET:?xt=urn:btih:" + magnetHash) {
+		t.Error("expected magnet URI to be recognised")
+	}
+	if IsMagnet("./magnet.torrent") {
+		t.Error("expected path not to be recognised as magnet")
+	}
+}
@@ -0,0 +1,72 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+
+	"kbit/internal/bencode"
+	"kbit/pkg/types"
+)
+
+// ParseInfo completes t, typically a partial torrent from a magnet link,
+// with an info dictionary fetched from peers. The dictionary must hash to
+// t.InfoHash. Trackers, peers and web seeds already in t are kept.
+func ParseInfo(t *types.TorrentFile, infoBytes []byte) error {
+	hash := sha1.Sum(infoBytes)
+	if !bytes.Equal(hash[:], t.InfoHash) {
+		return fmt.Errorf("info dictionary hash %x does not match infohash %x", hash, t.InfoHash)
+	}
+
+	value, err := bencode.NewDecoder(bytes.NewReader(infoBytes)).Decode()
+	if err != nil {
+		return fmt.Errorf("decoding info dictionary: %w", err)
+	}
+	info, ok := value.(types.BencodeDict)
+	if !ok {
+		return fmt.Errorf("expected info to be a BencodeDict, got %T", value)
+	}
+
+	t.InfoBytes = infoBytes
+	return parseInfo(t, info)
+}
+
+type metainfo struct {
+	Announce     string             `bencode:"announce,omitempty"`
+	AnnounceList [][]string         `bencode:"announce-list,omitempty"`
+	URLList      []string           `bencode:"url-list,omitempty"`
+	Info         bencode.RawMessage `bencode:"info"`
+}
+
+// WriteMetainfo writes t as a .torrent file. The info dictionary is copied
+// byte for byte from t.InfoBytes so the file keeps the same infohash.
+func WriteMetainfo(w io.Writer, t *types.TorrentFile) error {
+	if len(t.InfoBytes) == 0 {
+		return fmt.Errorf("torrent has no info dictionary to write")
+	}
+
+	meta := metainfo{
+		Announce: t.TrackerURL,
+		URLList:  t.WebSeeds,
+		Info:     t.InfoBytes,
+	}
+
+	count := 0
+	for _, tier := range t.Tiers {
+		count += len(tier)
+	}
+	if count > 1 {
+		meta.AnnounceList = t.Tiers
+	}
+	if meta.Announce == "" && count > 0 {
+		meta.Announce = t.Tiers[0][0]
+	}
+
+	data, err := bencode.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
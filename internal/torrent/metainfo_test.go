@@ -0,0 +1,94 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"kbit/pkg/types"
+)
+
+func createInfo(t *testing.T) []byte {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "content")
+	writeFile(t, filepath.Join(dir, "a.txt"), []byte("hello"))
+	writeFile(t, filepath.Join(dir, "b", "c.txt"), []byte("world"))
+
+	meta, err := Create(dir, CreateOptions{})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	info, err := Encode(meta["info"])
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	return []byte(info)
+}
+
+func TestParseInfo_CompletesMagnet(t *testing.T) {
+	info := createInfo(t)
+	hash := sha1.Sum(info)
+
+	torrent, err := ParseMagnet(fmt.Sprintf("magnet:?xt=urn:btih:%x&dn=other&ws=http%%3A%%2F%%2Fseed.example%%2F", hash))
+	if err != nil {
+		t.Fatalf("ParseMagnet failed: %v", err)
+	}
+	if err := ParseInfo(&torrent, info); err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+
+	if torrent.Name != "content" || torrent.Length != 10 || len(torrent.Pieces) != 1 {
+		t.Errorf("unexpected torrent %+v", torrent)
+	}
+	expected := []types.File{
+		{Path: []string{"content", "a.txt"}, Length: 5, Offset: 0},
+		{Path: []string{"content", "b", "c.txt"}, Length: 5, Offset: 5},
+	}
+	if !reflect.DeepEqual(torrent.Files, expected) {
+		t.Errorf("expected files %+v, got %+v", expected, torrent.Files)
+	}
+	if len(torrent.WebSeeds) != 1 {
+		t.Error("expected web seeds from the magnet link to be kept")
+	}
+}
+
+func TestParseInfo_RejectsWrongHash(t *testing.T) {
+	info := createInfo(t)
+	torrent := types.TorrentFile{InfoHash: make([]byte, 20)}
+	if err := ParseInfo(&torrent, info); err == nil {
+		t.Error("expected error for info dict not matching the infohash")
+	}
+}
+
+func TestWriteMetainfo_RoundTrip(t *testing.T) {
+	info := createInfo(t)
+	hash := sha1.Sum(info)
+
+	torrent := types.TorrentFile{InfoHash: hash[:], WebSeeds: []string{"http://seed.example/"}}
+	if err := ParseInfo(&torrent, info); err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteMetainfo(&buf, &torrent); err != nil {
+		t.Fatalf("WriteMetainfo failed: %v", err)
+	}
+
+	parsed, err := ParseTorrentFile(writeTempTorrent(t, buf.String()))
+	if err != nil {
+		t.Fatalf("ParseTorrentFile failed: %v", err)
+	}
+	if !bytes.Equal(parsed.InfoHash, hash[:]) {
+		t.Errorf("infohash changed: expected %x, got %x", hash, parsed.InfoHash)
+	}
+	if !reflect.DeepEqual(parsed.WebSeeds, torrent.WebSeeds) {
+		t.Errorf("expected web seeds %v, got %v", torrent.WebSeeds, parsed.WebSeeds)
+	}
+
+	if err := WriteMetainfo(&buf, &types.TorrentFile{}); err == nil {
+		t.Error("expected error without info dictionary")
+	}
+}
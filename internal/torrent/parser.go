@@ -1,33 +1,33 @@
 package torrent
 
 import (
+	"math/rand/v2"
 	"strconv"
 	"fmt"
-	"os"
 	"io"
 	"strings"
+	"unicode/utf8"
 	"log/slog"
-	"kbit/internal/net"
+	"kbit/internal/bencode"
 	"kbit/internal/logger"
 	"crypto/sha1"
 	"kbit/pkg/types"
 )
 
-func ParseTorrentFile(file *os.File) (types.TorrentFile, error) {
+// ParseTorrentFile reads a .torrent file. It only decodes the bytes of r;
+// finding peers for the torrent is a separate step.
+func ParseTorrentFile(file io.Reader) (types.TorrentFile, error) {
 	var torrent types.TorrentFile
 	logger.Log.Info("parsing torrent file")
 
-	data, err := io.ReadAll(file)
+	dec := bencode.NewDecoder(file)
+	dec.Keep("info")
+	value, err := dec.Decode()
 	if err != nil {
 		return torrent, err
 	}
 
-	logger.Log.Debug("file read complete", slog.Int("bytes", len(data)))
-
-	value, err := Decode(string(data))
-	if err != nil {
-		return torrent, err
-	}
+	logger.Log.Debug("file decoded", slog.Int64("bytes", dec.Offset()))
 
 	root, ok := value.(types.BencodeDict)
 	if !ok {
@@ -41,59 +41,181 @@ func ParseTorrentFile(file *os.File) (types.TorrentFile, error) {
 		return torrent, err
 	}
 
+	// The infohash must be taken over the info dict exactly as it appears in
+	// the file; re-encoding a non-canonical dict would yield a hash the rest
+	// of the swarm does not know.
+	infoBytes, _ := dec.Raw("info")
+	torrent.InfoBytes = infoBytes
+
+	hasher := sha1.New()
+	hasher.Write(infoBytes)
+	torrent.InfoHash = hasher.Sum(nil)
+
+	if infoEncoded, err := Encode(info); err != nil || infoEncoded != string(infoBytes) {
+		logger.Log.Warn("info dictionary is not canonically encoded; infohash uses the original bytes")
+	}
+
+	logger.Log.Info("infohash generated",
+		slog.String("infohash", fmt.Sprintf("%x", torrent.InfoHash)),
+	)
+
+	if err := parseInfo(&torrent, info); err != nil {
+		return torrent, err
+	}
+
+	// BEP 19 allows url-list to be a single URL or a list of them.
+	switch urls := root["url-list"].(type) {
+	case types.BencodeString:
+		torrent.WebSeeds = []string{string(urls)}
+	case types.BencodeList:
+		torrent.WebSeeds, _ = stringList(urls)
+	}
+
+	announce, _ := root["announce"].(types.BencodeString)
+	if supportedTracker(string(announce)) {
+		torrent.TrackerURL = string(announce)
+	} else if announce != "" {
+		logger.Log.Warn("torrent file main tracker url does not use http, https or udp",
+			slog.String("tracker", string(announce)),
+		)
+	}
+
+	torrent.Tiers = parseTiers(torrent.TrackerURL, root["announce-list"])
+
+	return torrent, nil
+}
+
+// parseTiers turns announce-list into tracker tiers (BEP 12), dropping
+// unsupported URLs and empty tiers and shuffling each tier. The main
+// announce URL becomes a tier of its own in front when the list does not
+// contain it.
+func parseTiers(announce string, announceList types.BencodeValue) [][]string {
+	var tiers [][]string
+	seen := make(map[string]bool)
+
+	list, _ := announceList.(types.BencodeList)
+	for _, entry := range list {
+		urls, ok := entry.(types.BencodeList)
+		if !ok {
+			continue
+		}
+
+		var tier []string
+		for _, v := range urls {
+			url, ok := v.(types.BencodeString)
+			if !ok || !supportedTracker(string(url)) || seen[string(url)] {
+				continue
+			}
+			seen[string(url)] = true
+			tier = append(tier, string(url))
+		}
+		if len(tier) == 0 {
+			continue
+		}
+
+		rand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+		tiers = append(tiers, tier)
+	}
+
+	if announce != "" && !seen[announce] {
+		tiers = append([][]string{{announce}}, tiers...)
+	}
+	return tiers
+}
+
+// supportedTracker reports whether url uses a tracker protocol the net
+// package speaks.
+func supportedTracker(url string) bool {
+	for _, scheme := range []string{"http://", "https://", "udp://"} {
+		if strings.HasPrefix(url, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseInfo fills in the fields of t that come from the info dictionary:
+// the name, private flag, file layout and piece hashes. t.InfoHash must
+// already be set, as the name falls back to it.
+func parseInfo(t *types.TorrentFile, info types.BencodeDict) error {
 	name, ok := info["name"].(types.BencodeString)
 	if !ok {
 		err := fmt.Errorf("expected to find name at info")
-		return torrent, err
+		return err
 	}
 
-	torrent.Name = string(name)
+	if utf8Name, ok := info["name.utf-8"].(types.BencodeString); ok && utf8.ValidString(string(utf8Name)) {
+		name = utf8Name
+	}
+
+	// The name becomes a file or directory on disk, so it gets the same
+	// treatment as every path component.
+	cleanName, rewrites, err := SanitizePath([]string{string(name)})
+	if err != nil {
+		// Names like "." are what mktorrent writes for the current
+		// directory; fall back to the infohash rather than refusing.
+		fallback := fmt.Sprintf("%x", t.InfoHash)
+		rewrites = []PathRewrite{{Original: string(name), Sanitized: fallback, Reason: err.Error()}}
+		cleanName = []string{fallback}
+	}
+	logRewrites(rewrites)
+	t.Name = cleanName[0]
 
 	logger.Log.Info("torrent metadata",
-		slog.String("name", torrent.Name),
+		slog.String("name", t.Name),
 	)
 
-	privateStr, ok := info["private"].(types.BencodeString)
-	if ok {
-		private, err := strconv.ParseBool(string(privateStr))
+	// BEP 27 defines private as an integer, but some tools write a string.
+	switch private := info["private"].(type) {
+	case types.BencodeInt:
+		t.Private = private == 1
+	case types.BencodeString:
+		value, err := strconv.ParseBool(string(private))
 		if err == nil {
-			torrent.Private = private
+			t.Private = value
 		} else {
 			logger.Log.Warn("invalid private flag",
-				slog.String("value", string(privateStr)),
+				slog.String("value", string(private)),
 			)
 		}
 	}
 
 	length, ok := info["length"].(types.BencodeInt)
 	if ok {
-		torrent.Length = int64(length)
+		t.Length = int64(length)
+		t.Files = []types.File{{Path: []string{t.Name}, Length: t.Length}}
 		logger.Log.Debug("single file torrent",
-			slog.Int64("length", torrent.Length),
+			slog.Int64("length", t.Length),
 		)
 	} else {
 		files, ok := info["files"].(types.BencodeList)
 		if !ok {
 			err := fmt.Errorf("torrent missing length and files")
-			return torrent, err
+			return err
+		}
+
+		parsed, err := parseFiles(t.Name, files)
+		if err != nil {
+			return err
 		}
+		t.Files = parsed
 
 		var total int64
-		for _, file := range files {
-			length, ok := (file.(types.BencodeDict))["length"].(types.BencodeInt)
-			if ok {
-				total += int64(length)
-			}
+		for _, f := range parsed {
+			total += f.Length
 		}
-		torrent.Length = total
+		t.Length = total
 
 		logger.Log.Debug("multi file torrent",
+			slog.Int("files", len(parsed)),
 			slog.Int64("total_length", total),
 		)
 	}
 
 	if pl, ok := info["piece length"].(types.BencodeInt); ok {
-		torrent.PieceLength = int64(pl)
+		t.PieceLength = int64(pl)
 	} else {
 		logger.Log.Warn("piece length not found in info dict")
 	}
@@ -101,63 +223,106 @@ func ParseTorrentFile(file *os.File) (types.TorrentFile, error) {
 	if ps, ok := info["pieces"].(types.BencodeString); ok {
 		raw := []byte(ps)
 		if len(raw)%20 != 0 {
-			return torrent, fmt.Errorf("pieces field length %d is not a multiple of 20", len(raw))
+			return fmt.Errorf("pieces field length %d is not a multiple of 20", len(raw))
 		}
 		n := len(raw) / 20
-		torrent.Pieces = make([][]byte, n)
+		t.Pieces = make([][]byte, n)
 		for i := range n {
 			h := make([]byte, 20)
 			copy(h, raw[i*20:(i+1)*20])
-			torrent.Pieces[i] = h
+			t.Pieces[i] = h
 		}
 	} else {
 		logger.Log.Warn("pieces not found in info dict")
 	}
 
-	infoEncoded, err := Encode(info)
-	if err != nil {
-		return torrent, err
-	}
+	return nil
+}
 
-	hasher := sha1.New()
-	hasher.Write([]byte(infoEncoded))
-	torrent.InfoHash = hasher.Sum(nil)
+// parseFiles turns the info.files list into a file layout rooted at the
+// torrent name, recording where each file starts in the concatenated data.
+func parseFiles(name string, files types.BencodeList) ([]types.File, error) {
+	parsed := make([]types.File, 0, len(files))
+	seen := make(map[string]bool, len(files))
+	var offset int64
 
-	logger.Log.Info("infohash generated",
-		slog.String("infohash", fmt.Sprintf("%x", torrent.InfoHash)),
-	)
+	for i, entry := range files {
+		dict, ok := entry.(types.BencodeDict)
+		if !ok {
+			return nil, fmt.Errorf("files[%d] is not a dictionary", i)
+		}
 
-	announce, _ := root["announce"].(types.BencodeString)
-	if strings.HasPrefix(string(announce), "https://") || strings.HasPrefix(string(announce), "http://") {
-		torrent.TrackerURL = string(announce)
-		temp := make(types.HashSet[string], 1)
-		temp[torrent.TrackerURL] = struct{}{}
+		length, ok := dict["length"].(types.BencodeInt)
+		if !ok || length < 0 {
+			return nil, fmt.Errorf("files[%d] has no valid length", i)
+		}
 
-		net.DiscoverPeers(&torrent, &temp)
-	} else {
-		logger.Log.Warn("torrent file main tracker url does not http/https protocol")
-	}
+		components, err := filePath(dict)
+		if err != nil {
+			return nil, fmt.Errorf("files[%d]: %w", i, err)
+		}
 
+		clean, rewrites, err := SanitizePath(components)
+		if err != nil {
+			return nil, fmt.Errorf("files[%d]: %w", i, err)
+		}
+		logRewrites(rewrites)
 
+		path, rewrite := dedupePath(append([]string{name}, clean...), seen)
+		if rewrite != nil {
+			logRewrites([]PathRewrite{*rewrite})
+		}
 
-	announceList, ok := root["announce-list"].(types.BencodeList)
-	if ok {
-		torrent.Trackers = make(types.HashSet[string])
+		parsed = append(parsed, types.File{Path: path, Length: int64(length), Offset: offset})
+		offset += int64(length)
+	}
 
-		// WHY TORRENT JUST WHY
-		for _, v1 := range announceList {
-			for _, v2 := range (v1.(types.BencodeList)) {
-				url := string(v2.(types.BencodeString))
-				if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
-					continue
-				}
+	return parsed, nil
+}
 
-				torrent.Trackers[url] = struct{}{}
-			}
+// filePath returns the path components of a files entry, preferring
+// path.utf-8 when it is present and valid.
+func filePath(dict types.BencodeDict) ([]string, error) {
+	if components, err := stringList(dict["path.utf-8"]); err == nil {
+		valid := true
+		for _, c := range components {
+			valid = valid && utf8.ValidString(c)
+		}
+		if valid {
+			return components, nil
 		}
+	}
+
+	components, err := stringList(dict["path"])
+	if err != nil {
+		return nil, fmt.Errorf("path: %w", err)
+	}
+	return components, nil
+}
 
-		net.DiscoverPeers(&torrent, &torrent.Trackers)
+func stringList(v types.BencodeValue) ([]string, error) {
+	list, ok := v.(types.BencodeList)
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("missing or empty")
 	}
 
-	return torrent, nil
+	out := make([]string, 0, len(list))
+	for _, item := range list {
+		s, ok := item.(types.BencodeString)
+		if !ok {
+			return nil, fmt.Errorf("contains a non-string component")
+		}
+		out = append(out, string(s))
+	}
+	return out, nil
+}
+
+func logRewrites(rewrites []PathRewrite) {
+	for _, r := range rewrites {
+		logger.Log.Warn("rewrote unsafe path from torrent",
+			slog.String("original", r.Original),
+			slog.String("sanitized", r.Sanitized),
+			slog.String("reason", r.Reason),
+		)
+	}
 }
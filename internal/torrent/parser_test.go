@@ -1,9 +1,15 @@
 package torrent
 
 import (
+	"bytes"
+	"crypto/sha1"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
+
+	"kbit/pkg/types"
 )
 
 func writeTempTorrent(t *testing.T, content string) *os.File {
@@ -147,6 +153,14 @@ func TestParseTorrentFile_MultiFile(t *testing.T) {
 	if torrent.Length != 300 {
 		t.Errorf("expected total length 300, got %d", torrent.Length)
 	}
+
+	expectedFiles := []types.File{
+		{Path: []string{"test-multi", "f1.txt"}, Length: 100, Offset: 0},
+		{Path: []string{"test-multi", "f2.txt"}, Length: 200, Offset: 100},
+	}
+	if !reflect.DeepEqual(torrent.Files, expectedFiles) {
+		t.Errorf("expected files %+v, got %+v", expectedFiles, torrent.Files)
+	}
 	if len(torrent.InfoHash) != 20 {
 		t.Errorf("expected infohash length 20, got %d", len(torrent.InfoHash))
 	}
@@ -200,4 +214,78 @@ func TestParseTorrentFile_NoAnnounce(t *testing.T) {
 	if torrent.Length != 512 {
 		t.Errorf("expected length 512, got %d", torrent.Length)
 	}
+	if len(torrent.Files) != 1 || torrent.Files[0].Path[0] != "simple" {
+		t.Errorf("expected a single file named simple, got %+v", torrent.Files)
+	}
+}
+
+func TestParseTorrentFile_MalformedFiles(t *testing.T) {
+	for _, files := range []string{
+		"li1ee",                         // entry is not a dict
+		"ld4:pathl1:aeee",               // missing length
+		"ld6:lengthi1eee",               // missing path
+		"ld6:lengthi1e4:pathli1eeee",    // non-string path component
+	} {
+		file := writeTempTorrent(t, "d4:infod5:files"+files+"4:name1:xee")
+		if _, err := ParseTorrentFile(file); err == nil {
+			t.Errorf("files %q: expected error", files)
+		}
+	}
+}
+
+func TestParseTorrentFile_NonCanonicalInfoHash(t *testing.T) {
+	// "name" sorts after "length", so this info dict is not canonical.
+	info := "d4:name6:simple6:lengthi512ee"
+	file := writeTempTorrent(t, "d4:info"+info+"e")
+
+	torrent, err := ParseTorrentFile(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := sha1.Sum([]byte(info))
+	if !bytes.Equal(torrent.InfoHash, expected[:]) {
+		t.Errorf("expected infohash %x, got %x", expected, torrent.InfoHash)
+	}
+	if string(torrent.InfoBytes) != info {
+		t.Errorf("expected original info bytes, got %q", torrent.InfoBytes)
+	}
+}
+
+func TestParseTiers(t *testing.T) {
+	list := types.BencodeList{
+		types.BencodeList{types.BencodeString("udp://a:1"), types.BencodeString("udp://b:1"), types.BencodeString("wss://x")},
+		types.BencodeString("not a tier"),
+		types.BencodeList{},
+		types.BencodeList{types.BencodeString("http://c/announce"), types.BencodeInt(3)},
+	}
+
+	tiers := parseTiers("udp://main:1", list)
+	if len(tiers) != 3 {
+		t.Fatalf("expected 3 tiers, got %v", tiers)
+	}
+	if !reflect.DeepEqual(tiers[0], []string{"udp://main:1"}) {
+		t.Errorf("expected the main announce as the first tier, got %v", tiers[0])
+	}
+	first := append([]string(nil), tiers[1]...)
+	sort.Strings(first)
+	if !reflect.DeepEqual(first, []string{"udp://a:1", "udp://b:1"}) {
+		t.Errorf("unexpected second tier %v", tiers[1])
+	}
+	if !reflect.DeepEqual(tiers[2], []string{"http://c/announce"}) {
+		t.Errorf("unexpected third tier %v", tiers[2])
+	}
+
+	// An announce URL already in the list is not added again.
+	tiers = parseTiers("http://c/announce", list)
+	if len(tiers) != 2 {
+		t.Errorf("expected 2 tiers, got %v", tiers)
+	}
+
+	if tiers := parseTiers("", nil); tiers != nil {
+		t.Errorf("expected no tiers, got %v", tiers)
+	}
+	if tiers := parseTiers("udp://main:1", nil); !reflect.DeepEqual(tiers, [][]string{{"udp://main:1"}}) {
+		t.Errorf("expected a single tier, got %v", tiers)
+	}
 }
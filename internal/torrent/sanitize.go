@@ -0,0 +1,155 @@
+package torrent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxComponentLen is the longest file name most filesystems accept, in bytes.
+const maxComponentLen = 255
+
+// PathRewrite records one change the sanitizer made to a name or path from
+// a .torrent file.
+type PathRewrite struct {
+	Original  string
+	Sanitized string
+	Reason    string
+}
+
+func (r PathRewrite) String() string {
+	return fmt.Sprintf("%q -> %q (%s)", r.Original, r.Sanitized, r.Reason)
+}
+
+// windowsReserved are device names that cannot be used as file names on
+// Windows, with or without an extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizePath makes the components of an untrusted path safe to join under
+// a download directory. Empty and "." components are dropped, ".." and
+// reserved names are renamed, path separators and control characters are
+// replaced and over-long components are shortened. Components containing a
+// NUL byte are rejected outright, as is a path with nothing left.
+func SanitizePath(components []string) ([]string, []PathRewrite, error) {
+	var rewrites []PathRewrite
+	clean := make([]string, 0, len(components))
+
+	for _, c := range components {
+		if strings.IndexByte(c, 0) != -1 {
+			return nil, nil, fmt.Errorf("path component %q contains a NUL byte", c)
+		}
+
+		s, reason := sanitizeComponent(c)
+		if reason != "" {
+			rewrites = append(rewrites, PathRewrite{Original: c, Sanitized: s, Reason: reason})
+		}
+		if s != "" {
+			clean = append(clean, s)
+		}
+	}
+
+	if len(clean) == 0 {
+		return nil, nil, fmt.Errorf("path %q is empty after sanitizing", strings.Join(components, "/"))
+	}
+	return clean, rewrites, nil
+}
+
+func sanitizeComponent(c string) (string, string) {
+	switch c {
+	case "":
+		return "", "empty component"
+	case ".":
+		return "", "current directory component"
+	case "..":
+		return "__", "parent directory component"
+	}
+
+	var reasons []string
+	s := c
+
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "_")
+		reasons = append(reasons, "invalid UTF-8")
+	}
+
+	if strings.ContainsAny(s, `/\`) {
+		s = strings.NewReplacer("/", "_", `\`, "_").Replace(s)
+		reasons = append(reasons, "path separator")
+	}
+
+	if strings.ContainsFunc(s, isControl) {
+		s = strings.Map(func(r rune) rune {
+			if isControl(r) {
+				return '_'
+			}
+			return r
+		}, s)
+		reasons = append(reasons, "control character")
+	}
+
+	if trimmed := strings.TrimRight(s, ". "); trimmed != s {
+		s = trimmed + "_"
+		reasons = append(reasons, "trailing dot or space")
+	}
+
+	base, _, _ := strings.Cut(s, ".")
+	if windowsReserved[strings.ToUpper(base)] {
+		s = "_" + s
+		reasons = append(reasons, "reserved name")
+	}
+
+	if len(s) > maxComponentLen {
+		s = truncateComponent(s)
+		reasons = append(reasons, "too long")
+	}
+
+	return s, strings.Join(reasons, ", ")
+}
+
+// truncateComponent shortens s to maxComponentLen bytes on a rune boundary,
+// keeping a short extension intact.
+func truncateComponent(s string) string {
+	ext := ""
+	if i := strings.LastIndexByte(s, '.'); i > 0 && len(s)-i <= 16 {
+		ext = s[i:]
+		s = s[:i]
+	}
+
+	limit := maxComponentLen - len(ext)
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit] + ext
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// dedupePath renames path if its joined form was already seen, by adding a
+// counter to the last component.
+func dedupePath(path []string, seen map[string]bool) ([]string, *PathRewrite) {
+	key := strings.Join(path, "/")
+	if !seen[key] {
+		seen[key] = true
+		return path, nil
+	}
+
+	last := path[len(path)-1]
+	for n := 1; ; n++ {
+		candidate := last + "." + strconv.Itoa(n)
+		renamed := append(append([]string{}, path[:len(path)-1]...), candidate)
+		key := strings.Join(renamed, "/")
+		if !seen[key] {
+			seen[key] = true
+			return renamed, &PathRewrite{Original: last, Sanitized: candidate, Reason: "duplicate path"}
+		}
+	}
+}
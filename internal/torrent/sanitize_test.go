@@ -0,0 +1,122 @@
+package torrent
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSanitizePath(t *testing.T) {
+	tests := []struct {
+		in       []string
+		expected []string
+		rewrites int
+	}{
+		{[]string{"dir", "file.txt"}, []string{"dir", "file.txt"}, 0},
+		{[]string{"..", "..", "etc", "passwd"}, []string{"__", "__", "etc", "passwd"}, 2},
+		{[]string{"/etc", "passwd"}, []string{"_etc", "passwd"}, 1},
+		{[]string{"a/../../b"}, []string{"a_.._.._b"}, 1},
+		{[]string{"", ".", "x"}, []string{"x"}, 2},
+		{[]string{"C:\\Windows"}, []string{"C:_Windows"}, 1},
+		{[]string{"con.txt"}, []string{"_con.txt"}, 1},
+		{[]string{"LPT1"}, []string{"_LPT1"}, 1},
+		{[]string{"tab\there"}, []string{"tab_here"}, 1},
+		{[]string{"trailing. "}, []string{"trailing_"}, 1},
+		{[]string{"bad\xffutf8"}, []string{"bad_utf8"}, 1},
+	}
+
+	for _, tt := range tests {
+		got, rewrites, err := SanitizePath(tt.in)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%q: expected %q, got %q", tt.in, tt.expected, got)
+		}
+		if len(rewrites) != tt.rewrites {
+			t.Errorf("%q: expected %d rewrites, got %v", tt.in, tt.rewrites, rewrites)
+		}
+	}
+}
+
+func TestSanitizePath_Rejects(t *testing.T) {
+	for _, in := range [][]string{{"nul\x00byte"}, {}, {"", "."}} {
+		if _, _, err := SanitizePath(in); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestSanitizePath_TruncatesLongComponents(t *testing.T) {
+	long := strings.Repeat("é", 200) + ".mkv"
+	got, rewrites, err := SanitizePath([]string{long})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got[0]) > maxComponentLen {
+		t.Errorf("expected at most %d bytes, got %d", maxComponentLen, len(got[0]))
+	}
+	if !strings.HasSuffix(got[0], "é.mkv") {
+		t.Errorf("expected extension kept on a rune boundary, got %q", got[0][len(got[0])-10:])
+	}
+	if len(rewrites) != 1 {
+		t.Errorf("expected one rewrite, got %v", rewrites)
+	}
+}
+
+func TestParseTorrentFile_MaliciousPaths(t *testing.T) {
+	content := "d4:infod5:filesl" +
+		"d6:lengthi1e4:pathl2:..2:..6:passwdee" +
+		"d6:lengthi1e4:pathl2:..2:..6:passwdee" +
+		"e4:name5:../..ee"
+	file := writeTempTorrent(t, content)
+
+	torrent, err := ParseTorrentFile(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if torrent.Name != "..__" {
+		t.Errorf("expected sanitized name, got %q", torrent.Name)
+	}
+	expected := [][]string{
+		{"..__", "__", "__", "passwd"},
+		{"..__", "__", "__", "passwd.1"},
+	}
+	for i, f := range torrent.Files {
+		if !reflect.DeepEqual(f.Path, expected[i]) {
+			t.Errorf("file %d: expected %q, got %q", i, expected[i], f.Path)
+		}
+	}
+}
+
+func TestParseTorrentFile_PrefersUTF8Fields(t *testing.T) {
+	content := "d4:infod5:filesl" +
+		"d6:lengthi1e4:pathl3:\xe9t\xe9e10:path.utf-8l5:\xc3\xa9t\xc3\xa9ee" +
+		"e4:name3:\xe9t\xe910:name.utf-85:\xc3\xa9t\xc3\xa9ee"
+	file := writeTempTorrent(t, content)
+
+	torrent, err := ParseTorrentFile(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if torrent.Name != "été" {
+		t.Errorf("expected UTF-8 name, got %q", torrent.Name)
+	}
+	if !reflect.DeepEqual(torrent.Files[0].Path, []string{"été", "été"}) {
+		t.Errorf("expected UTF-8 path, got %q", torrent.Files[0].Path)
+	}
+}
+
+func TestParseTorrentFile_DotNameFallsBackToInfoHash(t *testing.T) {
+	file := writeTempTorrent(t, "d4:infod6:lengthi1e4:name1:.ee")
+
+	torrent, err := ParseTorrentFile(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(torrent.Name) != 40 {
+		t.Errorf("expected hex infohash as name, got %q", torrent.Name)
+	}
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"fmt"
+	"sort"
 )
 
 type BencodeValue interface{
@@ -45,11 +46,17 @@ func (d BencodeDict) Print(indent int) {
 		}
 	}
 
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
 	fmt.Println("{")
-	for k, v := range d {
+	for _, k := range keys {
 		padding(indent + 1)
 		fmt.Printf("%q: ", k)
-		v.Print(indent + 1)
+		d[k].Print(indent + 1)
 		fmt.Println(",")
 	}
 	padding(indent)
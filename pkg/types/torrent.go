@@ -3,12 +3,25 @@ package types
 type TorrentFile struct {
 	Name        string
 	InfoHash    []byte
+	InfoBytes   []byte // the info dict exactly as encoded in the .torrent
 	Length      int64
 	PieceLength int64
 	Pieces      [][]byte // each entry is a 20-byte SHA1 hash
 	Private     bool
+	Files       []File
+	WebSeeds    []string
 
 	TrackerURL string
-	Trackers HashSet[string]
-	Peers HashSet[string]
+	Tiers [][]string // announce-list tiers (BEP 12), tried in order
+	Peers HashSet[string] // host:port, with IPv6 hosts in brackets ([addr]:port)
+}
+
+// File is one file of a torrent's content. Path is relative to the download
+// directory and starts with the torrent name for multi-file torrents, so a
+// single-file torrent has the one-element path [Name]. Offset is where the
+// file begins in the concatenation of all files that pieces are cut from.
+type File struct {
+	Path   []string
+	Length int64
+	Offset int64
 }
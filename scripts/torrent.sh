@@ -3,8 +3,8 @@
 SOURCE="$1"
 OUTPUT="$2"
 PRIVATE="false"        
-CREATOR="mktorrent script"
-PIECE_LENGTH="21"       # 2^21 = 2MB pieces
+CREATOR="kbit-torrent script"
+PIECE_LENGTH="2M"
 
 if [ -z "$SOURCE" ]; then
   echo "Usage: $0 <source_file_or_dir> [output.torrent]"
@@ -29,26 +29,27 @@ TRACKERS=(
   "http://tracker.torrent.eu.org:451/announce"
 )
 
+# Each tracker gets its own tier, tried in order.
 TRACKER_ARGS=()
 for t in "${TRACKERS[@]}"; do
-  TRACKER_ARGS+=("-a" "$t")
+  TRACKER_ARGS+=("-t" "$t")
 done
 
 PRIVATE_FLAG=""
 if [ "$PRIVATE" = "true" ]; then
-  PRIVATE_FLAG="-p"
+  PRIVATE_FLAG="-private"
 fi
 
 echo "Creating torrent..."
 echo "Source: $SOURCE"
 echo "Output: $OUTPUT"
 
-mktorrent \
+"$(dirname "$0")/../bin/kbit-torrent" create \
   $PRIVATE_FLAG \
-  -l "$PIECE_LENGTH" \
-  -n "$(basename "$SOURCE")" \
+  -piece-length "$PIECE_LENGTH" \
+  -name "$(basename "$SOURCE")" \
   -o "$OUTPUT" \
-  -s "$CREATOR" \
+  -created-by "$CREATOR" \
   "${TRACKER_ARGS[@]}" \
   "$SOURCE"
 